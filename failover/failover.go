@@ -0,0 +1,231 @@
+package main
+
+import "fmt"
+import "flag"
+import "time"
+import "strings"
+import "github.com/gomodule/redigo/redis"
+import "github.com/valyala/gorpc"
+import log "github.com/golang/glog"
+
+//和im_debug/cluster.go中的定义保持一致
+const ClusterKey = "im_cluster"
+
+var (
+	masterAddr    = flag.String("master", "", "rpc address of current master, may be unreachable")
+	slaveAddr     = flag.String("slave", "", "rpc address of slave to promote")
+	syncAddr      = flag.String("sync", "", "sync_listen address of slave to promote")
+	otherSlaves   = flag.String("slaves", "", "rpc addresses of other slaves, resync from new master")
+	epoch         = flag.Int64("epoch", 0, "fencing token, 0 means max epoch of all nodes + 1")
+	masterMsgid   = flag.Int64("master_msgid", 0, "next msgid of master when master is unreachable")
+	wait          = flag.Duration("wait", 30*time.Second, "time for slave to catch up with master")
+	force         = flag.Bool("force", false, "promote even if slave may lose messages")
+	redisAddress  = flag.String("redis", "", "redis address, update storage_rpc_pool in im_cluster")
+	redisPassword = flag.String("redis_password", "", "redis password")
+	redisDb       = flag.Int("redis_db", 0, "redis db")
+)
+
+func newClient(addr string) *gorpc.DispatcherClient {
+	c := &gorpc.Client{
+		Conns:          1,
+		Addr:           addr,
+		RequestTimeout: 30 * time.Second,
+	}
+	c.Start()
+
+	dispatcher := gorpc.NewDispatcher()
+	dispatcher.AddFunc("GetReplicaStatus", GetReplicaStatusInterface)
+	dispatcher.AddFunc("FenceMaster", FenceMasterInterface)
+	dispatcher.AddFunc("PromoteSlave", PromoteSlaveInterface)
+	dispatcher.AddFunc("ReplicateMaster", ReplicateMasterInterface)
+	return dispatcher.NewFuncClient(c)
+}
+
+func getStatus(dc *gorpc.DispatcherClient) (*ReplicaStatus, error) {
+	resp, err := dc.CallTimeout("GetReplicaStatus", nil, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*ReplicaStatus), nil
+}
+
+// waitCatchUp 等待slave同步到msgid
+func waitCatchUp(dc *gorpc.DispatcherClient, msgid int64) (*ReplicaStatus, error) {
+	deadline := time.Now().Add(*wait)
+	for {
+		status, err := getStatus(dc)
+		if err != nil {
+			return nil, err
+		}
+		if status.NextMsgid >= msgid || time.Now().After(deadline) {
+			return status, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// updatePool 把storage_rpc_pool中旧的master替换为新的master, 保留权重
+func updatePool(pool string, master string, replicas []string) (string, bool) {
+	entries := strings.Fields(pool)
+	found := false
+	for i, entry := range entries {
+		addrs := strings.Split(entry, ",")
+		name := addrs[0]
+		weight := ""
+		if n := strings.LastIndex(name, "@"); n >= 0 {
+			name, weight = name[:n], name[n:]
+		}
+		if name != master {
+			continue
+		}
+		entries[i] = strings.Join(append([]string{*slaveAddr + weight}, replicas...), ",")
+		found = true
+	}
+	return strings.Join(entries, " "), found
+}
+
+func publishPool(replicas []string) {
+	conn, err := redis.Dial("tcp", *redisAddress,
+		redis.DialPassword(*redisPassword), redis.DialDatabase(*redisDb))
+	if err != nil {
+		log.Fatal("dial redis err:", err)
+	}
+	defer conn.Close()
+
+	pool, err := redis.String(conn.Do("HGET", ClusterKey, "storage_rpc_pool"))
+	if err != nil {
+		log.Fatal("hget storage_rpc_pool err:", err)
+	}
+	newPool, found := updatePool(pool, *masterAddr, replicas)
+	if !found {
+		log.Fatalf("master:%s not in storage_rpc_pool:%s", *masterAddr, pool)
+	}
+	_, err = conn.Do("HSET", ClusterKey, "storage_rpc_pool", newPool)
+	if err != nil {
+		log.Fatal("hset cluster err:", err)
+	}
+	_, err = conn.Do("PUBLISH", ClusterKey, "failover")
+	if err != nil {
+		log.Warning("publish cluster err:", err)
+	}
+	fmt.Printf("storage_rpc_pool:%s\n", newPool)
+}
+
+func main() {
+	flag.Parse()
+	if len(*slaveAddr) == 0 || len(*syncAddr) == 0 {
+		fmt.Println("usage: failover -slave ip:port -sync ip:port [-master ip:port] [-slaves \"ip:port ...\"] [-redis ip:port]")
+		return
+	}
+
+	slave := newClient(*slaveAddr)
+	slaveStatus, err := getStatus(slave)
+	if err != nil {
+		log.Fatalf("slave:%s err:%s", *slaveAddr, err)
+	}
+	if !slaveStatus.IsSlave {
+		log.Fatalf("%s is not a slave", *slaveAddr)
+	}
+	maxEpoch := slaveStatus.Epoch
+
+	var master *gorpc.DispatcherClient
+	if len(*masterAddr) > 0 {
+		master = newClient(*masterAddr)
+		status, err := getStatus(master)
+		if err != nil {
+			log.Warningf("master:%s unreachable err:%s", *masterAddr, err)
+			master = nil
+		} else if status.Epoch > maxEpoch {
+			maxEpoch = status.Epoch
+		}
+	}
+
+	others := make(map[string]*gorpc.DispatcherClient)
+	var lastMsgid int64
+	for _, addr := range strings.Fields(*otherSlaves) {
+		dc := newClient(addr)
+		status, err := getStatus(dc)
+		if err != nil {
+			log.Warningf("slave:%s unreachable err:%s", addr, err)
+			continue
+		}
+		others[addr] = dc
+		if status.Epoch > maxEpoch {
+			maxEpoch = status.Epoch
+		}
+		if status.NextMsgid > lastMsgid {
+			lastMsgid = status.NextMsgid
+		}
+	}
+
+	if *epoch == 0 {
+		*epoch = maxEpoch + 1
+	} else if *epoch <= maxEpoch {
+		log.Fatalf("epoch:%d must be greater than %d", *epoch, maxEpoch)
+	}
+
+	//确定slave需要同步到的位置
+	target := *masterMsgid
+	if master != nil {
+		resp, err := master.Call("FenceMaster", *epoch)
+		if err != nil {
+			log.Fatalf("fence master:%s err:%s", *masterAddr, err)
+		}
+		target = resp.(*ReplicaStatus).NextMsgid
+		fmt.Printf("master fenced, epoch:%d next msgid:%d\n", *epoch, target)
+	} else if target == 0 {
+		//master不可用时以同步最多的slave为准
+		target = lastMsgid
+		if target == 0 && !*force {
+			log.Fatal("master unreachable, -master_msgid or -force is required")
+		}
+	}
+	if master == nil {
+		//写入的rpc不带epoch, 旧的master没有被fence, 需要确保旧的master已经停止, 否则im仍然可能写入旧的master
+		fmt.Println("master unreachable and not fenced, make sure it is stopped before im reload the cluster")
+	}
+
+	status, err := waitCatchUp(slave, target)
+	if err != nil {
+		log.Fatalf("slave:%s err:%s", *slaveAddr, err)
+	}
+	if status.NextMsgid < target && !*force {
+		log.Fatalf("slave next msgid:%d is behind:%d, master stays fenced, retry or use -force", status.NextMsgid, target)
+	}
+
+	r := &PromoteRequest{Epoch: *epoch, MasterMsgid: target, Force: *force}
+	if *force {
+		r.MasterMsgid = 0
+	}
+	_, err = slave.Call("PromoteSlave", r)
+	if err != nil {
+		log.Fatalf("promote slave:%s err:%s", *slaveAddr, err)
+	}
+	fmt.Printf("slave:%s promoted, epoch:%d next msgid:%d\n", *slaveAddr, *epoch, status.NextMsgid)
+
+	//其它slave和旧的master从新的master同步
+	if master != nil {
+		others[*masterAddr] = master
+	}
+	replicas := make([]string, 0, len(others))
+	for addr, dc := range others {
+		rr := &ReplicateRequest{MasterAddress: *syncAddr, Epoch: *epoch}
+		_, err := dc.Call("ReplicateMaster", rr)
+		if err != nil {
+			log.Errorf("replicate %s err:%s", addr, err)
+			continue
+		}
+		replicas = append(replicas, addr)
+		fmt.Printf("%s replicates from %s\n", addr, *syncAddr)
+	}
+
+	if len(*redisAddress) > 0 {
+		if len(*masterAddr) == 0 {
+			log.Fatal("-master is required to update storage_rpc_pool")
+		}
+		publishPool(replicas)
+	} else {
+		fmt.Printf("replace %s with %s in storage_rpc_pool\n", *masterAddr, strings.Join(append([]string{*slaveAddr}, replicas...), ","))
+	}
+	log.Flush()
+}
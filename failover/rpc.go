@@ -0,0 +1,39 @@
+package main
+
+//和ims_debug/storage_rpc.go, ims_debug/failover.go中的定义保持一致
+
+type ReplicaStatus struct {
+	IsSlave   bool
+	Staleness int64
+	NextMsgid int64
+	Epoch     int64
+	Fenced    bool
+	Master    string
+}
+
+type PromoteRequest struct {
+	Epoch       int64
+	MasterMsgid int64
+	Force       bool
+}
+
+type ReplicateRequest struct {
+	MasterAddress string
+	Epoch         int64
+}
+
+func GetReplicaStatusInterface() *ReplicaStatus {
+	return nil
+}
+
+func FenceMasterInterface(addr string, epoch int64) (*ReplicaStatus, error) {
+	return nil, nil
+}
+
+func PromoteSlaveInterface(addr string, r *PromoteRequest) (*ReplicaStatus, error) {
+	return nil, nil
+}
+
+func ReplicateMasterInterface(addr string, r *ReplicateRequest) (*ReplicaStatus, error) {
+	return nil, nil
+}
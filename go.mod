@@ -9,7 +9,7 @@ require (
 	github.com/golang/glog v1.0.0
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/googollee/go-engine.io v1.4.2
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.0
 	github.com/importcjj/sensitive v0.0.0-20200106142752-42d1c505be7b
 	github.com/richmonkey/cfg v0.0.0-20130815005846-4b1e3c1869d4
 	github.com/stretchr/testify v1.7.0 // indirect
@@ -0,0 +1,150 @@
+package hashring
+
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+import "hash/crc32"
+
+// DefaultReplicas 权重为1的节点在环上的虚拟节点数量
+const DefaultReplicas = 160
+
+// Node 集群中的一个节点，Name一般为ip:port
+type Node struct {
+	Name   string
+	Weight int
+}
+
+func (node Node) String() string {
+	if node.Weight == 1 {
+		return node.Name
+	}
+	return fmt.Sprintf("%s@%d", node.Name, node.Weight)
+}
+
+// ParseNode 解析 ip:port 或者 ip:port@权重
+func ParseNode(s string) (Node, error) {
+	index := strings.LastIndex(s, "@")
+	if index == -1 {
+		return Node{Name: s, Weight: 1}, nil
+	}
+	weight, err := strconv.Atoi(s[index+1:])
+	if err != nil || weight <= 0 {
+		return Node{}, fmt.Errorf("invalid node weight:%s", s)
+	}
+	return Node{Name: s[:index], Weight: weight}, nil
+}
+
+func ParseNodes(strs []string) ([]Node, error) {
+	nodes := make([]Node, 0, len(strs))
+	for _, s := range strs {
+		node, err := ParseNode(s)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Ring 把uid/room id映射到节点
+// 一致性hash模式下增加或删除节点只影响相邻的一部分key,
+// 取模模式和之前的 key % len(nodes) 兼容，节点的顺序必须保持一致
+type Ring struct {
+	modulo bool
+	nodes  []Node
+
+	hashes []uint32 //已排序
+	owners map[uint32]string
+}
+
+// hashKey crc32之后再做一次murmur3的fmix，连续的uid也能均匀分布
+func hashKey(s string) uint32 {
+	h := crc32.ChecksumIEEE([]byte(s))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// New 一致性hash，每个节点有 replicas*权重 个虚拟节点
+func New(nodes []Node, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{nodes: nodes, owners: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < replicas*node.Weight; i++ {
+			h := hashKey(node.Name + "#" + strconv.Itoa(i))
+			//hash冲突时保留名字较小的节点，保证所有进程的结果一致
+			if owner, ok := r.owners[h]; ok {
+				if node.Name < owner {
+					r.owners[h] = node.Name
+				}
+				continue
+			}
+			r.owners[h] = node.Name
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// NewModulo 取模，忽略权重
+func NewModulo(nodes []Node) *Ring {
+	return &Ring{modulo: true, nodes: nodes}
+}
+
+// NewWithMode mode为"mod"时取模，否则使用一致性hash
+func NewWithMode(mode string, nodes []Node, replicas int) *Ring {
+	if mode == "mod" {
+		return NewModulo(nodes)
+	}
+	return New(nodes, replicas)
+}
+
+func (r *Ring) Get(key int64) string {
+	if len(r.nodes) == 0 {
+		return ""
+	}
+	if key < 0 {
+		key = -key
+	}
+	if r.modulo {
+		return r.nodes[key%int64(len(r.nodes))].Name
+	}
+
+	h := hashKey(strconv.FormatInt(key, 10))
+	index := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if index == len(r.hashes) {
+		index = 0
+	}
+	return r.owners[r.hashes[index]]
+}
+
+func (r *Ring) Nodes() []Node {
+	return r.nodes
+}
+
+func (r *Ring) Names() []string {
+	names := make([]string, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+func (r *Ring) IsModulo() bool {
+	return r.modulo
+}
@@ -0,0 +1,90 @@
+package hashring
+
+import "fmt"
+import "testing"
+
+func testNodes(n int) []Node {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{Name: fmt.Sprintf("127.0.0.1:%d", 13333+i), Weight: 1}
+	}
+	return nodes
+}
+
+//取模模式和之前的 uid % n 一致
+func TestModulo(t *testing.T) {
+	tests := []struct {
+		n    int
+		keys []int64
+	}{
+		{1, []int64{0, 1, 2, 100}},
+		{3, []int64{0, 1, 2, 3, 4, 5, 1000001}},
+		{4, []int64{-1, -6, 7, 1 << 40}},
+	}
+	for _, test := range tests {
+		nodes := testNodes(test.n)
+		r := NewWithMode("mod", nodes, 0)
+		for _, key := range test.keys {
+			k := key
+			if k < 0 {
+				k = -k
+			}
+			expect := nodes[k%int64(test.n)].Name
+			if name := r.Get(key); name != expect {
+				t.Errorf("n:%d key:%d got:%s expect:%s", test.n, key, name, expect)
+			}
+		}
+	}
+}
+
+//一致性hash模式下删除一个节点只移动该节点上的key, 数量大约是1/n
+func TestRemoveNode(t *testing.T) {
+	const keys = 100000
+	tests := []int{3, 5, 10}
+	for _, n := range tests {
+		nodes := testNodes(n)
+		r1 := New(nodes, 0)
+		removed := nodes[n/2].Name
+		r2 := New(append(append([]Node{}, nodes[:n/2]...), nodes[n/2+1:]...), 0)
+
+		moved := 0
+		for key := int64(0); key < keys; key++ {
+			a, b := r1.Get(key), r2.Get(key)
+			if a == b {
+				continue
+			}
+			if a != removed {
+				t.Fatalf("n:%d key:%d moved from %s to %s", n, key, a, b)
+			}
+			moved++
+		}
+
+		expect := float64(keys) / float64(n)
+		if float64(moved) < expect*0.7 || float64(moved) > expect*1.3 {
+			t.Errorf("n:%d moved:%d expect about:%.0f", n, moved, expect)
+		}
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		s    string
+		node Node
+		err  bool
+	}{
+		{"127.0.0.1:13333", Node{"127.0.0.1:13333", 1}, false},
+		{"127.0.0.1:13333@3", Node{"127.0.0.1:13333", 3}, false},
+		{"127.0.0.1:13333@0", Node{}, true},
+		{"127.0.0.1:13333@x", Node{}, true},
+	}
+	for _, test := range tests {
+		node, err := ParseNode(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("%s err:%v", test.s, err)
+			continue
+		}
+		if node != test.node {
+			t.Errorf("%s got:%v expect:%v", test.s, node, test.node)
+		}
+	}
+}
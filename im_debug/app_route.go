@@ -48,6 +48,21 @@ func (appRoute *AppRoute) GetUsers() map[int64]IntSet {
 	return r
 }
 
+func (appRoute *AppRoute) GetClients() []*Client {
+	appRoute.mutex.Lock()
+	routes := make([]*Route, 0, len(appRoute.apps))
+	for _, route := range appRoute.apps {
+		routes = append(routes, route)
+	}
+	appRoute.mutex.Unlock()
+
+	clients := make([]*Client, 0)
+	for _, route := range routes {
+		clients = append(clients, route.GetClients()...)
+	}
+	return clients
+}
+
 type ClientSet map[*Client]struct{}
 
 func NewClientSet() ClientSet {
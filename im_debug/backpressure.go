@@ -0,0 +1,193 @@
+package main
+
+import "time"
+import "sort"
+import "container/list"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//待发送队列满时的处理策略
+const PolicyDropOldest = "drop_oldest" //丢弃最早的消息
+const PolicyDropNewest = "drop_newest" //丢弃新消息
+const PolicyDisconnect = "disconnect"  //通知客户端重新同步后断开连接
+
+//被踢出的慢连接等待通知消息发出的最长时间
+const EvictTimeout = 10 * time.Second
+
+// QueuedMessage 待发送队列中的消息
+type QueuedMessage struct {
+	msg  *Message
+	size int       //编码之后的长度，限制队列字节数时入队时计算，否则导出统计时计算
+	tm   time.Time //入队时间
+}
+
+func NewQueuedMessage(msg *Message) *QueuedMessage {
+	//只有限制字节数时才需要计算长度，避免重复编码
+	size := 0
+	if config.messageQueueBytesLimit > 0 {
+		size = MsgHeaderSize + len(msg.ToData())
+	}
+	return &QueuedMessage{msg: msg, size: size, tm: time.Now()}
+}
+
+// Size 编码之后的长度，只计算一次，调用者需持有client.mutex
+func (qm *QueuedMessage) Size() int {
+	if qm.size == 0 {
+		qm.size = MsgHeaderSize + len(qm.msg.ToData())
+	}
+	return qm.size
+}
+
+// BackpressureStat 连接的待发送状态
+type BackpressureStat struct {
+	appid        int64
+	uid          int64
+	deviceId     int64
+	platformId   int8
+	transport    string
+	queueDepth   int   //待发送的消息数量
+	pendingBytes int64 //待发送队列中消息的字节数
+	oldestAge    time.Duration
+	blocked      bool
+	evicted      bool
+}
+
+func (stat *BackpressureStat) ToMap() map[string]interface{} {
+	obj := make(map[string]interface{})
+	obj["appid"] = stat.appid
+	obj["uid"] = stat.uid
+	obj["device_id"] = stat.deviceId
+	obj["platform_id"] = stat.platformId
+	obj["transport"] = stat.transport
+	obj["queue_depth"] = stat.queueDepth
+	obj["pending_bytes"] = stat.pendingBytes
+	obj["oldest_age"] = stat.oldestAge.Seconds()
+	obj["blocked"] = stat.blocked
+	obj["evicted"] = stat.evicted
+	return obj
+}
+
+// isQueueFull 调用者需持有client.mutex
+func (client *Connection) isQueueFull(size int) bool {
+	if client.messages.Len() >= config.messageQueueLimit {
+		return true
+	}
+	limit := config.messageQueueBytesLimit
+	return limit > 0 && client.pendingBytes+int64(size) > limit && client.messages.Len() > 0
+}
+
+// pushMessage 按照慢连接策略将消息加入待发送队列，返回消息是否入队
+func (client *Connection) pushMessage(msg *Message) bool {
+	qm := NewQueuedMessage(msg)
+
+	pushed := true
+	dropped := 0
+	evict := false
+	client.mutex.Lock()
+	if client.isQueueFull(qm.size) {
+		switch config.slowConsumerPolicy {
+		case PolicyDropNewest:
+			pushed = false
+			dropped = 1
+		case PolicyDisconnect:
+			pushed = false
+			evict = true
+		default:
+			//队列阻塞，丢弃之前的消息
+			for client.messages.Len() > 0 && client.isQueueFull(qm.size) {
+				e := client.messages.Front()
+				client.pendingBytes -= int64(e.Value.(*QueuedMessage).size)
+				client.messages.Remove(e)
+				dropped++
+			}
+		}
+	}
+	if pushed {
+		client.messages.PushBack(qm)
+		client.pendingBytes += int64(qm.size)
+	}
+	client.mutex.Unlock()
+
+	if dropped > 0 {
+		atomic.AddInt64(&serverSummary.droppedMessageCount, int64(dropped))
+		log.Infof("message queue full, drop %d message, client:%d", dropped, client.uid)
+	}
+	if evict {
+		client.Evict()
+	}
+	return pushed
+}
+
+// Evict 踢出慢连接：丢弃待发送的消息，通知客户端重新同步后断开连接
+func (client *Connection) Evict() {
+	if !atomic.CompareAndSwapInt32(&client.evicted, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&serverSummary.evictedCount, 1)
+	log.Warningf("evict slow consumer appid:%d uid:%d device id:%d", client.appid, client.uid, client.deviceId)
+
+	client.mutex.Lock()
+	client.messages = list.New()
+	client.messages.PushBack(NewQueuedMessage(&Message{cmd: MsgResync}))
+	client.pendingBytes = 0
+	client.mutex.Unlock()
+
+	select {
+	case client.lwt <- 1:
+	default:
+	}
+	client.wake()
+
+	//写协程阻塞时通知无法发出，超时后直接断开
+	time.AfterFunc(EvictTimeout, func() {
+		client.shutdown()
+	})
+}
+
+func (client *Connection) GetBackpressureStat() *BackpressureStat {
+	stat := &BackpressureStat{
+		appid:      client.appid,
+		uid:        client.uid,
+		deviceId:   client.deviceId,
+		platformId: client.platformId,
+		transport:  client.conn.Name(),
+		blocked:    atomic.LoadInt32(&client.timeoutCount) > 0,
+		evicted:    atomic.LoadInt32(&client.evicted) > 0,
+	}
+
+	client.mutex.Lock()
+	stat.queueDepth = client.messages.Len()
+	if config.messageQueueBytesLimit > 0 {
+		stat.pendingBytes = client.pendingBytes
+	} else {
+		//没有限制字节数时入队不计算长度
+		for e := client.messages.Front(); e != nil; e = e.Next() {
+			stat.pendingBytes += int64(e.Value.(*QueuedMessage).Size())
+		}
+	}
+	if e := client.messages.Front(); e != nil {
+		stat.oldestAge = time.Since(e.Value.(*QueuedMessage).tm)
+	}
+	client.mutex.Unlock()
+
+	stat.queueDepth += len(client.wt) + len(client.pwt)
+	return stat
+}
+
+// GetBackpressureStats 返回待发送消息数量不小于minDepth的连接，按数量降序排列
+func GetBackpressureStats(minDepth int, limit int) []*BackpressureStat {
+	stats := make([]*BackpressureStat, 0)
+	for _, client := range appRoute.GetClients() {
+		stat := client.GetBackpressureStat()
+		if stat.queueDepth >= minDepth {
+			stats = append(stats, stat)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].queueDepth > stats[j].queueDepth
+	})
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
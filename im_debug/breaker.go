@@ -0,0 +1,185 @@
+package main
+
+import "sync"
+import "time"
+import "errors"
+import "sync/atomic"
+import "github.com/valyala/gorpc"
+import log "github.com/golang/glog"
+
+//ack中的status
+const (
+	AckSuccess            = 0
+	AckStorageUnavailable = 1 //ims熔断或者连接失败
+	AckStorageTimeout     = 2 //ims超时，消息可能已经保存
+)
+
+//熔断器状态
+const (
+	BreakerClosed   = 0
+	BreakerOpen     = 1
+	BreakerHalfOpen = 2 //冷却时间结束，允许一个探测请求
+)
+
+var ErrBreakerOpen = errors.New("storage circuit breaker open")
+
+func BreakerStateName(state int) string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return ""
+	}
+}
+
+// CircuitBreaker 连续失败超过storage_breaker_failures次之后熔断,
+// storage_breaker_cooldown之内的请求直接失败，之后允许一个请求探测ims是否恢复
+type CircuitBreaker struct {
+	mutex    sync.Mutex
+	state    int
+	failures int
+	openTime time.Time
+	probing  bool
+}
+
+// Allow 是否允许发送请求
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openTime) < config.storageBreakerCooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Done 记录请求结果，返回状态是否发生变化
+func (b *CircuitBreaker) Done(success bool) (int, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	old := b.state
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+	if success {
+		b.failures = 0
+		b.state = BreakerClosed
+	} else {
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= config.storageBreakerFailures {
+			b.state = BreakerOpen
+			b.openTime = time.Now()
+		}
+	}
+	return b.state, b.state != old
+}
+
+func (b *CircuitBreaker) State() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// StorageStat 每个ims的调用统计
+type StorageStat struct {
+	callCount     int64
+	errorCount    int64
+	timeoutCount  int64
+	rejectedCount int64 //熔断时直接失败的请求数量
+	latency       int64 //最近一次成功调用的耗时(微秒)
+}
+
+func isTimeout(err error) bool {
+	if e, ok := err.(*gorpc.ClientError); ok {
+		return e.Timeout
+	}
+	return false
+}
+
+// AckStatus 保存消息失败时返回给客户端的错误码
+func AckStatus(err error) int8 {
+	if isTimeout(err) {
+		return AckStorageTimeout
+	}
+	return AckStorageUnavailable
+}
+
+// isFailure ims返回的业务错误不计入熔断
+func isFailure(err error) bool {
+	if e, ok := err.(*gorpc.ClientError); ok {
+		return !e.Server
+	}
+	return true
+}
+
+// Call 带超时和熔断的rpc调用
+func (sc *StorageRPCClient) Call(method string, req interface{}) (interface{}, error) {
+	if !sc.breaker.Allow() {
+		atomic.AddInt64(&sc.stat.rejectedCount, 1)
+		return nil, ErrBreakerOpen
+	}
+
+	atomic.AddInt64(&sc.stat.callCount, 1)
+	begin := time.Now()
+	resp, err := sc.dc.CallTimeout(method, req, config.storageTimeout)
+	if err != nil {
+		atomic.AddInt64(&sc.stat.errorCount, 1)
+		if isTimeout(err) {
+			atomic.AddInt64(&sc.stat.timeoutCount, 1)
+		}
+	} else {
+		atomic.StoreInt64(&sc.stat.latency, int64(time.Since(begin)/time.Microsecond))
+	}
+
+	state, changed := sc.breaker.Done(err == nil || !isFailure(err))
+	if changed {
+		log.Warningf("storage:%s circuit breaker:%s", sc.addr, BreakerStateName(state))
+	}
+	return resp, err
+}
+
+func (sc *StorageRPCClient) StatMap() map[string]interface{} {
+	obj := make(map[string]interface{})
+	obj["addr"] = sc.addr
+	obj["healthy"] = sc.IsHealthy()
+	obj["breaker"] = BreakerStateName(sc.breaker.State())
+	obj["call_count"] = atomic.LoadInt64(&sc.stat.callCount)
+	obj["error_count"] = atomic.LoadInt64(&sc.stat.errorCount)
+	obj["timeout_count"] = atomic.LoadInt64(&sc.stat.timeoutCount)
+	obj["rejected_count"] = atomic.LoadInt64(&sc.stat.rejectedCount)
+	obj["latency_us"] = atomic.LoadInt64(&sc.stat.latency)
+	return obj
+}
+
+// GetStorageStats 所有ims和slave的统计，用于/summary
+func GetStorageStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0)
+	for _, c := range getStorageClients() {
+		obj := c.StatMap()
+		replicas := make([]map[string]interface{}, 0, len(c.replicas))
+		for _, r := range c.replicas {
+			m := r.StatMap()
+			m["staleness"] = r.Staleness()
+			replicas = append(replicas, m)
+		}
+		obj["replicas"] = replicas
+		stats = append(stats, obj)
+	}
+	return stats
+}
@@ -5,6 +5,9 @@ import "time"
 import "sync"
 import log "github.com/golang/glog"
 
+//移除之后继续丢弃写入的消息的时间，超过之后没有新的消息时写协程退出
+const ChannelDrainTimeout = 10 * time.Second
+
 type Subscriber struct {
 	uids    map[int64]int
 	roomIds map[int64]int
@@ -27,6 +30,9 @@ type Channel struct {
 	dispatch      func(*AppMessage)
 	dispatchGroup func(*AppMessage)
 	dispatchRoom  func(*AppMessage)
+
+	closed   chan struct{} //从集群中移除时关闭
+	stopOnce sync.Once
 }
 
 func NewChannel(addr string, f1 func(*AppMessage), f2 func(*AppMessage)) *Channel {
@@ -36,6 +42,7 @@ func NewChannel(addr string, f1 func(*AppMessage), f2 func(*AppMessage)) *Channe
 	channel.dispatchRoom = f2
 	channel.addr = addr
 	channel.wt = make(chan *Message, 10)
+	channel.closed = make(chan struct{})
 	return channel
 }
 
@@ -94,6 +101,36 @@ func (channel *Channel) RemoveSubscribe(appid, uid int64, online bool) (int, int
 	return count & 0xffff, count >> 16 & 0xffff
 }
 
+// DeleteSubscribe 删除用户的订阅计数，迁移到其它channel时使用
+func (channel *Channel) DeleteSubscribe(appid, uid int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		return 0
+	}
+	count := subscriber.uids[uid]
+	delete(subscriber.uids, uid)
+	return count
+}
+
+// MergeSubscribe 合并从其它channel迁移过来的订阅计数，返回合并前的计数
+func (channel *Channel) MergeSubscribe(appid, uid int64, count int) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		subscriber = NewSubscriber()
+		channel.subscribers[appid] = subscriber
+	}
+	prev := subscriber.uids[uid]
+	//低16位表示总数量 高16位表示online的数量
+	c1 := prev&0xffff + count&0xffff
+	c2 := prev>>16&0xffff + count>>16&0xffff
+	subscriber.uids[uid] = c2<<16 | c1
+	return prev
+}
+
 func (channel *Channel) GetAllSubscribers() map[int64]*Subscriber {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
@@ -111,7 +148,8 @@ func (channel *Channel) GetAllSubscribers() map[int64]*Subscriber {
 }
 
 // Subscribe online表示用户不再接受推送通知(apns, gcm)
-func (channel *Channel) Subscribe(appid int64, uid int64, online bool) {
+//更新订阅计数，返回需要发送给imr的消息，imr未连接时写入会阻塞，调用方在clusterMutex之外写入
+func (channel *Channel) Subscribe(appid int64, uid int64, online bool) *Message {
 	count, onlineCount := channel.AddSubscribe(appid, uid, online)
 	log.Info("sub count:", count, onlineCount)
 	if count == 0 {
@@ -121,30 +159,29 @@ func (channel *Channel) Subscribe(appid int64, uid int64, online bool) {
 			on = 1
 		}
 		id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on)}
-		msg := &Message{cmd: MsgSubscribe, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgSubscribe, body: id}
 	} else if onlineCount == 0 && online {
 		//手机端上线
 		id := &SubscribeMessage{appid: appid, uid: uid, online: 1}
-		msg := &Message{cmd: MsgSubscribe, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgSubscribe, body: id}
 	}
+	return nil
 }
 
-func (channel *Channel) Unsubscribe(appid int64, uid int64, online bool) {
+// Unsubscribe 更新订阅计数，返回需要发送给imr的消息
+func (channel *Channel) Unsubscribe(appid int64, uid int64, online bool) *Message {
 	count, onlineCount := channel.RemoveSubscribe(appid, uid, online)
 	log.Info("unsub count:", count, onlineCount)
 	if count == 1 {
 		//用户断开全部连接
 		id := &AppUser{appid: appid, uid: uid}
-		msg := &Message{cmd: MsgUnsubscribe, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgUnsubscribe, body: id}
 	} else if count > 1 && onlineCount == 1 && online {
 		//手机端断开连接,pc/web端还未断开连接
 		id := &SubscribeMessage{appid: appid, uid: uid, online: 0}
-		msg := &Message{cmd: MsgSubscribe, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgSubscribe, body: id}
 	}
+	return nil
 }
 
 func (channel *Channel) Publish(amsg *AppMessage) {
@@ -192,6 +229,33 @@ func (channel *Channel) RemoveSubscribeRoom(appid, roomId int64) int {
 	return count
 }
 
+// DeleteSubscribeRoom 删除聊天室的订阅计数，迁移到其它channel时使用
+func (channel *Channel) DeleteSubscribeRoom(appid, roomId int64) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		return 0
+	}
+	count := subscriber.roomIds[roomId]
+	delete(subscriber.roomIds, roomId)
+	return count
+}
+
+// MergeSubscribeRoom 合并从其它channel迁移过来的订阅计数，返回合并前的计数
+func (channel *Channel) MergeSubscribeRoom(appid, roomId int64, count int) int {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	subscriber, ok := channel.subscribers[appid]
+	if !ok {
+		subscriber = NewSubscriber()
+		channel.subscribers[appid] = subscriber
+	}
+	prev := subscriber.roomIds[roomId]
+	subscriber.roomIds[roomId] = prev + count
+	return prev
+}
+
 func (channel *Channel) GetAllRoomSubscribers() []*AppRoom {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
@@ -206,24 +270,26 @@ func (channel *Channel) GetAllRoomSubscribers() []*AppRoom {
 	return subs
 }
 
-func (channel *Channel) SubscribeRoom(appid int64, roomId int64) {
+// SubscribeRoom 更新聊天室的订阅计数，返回需要发送给imr的消息
+func (channel *Channel) SubscribeRoom(appid int64, roomId int64) *Message {
 	count := channel.AddSubscribeRoom(appid, roomId)
 	log.Info("sub room count:", count)
 	if count == 0 {
 		id := &AppRoom{appid: appid, roomId: roomId}
-		msg := &Message{cmd: MsgSubscribeRoom, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgSubscribeRoom, body: id}
 	}
+	return nil
 }
 
-func (channel *Channel) UnsubscribeRoom(appid int64, roomId int64) {
+// UnsubscribeRoom 更新聊天室的订阅计数，返回需要发送给imr的消息
+func (channel *Channel) UnsubscribeRoom(appid int64, roomId int64) *Message {
 	count := channel.RemoveSubscribeRoom(appid, roomId)
 	log.Info("unsub room count:", count)
 	if count == 1 {
 		id := &AppRoom{appid: appid, roomId: roomId}
-		msg := &Message{cmd: MsgUnsubscribeRoom, body: id}
-		channel.wt <- msg
+		return &Message{cmd: MsgUnsubscribeRoom, body: id}
 	}
+	return nil
 }
 
 func (channel *Channel) PublishRoom(amsg *AppMessage) {
@@ -306,6 +372,9 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 		case _ = <-closedCh:
 			log.Info("channel closed")
 			return
+		case <-channel.closed:
+			log.Infof("channel:%s removed from cluster", channel.addr)
+			return
 		case msg := <-channel.wt:
 			seq = seq + 1
 			msg.seq = seq
@@ -320,7 +389,7 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 
 func (channel *Channel) Run() {
 	nsleep := 100
-	for {
+	for !channel.IsClosed() {
 		conn, err := net.Dial("tcp", channel.addr)
 		if err != nil {
 			log.Info("connect route server error:", err)
@@ -329,7 +398,10 @@ func (channel *Channel) Run() {
 				nsleep = 60 * 1000
 			}
 			log.Info("channel sleep:", nsleep)
-			time.Sleep(time.Duration(nsleep) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(nsleep) * time.Millisecond):
+			case <-channel.closed:
+			}
 			continue
 		}
 		tconn := conn.(*net.TCPConn)
@@ -339,6 +411,32 @@ func (channel *Channel) Run() {
 		nsleep = 100
 		channel.RunOnce(tconn)
 	}
+
+	//移除之后仍然持有该channel的调用方不能被阻塞，丢弃之后写入的消息
+	for {
+		select {
+		case msg := <-channel.wt:
+			log.Warningf("channel:%s removed, drop message:%s", channel.addr, Command(msg.cmd))
+		case <-time.After(ChannelDrainTimeout):
+			return
+		}
+	}
+}
+
+func (channel *Channel) IsClosed() bool {
+	select {
+	case <-channel.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop 断开和imr的连接，imr会清理该连接上的订阅
+func (channel *Channel) Stop() {
+	channel.stopOnce.Do(func() {
+		close(channel.closed)
+	})
 }
 
 func (channel *Channel) Start() {
@@ -1,8 +1,6 @@
 package main
 
-import (
-	"net"
-)
+import "net"
 import "time"
 import "sync/atomic"
 import log "github.com/golang/glog"
@@ -14,26 +12,32 @@ type Client struct {
 	//*GroupClient
 	*RoomClient
 	publicIp int32
+
+	seq       int   //下发消息的序号，只在写协程中访问
+	scheduled int32 //是否已加入写协程池(epoll模式)
+}
+
+func NewClient(conn Transport) *Client {
+	return newClient(conn, 300, 10)
 }
 
-func NewClient(conn interface{}) *Client {
+func newClient(conn Transport, wtSize int, pwtSize int) *Client {
 	client := new(Client)
 
 	//初始化Connection
-	client.conn = conn // conn is net.Conn or engineio.Conn
+	client.conn = conn
 
-	if netConn, ok := conn.(net.Conn); ok {
-		addr := netConn.LocalAddr()
-		if taddr, ok := addr.(*net.TCPAddr); ok {
-			ip4 := taddr.IP.To4()
+	addr := conn.LocalAddr()
+	if taddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := taddr.IP.To4(); ip4 != nil {
 			client.publicIp = int32(ip4[0])<<24 | int32(ip4[1])<<16 | int32(ip4[2])<<8 | int32(ip4[3])
 		}
 	}
 
-	client.wt = make(chan *Message, 300)
+	client.wt = make(chan *Message, wtSize)
 	client.lwt = make(chan int, 1) //only need 1
 	//'10'对于用户拥有非常多的超级群，读线程还是有可能会阻塞
-	client.pwt = make(chan []*Message, 10)
+	client.pwt = make(chan []*Message, pwtSize)
 	client.messages = list.New()
 
 	atomic.AddInt64(&serverSummary.nconnections, 1)
@@ -92,11 +96,19 @@ func (client *Client) HandleClientClosed() {
 	}
 	atomic.StoreInt32(&client.closed, 1)
 
-	client.RemoveClient()
+	//保留会话时连接留在路由中缓存宽限期内的消息，不取消订阅
+	held := client.uid > 0 && client.SaveSession()
+	if !held {
+		client.RemoveClient()
+	}
 
 	//quit when write goroutine received
 	client.wt <- nil
+	client.wake()
 
+	if held {
+		return
+	}
 	client.RoomClient.Logout()
 	client.PeerClient.Logout()
 }
@@ -110,6 +122,8 @@ func (client *Client) HandleMessage(msg *Message) {
 		client.HandleACK(msg.body.(*MessageACK))
 	case MsgPing:
 		client.HandlePing()
+	case MsgPong:
+		client.HandlePong()
 	}
 
 	client.PeerClient.HandleMessage(msg)
@@ -132,17 +146,21 @@ func (client *Client) HandleAuthToken(login *AuthToken, version int) {
 		return
 	}
 
+	if len(login.session) > 0 && client.ResumeSession(login, version) {
+		return
+	}
+
 	var err error
 	appid, uid, fb, on, err := client.AuthToken(login.accessToken)
 	if err != nil {
 		log.Infof("auth token:%s err:%s", login.accessToken, err)
-		msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{1, 0}}
+		msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{status: 1}}
 		client.EnqueueMessage(msg)
 		return
 	}
 	if uid == 0 {
 		log.Info("auth token uid==0")
-		msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{1, 0}}
+		msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{status: 1}}
 		client.EnqueueMessage(msg)
 		return
 	}
@@ -151,7 +169,7 @@ func (client *Client) HandleAuthToken(login *AuthToken, version int) {
 		client.deviceId, err = GetDeviceId(login.device, int(login.platformId))
 		if err != nil {
 			log.Info("auth token uid==0")
-			msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{1, 0}}
+			msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{status: 1}}
 			client.EnqueueMessage(msg)
 			return
 		}
@@ -172,16 +190,22 @@ func (client *Client) HandleAuthToken(login *AuthToken, version int) {
 	client.device = login.device
 	client.platformId = login.platformId
 	client.tm = time.Now()
+	if version >= SessionVersion && config.sessionGracePeriod > 0 {
+		client.session = NewSessionToken()
+	}
 	log.Infof("auth token:%s appid:%d uid:%d device id:%s:%d forbidden:%d notification on:%t online:%t",
 		login.accessToken, client.appid, client.uid, client.device,
 		client.deviceId, client.forbidden, client.notificationOn, client.online)
 
-	msg := &Message{cmd: MsgAuthStatus, version: version, body: &AuthStatus{0, client.publicIp}}
+	interval := config.HeartbeatInterval(client.conn.Name(), client.platformId)
+	status := &AuthStatus{status: 0, ip: client.publicIp, heartbeat: int32(interval / time.Second), session: client.session}
+	msg := &Message{cmd: MsgAuthStatus, version: version, body: status}
 	client.EnqueueMessage(msg)
 
 	client.AddClient()
 
 	client.PeerClient.Login()
+	client.StartHeartbeat(interval)
 
 	CountDau(client.appid, client.uid)
 	atomic.AddInt64(&serverSummary.nclients, 1)
@@ -193,6 +217,8 @@ func (client *Client) AddClient() {
 }
 
 func (client *Client) HandlePing() {
+	//客户端的ping同样说明连接正常
+	client.HandlePong()
 	m := &Message{cmd: MsgPong}
 	client.EnqueueMessage(m)
 	if client.uid == 0 {
@@ -205,71 +231,110 @@ func (client *Client) HandleACK(ack *MessageACK) {
 	log.Info("ack:", ack.seq)
 }
 
-// SendMessages 发送等待队列中的消息
-func (client *Client) SendMessages(seq int) int {
+// versionMessage 以当前客户端所用版本号和下一个序号生成待发送的消息
+func (client *Client) versionMessage(msg *Message) *Message {
+	if msg.cmd == MsgRt || msg.cmd == MsgIm || msg.cmd == MsgGroupIm {
+		atomic.AddInt64(&serverSummary.outMessageCount, 1)
+	}
+	client.seq++
+	return &Message{msg.cmd, client.seq, client.version, msg.flag, msg.body}
+}
+
+// SendMessages 将等待队列中的消息加入待发送批次
+func (client *Client) SendMessages(batch []*Message) []*Message {
 	var messages *list.List
 	client.mutex.Lock()
 	if client.messages.Len() == 0 {
 		client.mutex.Unlock()
-		return seq
+		return batch
 	}
 	messages = client.messages
 	client.messages = list.New()
+	client.pendingBytes = 0
 	client.mutex.Unlock()
 
 	e := messages.Front()
 	for e != nil {
-		msg := e.Value.(*Message)
-		if msg.cmd == MsgRt || msg.cmd == MsgIm || msg.cmd == MsgGroupIm {
-			atomic.AddInt64(&serverSummary.outMessageCount, 1)
-		}
-		seq++
-		//以当前客户端所用版本号发送消息
-		vmsg := &Message{msg.cmd, seq, client.version, msg.flag, msg.body}
-		client.send(vmsg)
-
+		msg := e.Value.(*QueuedMessage).msg
+		batch = append(batch, client.versionMessage(msg))
 		e = e.Next()
 	}
-	return seq
+	return batch
+}
+
+// FlushPending 非阻塞地取出所有待发送的消息合并写入，连接关闭时返回false
+func (client *Client) FlushPending(batch []*Message) bool {
+	for {
+		select {
+		case msg := <-client.wt:
+			if msg == nil {
+				client.sendBatch(batch)
+				client.close()
+				log.Infof("client:%d socket closed", client.uid)
+				return false
+			}
+			batch = append(batch, client.versionMessage(msg))
+		case messages := <-client.pwt:
+			for _, msg := range messages {
+				batch = append(batch, client.versionMessage(msg))
+			}
+		case <-client.lwt:
+			batch = client.SendMessages(batch)
+		default:
+			client.sendBatch(batch)
+			return true
+		}
+		if len(batch) >= WriteBatchLimit {
+			client.sendBatch(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (client *Client) hasPending() bool {
+	return len(client.wt) > 0 || len(client.pwt) > 0 || len(client.lwt) > 0
 }
 
 func (client *Client) Write() {
-	seq := 0
 	running := true
 
+	//同一批次的消息合并写入，减少系统调用
+	batch := make([]*Message, 0, WriteBatchLimit)
+	var batchTime time.Time
+
 	//发送在线消息
 	for running {
+		if len(batch) == 0 {
+			batchTime = time.Now()
+		}
 		select {
 		case msg := <-client.wt:
 			if msg == nil {
+				client.sendBatch(batch)
+				batch = batch[:0]
 				client.close()
 				running = false
 				log.Infof("client:%d socket closed", client.uid)
 				break
 			}
-			if msg.cmd == MsgRt || msg.cmd == MsgIm || msg.cmd == MsgGroupIm {
-				atomic.AddInt64(&serverSummary.outMessageCount, 1)
-			}
-			seq++
-
-			//以当前客户端所用版本号发送消息
-			vmsg := &Message{msg.cmd, seq, client.version, msg.flag, msg.body}
-			client.send(vmsg)
+			batch = append(batch, client.versionMessage(msg))
 		case messages := <-client.pwt:
 			for _, msg := range messages {
-				if msg.cmd == MsgRt || msg.cmd == MsgIm || msg.cmd == MsgGroupIm {
-					atomic.AddInt64(&serverSummary.outMessageCount, 1)
-				}
-				seq++
-
-				//以当前客户端所用版本号发送消息
-				vmsg := &Message{msg.cmd, seq, client.version, msg.flag, msg.body}
-				client.send(vmsg)
+				batch = append(batch, client.versionMessage(msg))
 			}
 		case <-client.lwt:
-			seq = client.SendMessages(seq)
+			batch = client.SendMessages(batch)
 			break
 		}
+
+		//没有后续消息、批次已满或者等待超时时写入
+		if !client.hasPending() || len(batch) >= WriteBatchLimit || time.Since(batchTime) >= WriteFlushDelay {
+			client.sendBatch(batch)
+			for i := range batch {
+				batch[i] = nil
+			}
+			batch = batch[:0]
+		}
 	}
 
 	//等待200ms,避免发送者阻塞
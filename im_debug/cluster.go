@@ -0,0 +1,409 @@
+package main
+
+import "os"
+import "sync"
+import "time"
+import "strings"
+import "net/http"
+import "github.com/gomodule/redigo/redis"
+import "github.com/richmonkey/cfg"
+import "github.com/valyala/gorpc"
+import "im_research/hashring"
+import log "github.com/golang/glog"
+
+//redis中保存集群成员的hash, 字段为storage_rpc_pool和route_pool
+//成员变化之后publish该channel可以立即生效
+const ClusterKey = "im_cluster"
+
+//移除的ims连接延迟关闭，等待正在进行的调用完成
+const StorageClientCloseDelay = 60 * time.Second
+
+// StorageRPCClient 和一个ims的rpc连接
+type StorageRPCClient struct {
+	addr   string
+	client *gorpc.Client
+	dc     *gorpc.DispatcherClient
+
+	replicas []*StorageRPCClient //slave, 只用于读取
+
+	healthy   int32 //最近一次健康检查是否成功
+	staleness int64 //slave的数据落后master的秒数
+
+	breaker CircuitBreaker
+	stat    StorageStat
+}
+
+func NewStorageRPCClient(addr string, replicas []string) *StorageRPCClient {
+	c := &gorpc.Client{
+		Conns: 4,
+		Addr:  addr,
+	}
+	c.Start()
+
+	dispatcher := gorpc.NewDispatcher()
+	dispatcher.AddFunc("SyncMessage", SyncMessageInterface)
+	dispatcher.AddFunc("SavePeerMessage", SavePeerMessageInterface)
+	dispatcher.AddFunc("GetLatestMessage", GetLatestMessageInterface)
+	dispatcher.AddFunc("GetReplicaStatus", GetReplicaStatusInterface)
+
+	dc := dispatcher.NewFuncClient(c)
+	sc := &StorageRPCClient{addr: addr, client: c, dc: dc, healthy: 1}
+	for _, replica := range replicas {
+		sc.replicas = append(sc.replicas, NewStorageRPCClient(replica, nil))
+	}
+	return sc
+}
+
+func (sc *StorageRPCClient) ReplicaAddrs() []string {
+	addrs := make([]string, 0, len(sc.replicas))
+	for _, r := range sc.replicas {
+		addrs = append(addrs, r.addr)
+	}
+	return addrs
+}
+
+func (sc *StorageRPCClient) Stop() {
+	sc.client.Stop()
+	for _, r := range sc.replicas {
+		r.client.Stop()
+	}
+}
+
+//保护rpcClients, routeChannels和hash环
+var clusterMutex sync.RWMutex
+
+//imr列表每次变更加1，由clusterMutex保护
+var routeVersion int64
+
+//同一时间只有一个成员变更
+var reloadMutex sync.Mutex
+
+func ParsePool(str string) []string {
+	return strings.Fields(str)
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRing 解析 "ip:port ip:port@权重 ..." 形式的成员列表，列表为空时返回nil
+// ims的列表需要先通过SplitReplicas去掉slave
+func NewRing(pool []string, mode string) (*hashring.Ring, error) {
+	if len(pool) == 0 {
+		return nil, nil
+	}
+	nodes, err := hashring.ParseNodes(pool)
+	if err != nil {
+		return nil, err
+	}
+	return hashring.NewWithMode(mode, nodes, config.hashReplicas), nil
+}
+
+// ringNodes 带权重的成员列表，用于比较成员是否变化
+func ringNodes(r *hashring.Ring) []string {
+	if r == nil {
+		return nil
+	}
+	nodes := make([]string, 0, r.Len())
+	for _, node := range r.Nodes() {
+		nodes = append(nodes, node.String())
+	}
+	return nodes
+}
+
+// GetStorageClient 用户所属ims的master和slave, 个人消息／普通群消息／客服消息
+func GetStorageClient(uid int64) *StorageRPCClient {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return rpcClients[storageRing.Get(uid)]
+}
+
+// GetOldStorageRPCClient 迁移期间用户之前所属的ims, 不在迁移中或者所属的ims没有变化时返回nil
+func GetOldStorageRPCClient(uid int64) *StorageRPCClient {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	if oldStorageRing == nil {
+		return nil
+	}
+	addr := oldStorageRing.Get(uid)
+	if addr == storageRing.Get(uid) {
+		return nil
+	}
+	return rpcClients[addr]
+}
+
+// storageNodes 带权重和slave的ims列表
+func storageNodes(r *hashring.Ring) []string {
+	nodes := ringNodes(r)
+	if r == nil {
+		return nodes
+	}
+	for i, node := range r.Nodes() {
+		if c, ok := rpcClients[node.Name]; ok && len(c.replicas) > 0 {
+			nodes[i] = nodes[i] + "," + strings.Join(c.ReplicaAddrs(), ",")
+		}
+	}
+	return nodes
+}
+
+func GetStorageNodes() ([]string, []string) {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return storageNodes(storageRing), storageNodes(oldStorageRing)
+}
+
+// routeChannel 调用方需要持有clusterMutex
+func routeChannel(id int64) *Channel {
+	return routeChannels[routeRing.Get(id)]
+}
+
+// GetRouteChannels 按照配置的顺序返回
+func GetRouteChannels() []*Channel {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	channels := make([]*Channel, 0, len(routeChannels))
+	for _, addr := range routeRing.Names() {
+		channels = append(channels, routeChannels[addr])
+	}
+	return channels
+}
+
+func GetRouteNodes() []string {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return ringNodes(routeRing)
+}
+
+// UpdateStorageCluster 替换ims列表，地址和slave都不变的连接继续使用
+// oldRing不为nil时处于迁移中，读取消息时同时查询用户之前所属的ims
+func UpdateStorageCluster(ring *hashring.Ring, oldRing *hashring.Ring, replicas map[string][]string) {
+	addrs := ring.Names()
+	if oldRing != nil {
+		addrs = append(addrs, oldRing.Names()...)
+	}
+
+	clusterMutex.Lock()
+	existing := rpcClients
+	clients := make(map[string]*StorageRPCClient)
+	for _, addr := range addrs {
+		if _, ok := clients[addr]; ok {
+			continue
+		}
+		if c, ok := existing[addr]; ok && equalAddrs(c.ReplicaAddrs(), replicas[addr]) {
+			clients[addr] = c
+			delete(existing, addr)
+		} else {
+			log.Infof("add storage:%s replicas:%v", addr, replicas[addr])
+			clients[addr] = NewStorageRPCClient(addr, replicas[addr])
+		}
+	}
+	rpcClients = clients
+	storageRing = ring
+	oldStorageRing = oldRing
+	clusterMutex.Unlock()
+
+	for addr, c := range existing {
+		log.Info("remove storage:", addr)
+		time.AfterFunc(StorageClientCloseDelay, c.Stop)
+	}
+}
+
+// UpdateRouteCluster 替换imr列表，地址不变的channel继续使用
+// 所属imr发生变化的用户和聊天室迁移到新的channel上，客户端连接不受影响
+func UpdateRouteCluster(ring *hashring.Ring) {
+	clusterMutex.Lock()
+	old := routeChannels
+	existing := make(map[string]*Channel)
+	for addr, c := range old {
+		existing[addr] = c
+	}
+	added := make(map[*Channel]bool)
+	channels := make(map[string]*Channel)
+	for _, addr := range ring.Names() {
+		if c, ok := existing[addr]; ok {
+			channels[addr] = c
+			delete(existing, addr)
+		} else {
+			log.Info("add route:", addr)
+			c = NewChannel(addr, DispatchAppMessage, DispatchRoomMessage)
+			channels[addr] = c
+			added[c] = true
+		}
+	}
+	routeChannels = channels
+	routeRing = ring
+	routeVersion++
+
+	//新的channel在连接imr之后通过ReSubscribe发送全部订阅,
+	//已经存在的channel需要单独发送迁移过来的订阅
+	type pending struct {
+		channel *Channel
+		msg     *Message
+	}
+	msgs := make([]*pending, 0)
+	for _, channel := range old {
+		_, removed := existing[channel.addr]
+		subs := channel.GetAllSubscribers()
+		for appid, sub := range subs {
+			for uid := range sub.uids {
+				owner := routeChannel(uid)
+				if owner == channel {
+					continue
+				}
+				count := channel.DeleteSubscribe(appid, uid)
+				prev := owner.MergeSubscribe(appid, uid, count)
+				if !removed {
+					id := &AppUser{appid: appid, uid: uid}
+					msgs = append(msgs, &pending{channel, &Message{cmd: MsgUnsubscribe, body: id}})
+				}
+				//低16位表示总数量 高16位表示online的数量
+				online := count>>16&0xffff > 0
+				if !added[owner] && (prev == 0 || (prev>>16&0xffff == 0 && online)) {
+					on := 0
+					if online || prev>>16&0xffff > 0 {
+						on = 1
+					}
+					id := &SubscribeMessage{appid: appid, uid: uid, online: int8(on)}
+					msgs = append(msgs, &pending{owner, &Message{cmd: MsgSubscribe, body: id}})
+				}
+			}
+		}
+
+		for _, room := range channel.GetAllRoomSubscribers() {
+			owner := routeChannel(room.roomId)
+			if owner == channel {
+				continue
+			}
+			count := channel.DeleteSubscribeRoom(room.appid, room.roomId)
+			prev := owner.MergeSubscribeRoom(room.appid, room.roomId, count)
+			if !removed {
+				msgs = append(msgs, &pending{channel, &Message{cmd: MsgUnsubscribeRoom, body: room}})
+			}
+			if !added[owner] && prev == 0 {
+				msgs = append(msgs, &pending{owner, &Message{cmd: MsgSubscribeRoom, body: room}})
+			}
+		}
+	}
+	clusterMutex.Unlock()
+
+	for c := range added {
+		c.Start()
+	}
+	//imr未连接时写入会阻塞，不能持有clusterMutex
+	for _, p := range msgs {
+		p.channel.wt <- p.msg
+	}
+	for addr, c := range existing {
+		log.Info("remove route:", addr)
+		c.Stop()
+	}
+	log.Infof("route cluster updated, migrate subscriptions:%d", len(msgs))
+}
+
+// LoadClusterFile 从文件读取集群成员，格式和im.cfg相同
+func LoadClusterFile(path string) (map[string]string, error) {
+	appCfg := make(map[string]string)
+	err := cfg.Load(path, appCfg)
+	if err != nil {
+		return nil, err
+	}
+	return appCfg, nil
+}
+
+// LoadClusterRedis 从redis读取集群成员
+func LoadClusterRedis() (map[string]string, error) {
+	conn := redisPool.Get()
+	defer func(conn redis.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	return redis.StringMap(conn.Do("HGETALL", ClusterKey))
+}
+
+// ReloadCluster 重新读取集群成员，为空的列表保持不变
+// storage_rpc_pool_old为空表示迁移结束
+func ReloadCluster() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var values map[string]string
+	var err error
+	if len(config.clusterFile) > 0 {
+		values, err = LoadClusterFile(config.clusterFile)
+	} else if config.clusterRedis {
+		values, err = LoadClusterRedis()
+	} else {
+		return
+	}
+	if err != nil {
+		log.Warning("load cluster err:", err)
+		return
+	}
+
+	storageAddrs := ParsePool(values["storage_rpc_pool"])
+	if len(storageAddrs) > 0 {
+		oldAddrs := ParsePool(values["storage_rpc_pool_old"])
+		masters, replicas := SplitReplicas(append(oldAddrs, storageAddrs...))
+		ring, err1 := NewRing(masters[len(oldAddrs):], config.shardHash)
+		oldRing, err2 := NewRing(masters[:len(oldAddrs)], config.shardHashOld)
+		nodes, oldNodes := GetStorageNodes()
+		if err1 != nil || err2 != nil {
+			log.Warning("invalid storage pool:", err1, err2)
+		} else if !equalAddrs(normalizePool(storageAddrs), nodes) || !equalAddrs(normalizePool(oldAddrs), oldNodes) {
+			log.Infof("storage cluster changed:%v old:%v", storageAddrs, oldAddrs)
+			UpdateStorageCluster(ring, oldRing, replicas)
+		}
+	}
+
+	routeAddrs := ParsePool(values["route_pool"])
+	if len(routeAddrs) > 0 {
+		ring, err := NewRing(routeAddrs, config.shardHash)
+		if err != nil {
+			log.Warning("invalid route pool:", err)
+		} else if !equalAddrs(ringNodes(ring), GetRouteNodes()) {
+			log.Info("route cluster changed:", ringNodes(ring))
+			UpdateRouteCluster(ring)
+		}
+	}
+}
+
+// ClusterService 定时检查集群成员，文件通过修改时间判断是否变化
+func ClusterService() {
+	if len(config.clusterFile) == 0 && !config.clusterRedis {
+		return
+	}
+	var mtime time.Time
+	for {
+		if len(config.clusterFile) > 0 {
+			info, err := os.Stat(config.clusterFile)
+			if err != nil {
+				log.Warning("stat cluster file err:", err)
+			} else if !info.ModTime().Equal(mtime) {
+				mtime = info.ModTime()
+				ReloadCluster()
+			}
+		} else {
+			ReloadCluster()
+		}
+		time.Sleep(config.clusterWatchInterval)
+	}
+}
+
+// Cluster http接口 /cluster 当前的集群成员
+func Cluster(rw http.ResponseWriter, req *http.Request) {
+	obj := make(map[string]interface{})
+	nodes, oldNodes := GetStorageNodes()
+	obj["storage_rpc_pool"] = nodes
+	obj["storage_rpc_pool_old"] = oldNodes
+	obj["route_pool"] = GetRouteNodes()
+	obj["shard_hash"] = config.shardHash
+	WriteHttpObj(obj, rw)
+}
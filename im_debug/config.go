@@ -3,7 +3,9 @@ package main
 import "strconv"
 import "log"
 import "strings"
+import "time"
 import "github.com/richmonkey/cfg"
+import "im_research/hashring"
 
 type Config struct {
 	port                 int
@@ -30,6 +32,44 @@ type Config struct {
 
 	wordFile string //关键词字典文件
 	syncSelf bool   //是否同步自己发送的消息
+
+	messageQueueLimit      int    //每个连接待发送的消息数量限制
+	messageQueueBytesLimit int64  //每个连接待发送的消息字节数限制，0表示不限制
+	slowConsumerPolicy     string //待发送队列满时的处理策略
+
+	heartbeatIntervals map[string]int //心跳间隔(秒), key为 传输方式_平台/平台/传输方式/""(默认值)
+	heartbeatMaxMissed int            //连续没有收到pong的次数超过该值时断开连接
+	clientTimeouts     map[string]int //读超时(秒), key为 传输方式/""(默认值)
+
+	sessionGracePeriod time.Duration //断开连接之后会话的保留时间，0表示不保留
+
+	drainAddress string        //drain时通知客户端重连的地址，为空时客户端使用原有的地址
+	drainTimeout time.Duration //drain等待消息保存和发送的最长时间
+
+	epollMode    bool //普通tcp连接使用epoll处理(linux)
+	epollWorkers int  //epoll模式下写协程的数量
+
+	serverId               string //实例在服务发现中的唯一标识
+	publicTcpAddress       string //客户端连接的地址，为空时不对外提供该传输方式
+	publicTlsAddress       string
+	publicWebsocketAddress string
+	discoveryAddress       string //服务发现接口的监听地址，为空时只在内部http接口提供
+
+	clusterFile          string        //集群成员文件，修改之后自动生效
+	clusterRedis         bool          //从redis读取集群成员
+	clusterWatchInterval time.Duration //检查集群成员变化的间隔
+
+	shardHash          string   //ring:一致性hash mod:取模
+	hashReplicas       int      //一致性hash中权重为1的节点的虚拟节点数量
+	storageRpcOldAddrs []string //迁移期间之前的ims列表
+	shardHashOld       string   //之前的ims列表使用的hash方式
+
+	storageMaxStaleness  time.Duration //master不可用时，只从延迟不超过该值的slave读取
+	storageCheckInterval time.Duration //检查ims和slave状态的间隔
+
+	storageTimeout         time.Duration //调用ims的超时时间
+	storageBreakerFailures int           //连续失败多少次之后熔断
+	storageBreakerCooldown time.Duration //熔断之后多久允许探测请求
 }
 
 func getInt(appCfg map[string]string, key string) int {
@@ -72,6 +112,23 @@ func getOptString(appCfg map[string]string, key string) string {
 	return value
 }
 
+// getIntsWithPrefix 读取prefix和prefix_xxx形式的配置项，返回的map中key为xxx, prefix本身对应""
+func getIntsWithPrefix(appCfg map[string]string, prefix string) map[string]int {
+	values := make(map[string]int)
+	for key := range appCfg {
+		var name string
+		if key == prefix {
+			name = ""
+		} else if strings.HasPrefix(key, prefix+"_") {
+			name = key[len(prefix)+1:]
+		} else {
+			continue
+		}
+		values[name] = getInt(appCfg, key)
+	}
+	return values
+}
+
 func readCfg(cfgPath string) *Config {
 	config := new(Config)
 	appCfg := make(map[string]string)
@@ -96,18 +153,107 @@ func readCfg(cfgPath string) *Config {
 	config.keyFile = getOptString(appCfg, "key_file")
 
 	str := getString(appCfg, "storage_rpc_pool")
-	config.storageRpcAddrs = strings.Split(str, " ")
+	config.storageRpcAddrs = ParsePool(str)
 	if len(config.storageRpcAddrs) == 0 {
 		log.Fatal("storage pool config")
 	}
 
 	str = getString(appCfg, "route_pool")
-	config.routeAddrs = strings.Split(str, " ")
+	config.routeAddrs = ParsePool(str)
 	if len(config.routeAddrs) == 0 {
 		log.Fatal("route pool config")
 	}
 
 	config.wordFile = getOptString(appCfg, "word_file")
 	config.syncSelf = getOptInt(appCfg, "sync_self") != 0
+
+	config.messageQueueLimit = int(getOptInt(appCfg, "message_queue_limit"))
+	if config.messageQueueLimit <= 0 {
+		config.messageQueueLimit = MessageQueueLimit
+	}
+	config.messageQueueBytesLimit = getOptInt(appCfg, "message_queue_bytes_limit")
+	config.slowConsumerPolicy = getOptString(appCfg, "slow_consumer_policy")
+	switch config.slowConsumerPolicy {
+	case "":
+		config.slowConsumerPolicy = PolicyDropOldest
+	case PolicyDropOldest, PolicyDropNewest, PolicyDisconnect:
+	default:
+		log.Fatalf("invalid slow consumer policy:%s", config.slowConsumerPolicy)
+	}
+
+	config.heartbeatIntervals = getIntsWithPrefix(appCfg, "heartbeat_interval")
+	config.heartbeatMaxMissed = int(getOptInt(appCfg, "heartbeat_max_missed"))
+	if config.heartbeatMaxMissed <= 0 {
+		config.heartbeatMaxMissed = HeartbeatMaxMissed
+	}
+	config.clientTimeouts = getIntsWithPrefix(appCfg, "client_timeout")
+
+	config.sessionGracePeriod = time.Duration(getOptInt(appCfg, "session_grace_period")) * time.Second
+
+	config.drainAddress = getOptString(appCfg, "drain_address")
+	config.drainTimeout = time.Duration(getOptInt(appCfg, "drain_timeout")) * time.Second
+	if config.drainTimeout <= 0 {
+		config.drainTimeout = 30 * time.Second
+	}
+
+	config.epollMode = getOptInt(appCfg, "epoll_mode") != 0
+	config.epollWorkers = int(getOptInt(appCfg, "epoll_workers"))
+	if config.epollWorkers <= 0 {
+		config.epollWorkers = 64
+	}
+
+	config.serverId = getOptString(appCfg, "server_id")
+	if len(config.serverId) == 0 {
+		config.serverId = DefaultServerId(config.port)
+	}
+	config.publicTcpAddress = getOptString(appCfg, "public_tcp_address")
+	config.publicTlsAddress = getOptString(appCfg, "public_tls_address")
+	config.publicWebsocketAddress = getOptString(appCfg, "public_websocket_address")
+	config.discoveryAddress = getOptString(appCfg, "discovery_address")
+
+	config.shardHash = getOptString(appCfg, "shard_hash")
+	if len(config.shardHash) == 0 {
+		config.shardHash = "mod"
+	}
+	if config.shardHash != "mod" && config.shardHash != "ring" {
+		log.Fatal("invalid shard_hash:", config.shardHash)
+	}
+	config.hashReplicas = int(getOptInt(appCfg, "hash_replicas"))
+	if config.hashReplicas <= 0 {
+		config.hashReplicas = hashring.DefaultReplicas
+	}
+	config.storageRpcOldAddrs = ParsePool(getOptString(appCfg, "storage_rpc_pool_old"))
+	config.shardHashOld = getOptString(appCfg, "shard_hash_old")
+	if len(config.shardHashOld) == 0 {
+		config.shardHashOld = config.shardHash
+	}
+
+	config.storageMaxStaleness = time.Duration(getOptInt(appCfg, "storage_max_staleness")) * time.Second
+	if config.storageMaxStaleness <= 0 {
+		config.storageMaxStaleness = 60 * time.Second
+	}
+	config.storageCheckInterval = time.Duration(getOptInt(appCfg, "storage_check_interval")) * time.Second
+	if config.storageCheckInterval <= 0 {
+		config.storageCheckInterval = 5 * time.Second
+	}
+	config.storageTimeout = time.Duration(getOptInt(appCfg, "storage_timeout")) * time.Millisecond
+	if config.storageTimeout <= 0 {
+		config.storageTimeout = 3 * time.Second
+	}
+	config.storageBreakerFailures = int(getOptInt(appCfg, "storage_breaker_failures"))
+	if config.storageBreakerFailures <= 0 {
+		config.storageBreakerFailures = 5
+	}
+	config.storageBreakerCooldown = time.Duration(getOptInt(appCfg, "storage_breaker_cooldown")) * time.Second
+	if config.storageBreakerCooldown <= 0 {
+		config.storageBreakerCooldown = 10 * time.Second
+	}
+
+	config.clusterFile = getOptString(appCfg, "cluster_file")
+	config.clusterRedis = getOptInt(appCfg, "cluster_redis") != 0
+	config.clusterWatchInterval = time.Duration(getOptInt(appCfg, "cluster_watch_interval")) * time.Second
+	if config.clusterWatchInterval <= 0 {
+		config.clusterWatchInterval = 10 * time.Second
+	}
 	return config
 }
@@ -1,21 +1,20 @@
 package main
 
-import (
-	"github.com/gorilla/websocket"
-	"net"
-)
+import "net"
 import "time"
 import "sync"
 import "sync/atomic"
 import log "github.com/golang/glog"
-import "github.com/googollee/go-engine.io"
 import "container/list"
 
 const ClientTimeout = 60 * 6
-const MessageQueueLimit = 1000 //待发送的消息数量限制
+const MessageQueueLimit = 1000 //待发送的消息数量默认限制
+
+const WriteBatchLimit = 256                   //单次合并写入的最大消息数量
+const WriteFlushDelay = 10 * time.Millisecond //待合并的消息最长等待时间
 
 type Connection struct {
-	conn   interface{}
+	conn   Transport
 	closed int32
 
 	forbidden      int32 //是否被禁言
@@ -28,7 +27,8 @@ type Connection struct {
 	lwt          chan int
 	pwt          chan []*Message //离线消息
 
-	version int //客户端协议版本号
+	version int    //客户端协议版本号
+	session string //会话token
 
 	tm         time.Time
 	appid      int64
@@ -37,8 +37,24 @@ type Connection struct {
 	deviceId   int64 //generated by device_id + platform_id
 	platformId int8
 
-	messages *list.List //待发送的消息队列 FIFO
-	mutex    sync.Mutex
+	messages     *list.List //待发送的消息队列 FIFO, 元素为*QueuedMessage
+	pendingBytes int64      //messages中消息的字节数，只在限制队列字节数时统计
+	mutex        sync.Mutex
+	evicted      int32 //慢连接已被踢出
+	closing      int32 //连接已被服务端主动关闭
+	missedPongs  int32 //连续没有收到pong的心跳次数
+
+	held *Session //断开之后保留的会话，宽限期内发给该连接的消息缓存在会话中，由mutex保护
+
+	wakeup func() //非nil时由共享的写协程池发送消息(epoll模式)
+	closer func() //非nil时由reactor关闭连接(epoll模式)，先从epoll中移除再关闭fd
+}
+
+// wake 通知写协程池有新的待发送消息
+func (client *Connection) wake() {
+	if client.wakeup != nil {
+		client.wakeup()
+	}
 }
 
 //自己是否是发送者
@@ -81,6 +97,9 @@ func (client *Connection) SendMessage(uid int64, msg *Message) bool {
 func (client *Connection) EnqueueNonBlockMessage(msg *Message) bool {
 	closed := atomic.LoadInt32(&client.closed)
 	if closed > 0 {
+		if client.holdMessage(msg) {
+			return true
+		}
 		log.Infof("can't send message to closed connection:%d", client.uid)
 		return false
 	}
@@ -92,17 +111,13 @@ func (client *Connection) EnqueueNonBlockMessage(msg *Message) bool {
 		return false
 	}
 
-	dropped := false
-	client.mutex.Lock()
-	if client.messages.Len() >= MessageQueueLimit {
-		//队列阻塞，丢弃之前的消息
-		client.messages.Remove(client.messages.Front())
-		dropped = true
+	if atomic.LoadInt32(&client.evicted) > 0 {
+		log.Infof("can't send message to evicted connection:%d", client.uid)
+		return false
 	}
-	client.messages.PushBack(msg)
-	client.mutex.Unlock()
-	if dropped {
-		log.Info("message queue full, drop a message")
+
+	if !client.pushMessage(msg) {
+		return false
 	}
 
 	//nonblock
@@ -110,6 +125,7 @@ func (client *Connection) EnqueueNonBlockMessage(msg *Message) bool {
 	case client.lwt <- 1:
 	default:
 	}
+	client.wake()
 
 	return true
 }
@@ -129,10 +145,14 @@ func (client *Connection) EnqueueMessage(msg *Message) bool {
 	}
 	select {
 	case client.wt <- msg:
+		client.wake()
 		return true
 	case <-time.After(60 * time.Second):
 		atomic.AddInt32(&client.timeoutCount, 1)
 		log.Infof("send message to wt timed out:%d", client.uid)
+		if config.slowConsumerPolicy == PolicyDisconnect {
+			client.Evict()
+		}
 		return false
 	}
 }
@@ -152,57 +172,101 @@ func (client *Connection) EnqueueMessages(messages []*Message) bool {
 	}
 	select {
 	case client.pwt <- messages:
+		client.wake()
 		return true
 	case <-time.After(60 * time.Second):
 		atomic.AddInt32(&client.timeoutCount, 1)
 		log.Infof("send messages to pwt timed out:%d", client.uid)
+		if config.slowConsumerPolicy == PolicyDisconnect {
+			client.Evict()
+		}
 		return false
 	}
 }
 
-// 根据连接类型获取消息
 func (client *Connection) read() *Message {
-	if conn, ok := client.conn.(net.Conn); ok {
-		_ = conn.SetReadDeadline(time.Now().Add(ClientTimeout * time.Second))
-		return ReceiveClientMessage(conn)
-	} else if conn, ok := client.conn.(engineio.Conn); ok {
-		return ReadEngineIOMessage(conn)
-	} else if conn, ok := client.conn.(*websocket.Conn); ok {
-		return ReadWebsocketMessage(conn)
-	}
-	log.Infof("conn type: %T", client.conn)
-	return nil
+	return client.conn.ReadMessage()
 }
 
-// 根据连接类型发送消息
 func (client *Connection) send(msg *Message) {
-	if conn, ok := client.conn.(net.Conn); ok {
-		tc := atomic.LoadInt32(&client.timeoutCount)
-		if tc > 0 {
-			log.Info("can't write data to blocked socket")
-			return
+	tc := atomic.LoadInt32(&client.timeoutCount)
+	if tc > 0 {
+		log.Info("can't write data to blocked socket")
+		return
+	}
+	err := client.conn.WriteMessage(msg)
+	if err != nil {
+		log.Info("send msg:", Command(msg.cmd), " ", client.conn.Name(), " err:", err)
+		client.writeFailed(err)
+	}
+}
+
+// writeFailed 写超时的连接标记为阻塞，不再写入，其它写错误直接关闭连接
+func (client *Connection) writeFailed(err error) {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		atomic.AddInt32(&client.timeoutCount, 1)
+		return
+	}
+	if atomic.LoadInt32(&client.closing) > 0 {
+		return
+	}
+	client.shutdown()
+}
+
+// sendBatch 合并写入多个消息，传输层不支持合并时逐个发送
+func (client *Connection) sendBatch(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	tc := atomic.LoadInt32(&client.timeoutCount)
+	if tc > 0 {
+		log.Info("can't write data to blocked socket")
+		return
+	}
+
+	var err error
+	if bt, ok := client.conn.(BatchTransport); ok {
+		err = bt.WriteMessages(msgs)
+	} else {
+		for _, msg := range msgs {
+			if err = client.conn.WriteMessage(msg); err != nil {
+				break
+			}
 		}
-		_ = conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
-		err := SendMessage(conn, msg)
-		if err != nil {
-			atomic.AddInt32(&client.timeoutCount, 1)
-			log.Info("send msg:", Command(msg.cmd), " tcp err:", err)
+	}
+	if err != nil {
+		log.Info("send msgs:", len(msgs), " ", client.conn.Name(), " err:", err)
+		client.writeFailed(err)
+		return
+	}
+
+	//被踢出的连接在重新同步的通知发出之后断开
+	if atomic.LoadInt32(&client.evicted) > 0 {
+		for _, msg := range msgs {
+			if msg.cmd == MsgResync {
+				log.Infof("client:%d evicted, close connection", client.uid)
+				client.shutdown()
+				break
+			}
 		}
-	} else if conn, ok := client.conn.(engineio.Conn); ok {
-		SendEngineIOBinaryMessage(conn, msg)
-	} else if conn, ok := client.conn.(*websocket.Conn); ok {
-		SendWebsocketMessage(conn, msg)
-	} else {
-		log.Errorf("invalid conn: %s", client.conn)
 	}
 }
 
-// 根据连接类型关闭
 func (client *Connection) close() {
-	if conn, ok := client.conn.(net.Conn); ok {
-		_ = conn.Close()
-	} else if conn, ok := client.conn.(engineio.Conn); ok {
-		//bug:https://github.com/googollee/go-engine.io/issues/34
-		_ = conn.Close()
+	_ = client.conn.Close()
+}
+
+// shutdown 服务端主动断开连接，读协程随之退出并清理连接
+func (client *Connection) shutdown() {
+	atomic.StoreInt32(&client.closing, 1)
+	if client.closer != nil {
+		client.closer()
+		return
+	}
+	if c, ok := client.conn.(interface{ CloseRead() error }); ok {
+		if c.CloseRead() == nil {
+			return
+		}
 	}
+	client.close()
 }
@@ -0,0 +1,224 @@
+package main
+
+import "fmt"
+import "os"
+import "sort"
+import "time"
+import "strconv"
+import "net/url"
+import "net/http"
+import "sync/atomic"
+import "github.com/gomodule/redigo/redis"
+import log "github.com/golang/glog"
+
+//im实例定时把自己的地址和连接数写入redis
+const DiscoveryInterval = 10 * time.Second
+const DiscoveryTTL = 30 //秒，超过时间没有更新的实例被视为下线
+
+const DiscoveryInstancesKey = "im_instances"
+
+// IMInstance 客户端可以连接的im实例
+type IMInstance struct {
+	id          string
+	tcp         string
+	tls         string
+	websocket   string
+	connections int64
+	draining    bool
+	timestamp   int64
+}
+
+func (instance *IMInstance) ToMap() map[string]interface{} {
+	obj := make(map[string]interface{})
+	obj["id"] = instance.id
+	if len(instance.tcp) > 0 {
+		obj["tcp"] = instance.tcp
+	}
+	if len(instance.tls) > 0 {
+		obj["tls"] = instance.tls
+	}
+	if len(instance.websocket) > 0 {
+		obj["websocket"] = instance.websocket
+	}
+	obj["connections"] = instance.connections
+	return obj
+}
+
+// Address 指定传输方式的地址，为空表示不支持
+func (instance *IMInstance) Address(transport string) string {
+	switch transport {
+	case "tcp":
+		return instance.tcp
+	case "tls":
+		return instance.tls
+	case "websocket":
+		return instance.websocket
+	default:
+		return ""
+	}
+}
+
+func instanceKey(id string) string {
+	return fmt.Sprintf("im_instance_%s", id)
+}
+
+// DefaultServerId 没有配置server_id时使用 主机名:端口
+func DefaultServerId(port int) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s:%d", hostname, port)
+}
+
+// PublishInstance 更新当前实例的地址和连接数
+func PublishInstance() {
+	conn := redisPool.Get()
+	defer func(conn redis.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	draining := 0
+	if IsDraining() {
+		draining = 1
+	}
+	key := instanceKey(config.serverId)
+	_ = conn.Send("MULTI")
+	_ = conn.Send("HMSET", key,
+		"tcp", config.publicTcpAddress,
+		"tls", config.publicTlsAddress,
+		"websocket", config.publicWebsocketAddress,
+		"connections", atomic.LoadInt64(&serverSummary.nconnections),
+		"draining", draining,
+		"timestamp", time.Now().Unix())
+	_ = conn.Send("EXPIRE", key, DiscoveryTTL)
+	_ = conn.Send("SADD", DiscoveryInstancesKey, config.serverId)
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		log.Warning("publish instance err:", err)
+	}
+}
+
+func DiscoveryService() {
+	for {
+		PublishInstance()
+		time.Sleep(DiscoveryInterval)
+	}
+}
+
+// LoadInstances 读取所有在线的im实例，清理已经过期的实例
+func LoadInstances() ([]*IMInstance, error) {
+	conn := redisPool.Get()
+	defer func(conn redis.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", DiscoveryInstancesKey))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		_ = conn.Send("HGETALL", instanceKey(id))
+	}
+	_ = conn.Flush()
+
+	instances := make([]*IMInstance, 0, len(ids))
+	expired := make([]interface{}, 0)
+	for _, id := range ids {
+		values, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			//hash已经过期，读取完所有的回复之后再删除
+			expired = append(expired, id)
+			continue
+		}
+
+		instance := &IMInstance{id: id}
+		instance.tcp = values["tcp"]
+		instance.tls = values["tls"]
+		instance.websocket = values["websocket"]
+		instance.connections, _ = strconv.ParseInt(values["connections"], 10, 64)
+		instance.draining = values["draining"] == "1"
+		instance.timestamp, _ = strconv.ParseInt(values["timestamp"], 10, 64)
+		instances = append(instances, instance)
+	}
+
+	if len(expired) > 0 {
+		args := append([]interface{}{DiscoveryInstancesKey}, expired...)
+		if _, err := conn.Do("SREM", args...); err != nil {
+			log.Warning("remove expired instances err:", err)
+		}
+	}
+	return instances, nil
+}
+
+// RankInstances 排除drain中和不支持该传输方式的实例，按连接数升序排列
+func RankInstances(instances []*IMInstance, transport string) []*IMInstance {
+	r := make([]*IMInstance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.draining {
+			continue
+		}
+		if len(transport) > 0 && len(instance.Address(transport)) == 0 {
+			continue
+		}
+		r = append(r, instance)
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].connections < r[j].connections
+	})
+	return r
+}
+
+// Discovery http接口 /discovery?transport=tcp&limit=3
+func Discovery(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	transport := m.Get("transport")
+	if len(transport) > 0 && transport != "tcp" && transport != "tls" && transport != "websocket" {
+		WriteHttpError(400, "invalid transport", rw)
+		return
+	}
+
+	limit := 0
+	if s := m.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		limit = n
+	}
+
+	instances, err := LoadInstances()
+	if err != nil {
+		log.Warning("load instances err:", err)
+		WriteHttpError(500, "server internal error", rw)
+		return
+	}
+
+	instances = RankInstances(instances, transport)
+	if limit > 0 && len(instances) > limit {
+		instances = instances[:limit]
+	}
+
+	servers := make([]map[string]interface{}, 0, len(instances))
+	for _, instance := range instances {
+		servers = append(servers, instance.ToMap())
+	}
+	obj := make(map[string]interface{})
+	obj["servers"] = servers
+	WriteHttpObj(obj, rw)
+}
+
+// StartDiscoveryServer 客户端访问的服务发现接口，和内部的http接口分开监听
+func StartDiscoveryServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/discovery", Discovery)
+	err := http.ListenAndServe(addr, loggingHandler{mux})
+	if err != nil {
+		log.Fatal("discovery server err:", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import "io"
+import "os"
+import "sync"
+import "time"
+import "os/signal"
+import "syscall"
+import "net/url"
+import "net/http"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//drain模式下每一步等待的检查间隔
+const DrainCheckInterval = 100 * time.Millisecond
+
+//退出前等待drain完成的时间超过drain超时的部分
+const DrainExitDelay = time.Second
+
+var draining int32
+
+//drain完成之后关闭
+var drainDone = make(chan struct{})
+
+//当前正在调用ims SavePeerMessage的数量
+var inflightSaves int64
+
+var listenerMutex sync.Mutex
+var listeners []io.Closer
+
+// AddListener 记录客户端连接的监听，drain时停止接受新连接
+func AddListener(l io.Closer) {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	listeners = append(listeners, l)
+}
+
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) > 0
+}
+
+// waitUntil 等待条件成立，超时返回false
+func waitUntil(deadline time.Time, cond func() bool) bool {
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(DrainCheckInterval)
+	}
+	return true
+}
+
+// Drain 停止接受新连接，通知客户端重连(address非空时连接该地址)，
+// 等待消息保存和待发送队列写完之后断开所有连接，取消imr上的订阅
+func Drain(address string) {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	log.Infof("drain begin, reconnect address:%s timeout:%s", address, config.drainTimeout)
+	deadline := time.Now().Add(config.drainTimeout)
+
+	//服务发现中立即排除当前实例
+	PublishInstance()
+
+	listenerMutex.Lock()
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	listenerMutex.Unlock()
+
+	clients := appRoute.GetClients()
+	for _, c := range clients {
+		//旧版本的客户端不认识MsgReconnect，断开之后自行重连
+		if c.version < ReconnectVersion {
+			continue
+		}
+		c.EnqueueNonBlockMessage(&Message{cmd: MsgReconnect, body: &Reconnect{address}})
+	}
+
+	if !waitUntil(deadline, func() bool { return atomic.LoadInt64(&inflightSaves) == 0 }) {
+		log.Warningf("drain timeout, inflight saves:%d", atomic.LoadInt64(&inflightSaves))
+	}
+
+	flushed := waitUntil(deadline, func() bool {
+		for _, c := range clients {
+			if atomic.LoadInt32(&c.closed) == 0 && c.GetBackpressureStat().queueDepth > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if !flushed {
+		log.Warning("drain timeout, write queues not flushed")
+	}
+
+	//断开连接时取消订阅，drain期间不保留会话
+	for _, c := range appRoute.GetClients() {
+		c.shutdown()
+	}
+	sessionStore.ExpireAll()
+
+	closed := waitUntil(deadline, func() bool {
+		return atomic.LoadInt64(&serverSummary.nclients) <= 0
+	})
+	if !closed {
+		log.Warningf("drain timeout, clients:%d", atomic.LoadInt64(&serverSummary.nclients))
+	}
+
+	unsubscribed := waitUntil(deadline, func() bool {
+		for _, channel := range GetRouteChannels() {
+			if len(channel.wt) > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if !unsubscribed {
+		log.Warning("drain timeout, route channels not flushed")
+	}
+
+	log.Info("drain end")
+	close(drainDone)
+}
+
+// HandleDrain http接口 /drain?address=ip:port
+func HandleDrain(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	address := m.Get("address")
+	if len(address) == 0 {
+		address = config.drainAddress
+	}
+	go Drain(address)
+
+	obj := make(map[string]interface{})
+	obj["draining"] = true
+	obj["address"] = address
+	WriteHttpObj(obj, rw)
+}
+
+// HandleSignal 收到SIGTERM/SIGINT时进入drain模式
+func HandleSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	s := <-c
+	log.Info("receive signal:", s)
+	Drain(config.drainAddress)
+	//drain已经由http接口开始时Drain直接返回，需要等待它完成
+	select {
+	case <-drainDone:
+	case <-time.After(config.drainTimeout + DrainExitDelay):
+		log.Warning("wait drain timeout")
+	}
+	log.Flush()
+	os.Exit(0)
+}
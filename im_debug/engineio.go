@@ -4,7 +4,9 @@ import (
 	log "github.com/golang/glog"
 	"github.com/googollee/go-engine.io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"time"
 )
 
 type EIOServer struct {
@@ -22,7 +24,7 @@ func (s *EIOServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	}
-	log.Info("req: %s", req)
+	log.Infof("req: %v", req)
 	s.server.ServeHTTP(w, req)
 }
 
@@ -38,8 +40,8 @@ func StartEngineIO(address string, tlsAddress string, certFile string, keyFile s
 			if err != nil {
 				log.Info("accept connect fail")
 			}
-			log.Info("new conn: %s", conn)
-			client := NewClient(conn)
+			log.Infof("new conn: %v", conn)
+			client := NewClient(NewEngineIOTransport(conn))
 			client.Run()
 		}
 	}()
@@ -49,16 +51,21 @@ func StartEngineIO(address string, tlsAddress string, certFile string, keyFile s
 	log.Infof("EngineIO Serving at %s...", address)
 
 	if tlsAddress != "" && certFile != "" && keyFile != "" {
+		tlsServer := &http.Server{Addr: tlsAddress, Handler: mux}
+		AddListener(tlsServer)
 		go func() {
 			log.Infof("EngineIO Serving TLS at %s...", tlsAddress)
-			err = http.ListenAndServeTLS(tlsAddress, certFile, keyFile, mux)
-			if err != nil {
+			err := tlsServer.ListenAndServeTLS(certFile, keyFile)
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("listen err:%s", err)
 			}
 		}()
 	}
-	err = http.ListenAndServe(address, mux)
-	if err != nil {
+	//drain时关闭监听
+	httpServer := &http.Server{Addr: address, Handler: mux}
+	AddListener(httpServer)
+	err = httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("listen err:%s", err)
 	}
 }
@@ -80,17 +87,58 @@ func ReadEngineIOMessage(conn engineio.Conn) *Message {
 	}
 }
 
-func SendEngineIOBinaryMessage(conn engineio.Conn, msg *Message) {
+func SendEngineIOBinaryMessage(conn engineio.Conn, msg *Message) error {
 	w, err := conn.NextWriter(engineio.BINARY)
 	if err != nil {
 		log.Info("get next writer fail")
-		return
+		return err
 	}
 	log.Info("message version:", msg.version)
 	err = SendMessage(w, msg)
 	if err != nil {
 		log.Info("engine io write error")
-		return
+		return err
 	}
-	_ = w.Close()
+	return w.Close()
+}
+
+// EngineIOTransport engine.io连接
+type EngineIOTransport struct {
+	conn    engineio.Conn
+	timeout time.Duration //读超时
+}
+
+func NewEngineIOTransport(conn engineio.Conn) *EngineIOTransport {
+	return &EngineIOTransport{conn: conn, timeout: config.ClientTimeout("engineio")}
+}
+
+// ReadMessage engine.io不支持设置读超时，超时之后关闭连接使读操作返回
+func (t *EngineIOTransport) ReadMessage() *Message {
+	timer := time.AfterFunc(t.timeout, func() {
+		log.Infof("engine.io conn:%s read timeout", t.conn.ID())
+		_ = t.conn.Close()
+	})
+	defer timer.Stop()
+	return ReadEngineIOMessage(t.conn)
+}
+
+func (t *EngineIOTransport) WriteMessage(msg *Message) error {
+	return SendEngineIOBinaryMessage(t.conn, msg)
+}
+
+//bug:https://github.com/googollee/go-engine.io/issues/34
+func (t *EngineIOTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *EngineIOTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *EngineIOTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *EngineIOTransport) Name() string {
+	return "engineio"
 }
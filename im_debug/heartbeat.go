@@ -0,0 +1,95 @@
+package main
+
+import "time"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//默认连续3次没有收到pong时断开连接
+const HeartbeatMaxMissed = 3
+
+// Pinger 传输层自带心跳(websocket ping/pong)，所有版本的客户端都会响应
+type Pinger interface {
+	Ping() error
+}
+
+func PlatformName(platformId int8) string {
+	switch platformId {
+	case PlatformIos:
+		return "ios"
+	case PlatformAndroid:
+		return "android"
+	case PlatformWeb:
+		return "web"
+	default:
+		return ""
+	}
+}
+
+// HeartbeatInterval 按照 传输方式_平台 > 平台 > 传输方式 > 默认值 的顺序查找心跳间隔，0表示不发送心跳
+func (config *Config) HeartbeatInterval(transport string, platformId int8) time.Duration {
+	platform := PlatformName(platformId)
+	keys := []string{transport + "_" + platform, platform, transport, ""}
+	for _, key := range keys {
+		if n, ok := config.heartbeatIntervals[key]; ok {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 0
+}
+
+// ClientTimeout 连接的读超时
+func (config *Config) ClientTimeout(transport string) time.Duration {
+	if n, ok := config.clientTimeouts[transport]; ok {
+		return time.Duration(n) * time.Second
+	}
+	if n, ok := config.clientTimeouts[""]; ok {
+		return time.Duration(n) * time.Second
+	}
+	return ClientTimeout * time.Second
+}
+
+// StartHeartbeat 认证成功之后开始发送心跳
+func (client *Client) StartHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if _, ok := client.conn.(Pinger); !ok && client.version < HeartbeatVersion {
+		//旧版本的客户端不会响应MsgPing
+		return
+	}
+	log.Infof("client:%d heartbeat interval:%s", client.uid, interval)
+	time.AfterFunc(interval, func() {
+		client.heartbeat(interval)
+	})
+}
+
+func (client *Client) heartbeat(interval time.Duration) {
+	if atomic.LoadInt32(&client.closed) > 0 {
+		return
+	}
+
+	missed := atomic.AddInt32(&client.missedPongs, 1)
+	if int(missed) > config.heartbeatMaxMissed {
+		log.Infof("client:%d missed %d pongs, close connection", client.uid, missed-1)
+		atomic.AddInt64(&serverSummary.heartbeatTimeoutCount, 1)
+		client.shutdown()
+		return
+	}
+
+	if p, ok := client.conn.(Pinger); ok {
+		err := p.Ping()
+		if err != nil {
+			log.Infof("client:%d ping err:%s", client.uid, err)
+		}
+	} else {
+		client.EnqueueNonBlockMessage(&Message{cmd: MsgPing})
+	}
+
+	time.AfterFunc(interval, func() {
+		client.heartbeat(interval)
+	})
+}
+
+func (client *Client) HandlePong() {
+	atomic.StoreInt32(&client.missedPongs, 0)
+}
@@ -8,11 +8,12 @@ import "runtime"
 import "math/rand"
 import "net/http"
 import "crypto/tls"
+import "sync/atomic"
 import "github.com/gomodule/redigo/redis"
 import log "github.com/golang/glog"
-import "github.com/valyala/gorpc"
 import "github.com/importcjj/sensitive"
 import "github.com/bitly/go-simplejson"
+import "im_research/hashring"
 
 var (
 	Version     string
@@ -23,12 +24,17 @@ var (
 )
 
 //storage server,  peer, group, customer message
-var rpcClients []*gorpc.DispatcherClient
+//key为ims地址，迁移期间包括之前的ims
+var rpcClients map[string]*StorageRPCClient
+var storageRing *hashring.Ring
+var oldStorageRing *hashring.Ring //迁移期间之前的成员，nil表示不在迁移中
 
-//route server
-var routeChannels []*Channel
+//route server, key为imr地址
+var routeChannels map[string]*Channel
+var routeRing *hashring.Ring
 
 var appRoute *AppRoute
+var sessionStore *SessionStore
 var redisPool *redis.Pool
 
 var config *Config
@@ -40,19 +46,20 @@ var filter *sensitive.Filter
 
 func init() {
 	appRoute = NewAppRoute()
+	sessionStore = NewSessionStore()
 	serverSummary = NewServerSummary()
 	syncC = make(chan *SyncHistory, 100)
 }
 
 func handleClient(conn net.Conn) {
 	log.Infoln("handle new connection")
-	client := NewClient(conn)
+	client := NewClient(NewTCPTransport(conn))
 	client.Run()
 }
 
 func handleSslClient(conn net.Conn) {
 	log.Infoln("handle new ssl connection")
-	client := NewClient(conn)
+	client := NewClient(NewTLSTransport(conn))
 	client.Run()
 }
 
@@ -69,9 +76,15 @@ func Listen(f func(net.Conn), port int) {
 		return
 	}
 
+	AddListener(tcpListener)
+
 	for {
 		client, err := tcpListener.AcceptTCP()
 		if err != nil {
+			if IsDraining() {
+				log.Info("listener closed")
+				return
+			}
 			log.Errorf("accept err:%s", err)
 			return
 		}
@@ -80,6 +93,10 @@ func Listen(f func(net.Conn), port int) {
 }
 
 func ListenClient() {
+	if config.epollMode {
+		ListenEpoll(config.port)
+		return
+	}
 	Listen(handleClient, config.port)
 }
 
@@ -96,10 +113,16 @@ func ListenSSL(port int, certFile, keyFile string) {
 		log.Fatal("ssl listen err:", err)
 	}
 
+	AddListener(listen)
+
 	log.Infof("ssl listen...")
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
+			if IsDraining() {
+				log.Info("ssl listener closed")
+				return
+			}
 			log.Fatal("ssl accept err:", err)
 		}
 		handleSslClient(conn)
@@ -134,33 +157,74 @@ func NewRedisPool(server, password string, db int) *redis.Pool {
 	}
 }
 
-// GetStorageRPCClient 个人消息／普通群消息／客服消息
-func GetStorageRPCClient(uid int64) *gorpc.DispatcherClient {
-	if uid < 0 {
-		uid = -uid
-	}
-	index := uid % int64(len(rpcClients))
-	return rpcClients[index]
-}
-
 func GetChannel(uid int64) *Channel {
-	if uid < 0 {
-		uid = -uid
-	}
-	index := uid % int64(len(routeChannels))
-	return routeChannels[index]
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return routeChannel(uid)
 }
 
 func GetRoomChannel(roomId int64) *Channel {
-	if roomId < 0 {
-		roomId = -roomId
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return routeChannel(roomId)
+}
+
+// updateSubscription 在clusterMutex内选择imr并更新订阅计数，UpdateRouteCluster迁移计数时不会遗漏
+// 写入之后imr发生了变化时，消息可能在迁移的取消订阅之后到达之前的imr，再次取消
+func updateSubscription(id int64, update func(*Channel) *Message, cancel *Message) {
+	clusterMutex.RLock()
+	channel := routeChannel(id)
+	version := routeVersion
+	msg := update(channel)
+	clusterMutex.RUnlock()
+	if msg == nil {
+		return
 	}
-	index := roomId % int64(len(routeChannels))
-	return routeChannels[index]
+	//imr未连接时写入会阻塞，不能持有clusterMutex
+	channel.wt <- msg
+
+	clusterMutex.RLock()
+	moved := routeVersion != version && routeChannel(id) != channel
+	clusterMutex.RUnlock()
+	if moved {
+		log.Infof("route of id:%d changed while subscribing, cancel on:%s", id, channel.addr)
+		channel.wt <- cancel
+	}
+}
+
+func SubscribeUser(appid int64, uid int64, online bool) {
+	cancel := &Message{cmd: MsgUnsubscribe, body: &AppUser{appid: appid, uid: uid}}
+	updateSubscription(uid, func(channel *Channel) *Message {
+		return channel.Subscribe(appid, uid, online)
+	}, cancel)
+}
+
+func UnsubscribeUser(appid int64, uid int64, online bool) {
+	cancel := &Message{cmd: MsgUnsubscribe, body: &AppUser{appid: appid, uid: uid}}
+	updateSubscription(uid, func(channel *Channel) *Message {
+		return channel.Unsubscribe(appid, uid, online)
+	}, cancel)
+}
+
+func SubscribeRoom(appid int64, roomId int64) {
+	cancel := &Message{cmd: MsgUnsubscribeRoom, body: &AppRoom{appid: appid, roomId: roomId}}
+	updateSubscription(roomId, func(channel *Channel) *Message {
+		return channel.SubscribeRoom(appid, roomId)
+	}, cancel)
+}
+
+func UnsubscribeRoom(appid int64, roomId int64) {
+	cancel := &Message{cmd: MsgUnsubscribeRoom, body: &AppRoom{appid: appid, roomId: roomId}}
+	updateSubscription(roomId, func(channel *Channel) *Message {
+		return channel.UnsubscribeRoom(appid, roomId)
+	}, cancel)
 }
 
 func SaveMessage(appid int64, uid int64, deviceId int64, m *Message) (int64, error) {
-	dc := GetStorageRPCClient(uid)
+	atomic.AddInt64(&inflightSaves, 1)
+	defer atomic.AddInt64(&inflightSaves, -1)
+
+	dc := GetStorageClient(uid)
 
 	pm := &PeerMessage{
 		Appid:    appid,
@@ -178,9 +242,103 @@ func SaveMessage(appid int64, uid int64, deviceId int64, m *Message) (int64, err
 
 	msgid := resp.(int64)
 	log.Infof("save peer message:%d %d %d %d\n", appid, uid, deviceId, msgid)
+	//迁移期间通知客户端的sync key和同步返回的一致
+	if GetOldStorageRPCClient(uid) != nil {
+		msgid |= SyncKeyNewStorage
+	}
 	return msgid, nil
 }
 
+//迁移期间从新的ims同步的sync key带上这个标记，没有标记的是之前的ims上的msgid
+//迁移结束之后调用ims时去掉标记，返回的sync key不再带标记
+const SyncKeyNewStorage = int64(1) << 62
+
+//之前的ims同步完成之后，用之前的ims上的msgid从新的ims同步时带上这个标记
+//新的ims上有reshard导入的消息时转换为对应的msgid, 否则从头同步，和ims_debug/reshard.go中的定义保持一致
+const SyncKeyPrevStorage = int64(1) << 60
+
+// syncKeyAfter 判断是否需要用key替换保存的sync key, 迁移期间切换到新的ims之后不再回到之前的ims
+func syncKeyAfter(key int64, origin int64) bool {
+	if key&SyncKeyNewStorage != 0 && origin&SyncKeyNewStorage == 0 {
+		return true
+	}
+	return key&^SyncKeyNewStorage > origin&^SyncKeyNewStorage
+}
+
+// tagSyncKey 新的ims返回的msgid带上迁移标记
+func tagSyncKey(ph *PeerHistoryMessage) *PeerHistoryMessage {
+	for _, m := range ph.Messages {
+		m.Msgid |= SyncKeyNewStorage
+	}
+	if ph.LastMsgid > 0 {
+		ph.LastMsgid |= SyncKeyNewStorage
+	}
+	return ph
+}
+
+// SyncMessage 迁移期间先从之前的ims同步，之前的ims上没有未同步的消息之后再从新的ims同步
+// 两个ims的msgid互不相关，通过sync key上的标记区分
+func SyncMessage(s *SyncHistory) (*PeerHistoryMessage, error) {
+	lastId := s.LastMsgid
+	req := *s
+	req.LastMsgid = lastId &^ SyncKeyNewStorage
+
+	old := GetOldStorageRPCClient(s.Uid)
+	if old == nil {
+		resp, err := CallStorageRead(GetStorageClient(s.Uid), "SyncMessage", &req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*PeerHistoryMessage), nil
+	}
+
+	if lastId&SyncKeyNewStorage == 0 {
+		resp, err := old.Call("SyncMessage", &req)
+		if err != nil {
+			log.Warning("sync message from old storage err:", err)
+			return nil, err
+		}
+		ph := resp.(*PeerHistoryMessage)
+		if len(ph.Messages) > 0 {
+			return ph, nil
+		}
+		//之前的ims上的消息已经同步完成，开始同步新的ims上的消息
+		if req.LastMsgid > 0 {
+			req.LastMsgid |= SyncKeyPrevStorage
+		}
+	}
+
+	resp, err := CallStorageRead(GetStorageClient(s.Uid), "SyncMessage", &req)
+	if err != nil {
+		return nil, err
+	}
+	return tagSyncKey(resp.(*PeerHistoryMessage)), nil
+}
+
+// GetLatestMessage 迁移期间消息不足时使用之前的ims补齐，之前的消息排在后面
+func GetLatestMessage(r *HistoryRequest) ([]*HistoryMessage, error) {
+	resp, err := CallStorageRead(GetStorageClient(r.Uid), "GetLatestMessage", r)
+	if err != nil {
+		return nil, err
+	}
+	hm := resp.([]*HistoryMessage)
+	if len(hm) >= int(r.Limit) {
+		return hm, nil
+	}
+
+	old := GetOldStorageRPCClient(r.Uid)
+	if old == nil {
+		return hm, nil
+	}
+	req := &HistoryRequest{Appid: r.Appid, Uid: r.Uid, Limit: r.Limit - int32(len(hm))}
+	resp, err = old.Call("GetLatestMessage", req)
+	if err != nil {
+		log.Warning("get latest message from old storage err:", err)
+		return hm, nil
+	}
+	return append(hm, resp.([]*HistoryMessage)...), nil
+}
+
 // PushMessage 离线消息推送
 func PushMessage(appid int64, uid int64, m *Message) {
 	PublishMessage(appid, uid, m)
@@ -281,6 +439,10 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func StartHttpServer(addr string) {
 	http.HandleFunc("/summary", Summary)
 	http.HandleFunc("/stack", Stack)
+	http.HandleFunc("/slow_consumers", SlowConsumers)
+	http.HandleFunc("/drain", HandleDrain)
+	http.HandleFunc("/discovery", Discovery)
+	http.HandleFunc("/cluster", Cluster)
 
 	//rpc function
 	http.HandleFunc("/post_im_message", PostIMMessage)
@@ -307,7 +469,7 @@ func SyncKeyService() {
 		select {
 		case s := <-syncC:
 			origin := GetSyncKey(s.Appid, s.Uid)
-			if s.LastMsgid > origin {
+			if syncKeyAfter(s.LastMsgid, origin) {
 				log.Infof("save sync key:%d %d %d", s.Appid, s.Uid, s.LastMsgid)
 				SaveSyncKey(s.Appid, s.Uid, s.LastMsgid)
 			}
@@ -330,36 +492,39 @@ func main() {
 	log.Infof("port:%d\n", config.port)
 	log.Infof("redis address:%s password:%s db:%d\n", config.redisAddress, config.redisPassword, config.redisDb)
 	log.Info("storage addresses:", config.storageRpcAddrs)
+	log.Info("storage old addresses:", config.storageRpcOldAddrs)
+	log.Infof("shard hash:%s old:%s replicas:%d", config.shardHash, config.shardHashOld, config.hashReplicas)
+	log.Infof("storage max staleness:%s check interval:%s", config.storageMaxStaleness, config.storageCheckInterval)
 	log.Info("route addressed:", config.routeAddrs)
 	log.Infof("socket io address:%s tls_address:%s cert file:%s key file:%s",
 		config.socketIoAddress, config.tlsAddress, config.certFile, config.keyFile)
 	log.Info("sync self:", config.syncSelf)
+	log.Infof("message queue limit:%d bytes limit:%d slow consumer policy:%s",
+		config.messageQueueLimit, config.messageQueueBytesLimit, config.slowConsumerPolicy)
+	log.Info("session grace period:", config.sessionGracePeriod)
+	log.Infof("drain address:%s timeout:%s", config.drainAddress, config.drainTimeout)
+	log.Infof("epoll mode:%t workers:%d", config.epollMode, config.epollWorkers)
+	log.Infof("cluster file:%s redis:%t watch interval:%s",
+		config.clusterFile, config.clusterRedis, config.clusterWatchInterval)
 
 	redisPool = NewRedisPool(config.redisAddress, config.redisPassword, config.redisDb)
-	rpcClients = make([]*gorpc.DispatcherClient, 0)
-	for _, addr := range config.storageRpcAddrs {
-		c := &gorpc.Client{
-			Conns: 4,
-			Addr:  addr,
-		}
-		c.Start()
-
-		dispatcher := gorpc.NewDispatcher()
-		dispatcher.AddFunc("SyncMessage", SyncMessageInterface)
-		dispatcher.AddFunc("SavePeerMessage", SavePeerMessageInterface)
-		dispatcher.AddFunc("GetLatestMessage", GetLatestMessageInterface)
-
-		dc := dispatcher.NewFuncClient(c)
-
-		rpcClients = append(rpcClients, dc)
+	n := len(config.storageRpcOldAddrs)
+	masters, replicas := SplitReplicas(append(config.storageRpcOldAddrs, config.storageRpcAddrs...))
+	ring, err := NewRing(masters[n:], config.shardHash)
+	if err != nil {
+		log.Fatal("storage pool config err:", err)
+	}
+	oldRing, err := NewRing(masters[:n], config.shardHashOld)
+	if err != nil {
+		log.Fatal("storage old pool config err:", err)
 	}
+	UpdateStorageCluster(ring, oldRing, replicas)
 
-	routeChannels = make([]*Channel, 0)
-	for _, addr := range config.routeAddrs {
-		channel := NewChannel(addr, DispatchAppMessage, DispatchRoomMessage)
-		channel.Start()
-		routeChannels = append(routeChannels, channel)
+	ring, err = NewRing(config.routeAddrs, config.shardHash)
+	if err != nil {
+		log.Fatal("route pool config err:", err)
 	}
+	UpdateRouteCluster(ring)
 
 	if len(config.wordFile) > 0 {
 		filter = sensitive.New()
@@ -368,6 +533,13 @@ func main() {
 
 	go ListenRedis()
 	go SyncKeyService()
+	go HandleSignal()
+	go DiscoveryService()
+	go ClusterService()
+	go StorageHealthService()
+	if len(config.discoveryAddress) > 0 {
+		go StartDiscoveryServer(config.discoveryAddress)
+	}
 
 	go StartHttpServer(config.httpListenAddress)
 	StartRPCServer(config.rpcListenAddress)
@@ -379,5 +551,9 @@ func main() {
 		go ListenSSL(config.sslPort, config.certFile, config.keyFile)
 	}
 	ListenClient()
+	if IsDraining() {
+		<-drainDone
+	}
 	log.Infof("exit")
+	log.Flush()
 }
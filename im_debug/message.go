@@ -32,6 +32,8 @@ const MsgSyncGroupNotify = 33
 const MsgSyncKey = 34
 const MsgGroupSyncKey = 35
 const MsgNotification = 36
+const MsgResync = 37 //服务端->客户端 连接即将断开，客户端重连之后需要重新同步
+const MsgReconnect = 38 //服务端->客户端 服务器即将停止，客户端需要重连(地址非空时连接该地址)，协议版本>=3
 const MsgVoipControl = 64
 
 const MessageFlagText = 0x01         //文本消息
@@ -40,7 +42,6 @@ const MessageFlagGroup = 0x04
 const MessageFlagSelf = 0x08 //离线消息由当前登录的用户在当前设备发出
 
 func init() {
-	messageCreators[MsgAck] = func() IMessage { return new(MessageACK) }
 	messageCreators[MsgGroupNotification] = func() IMessage { return new(GroupNotification) }
 	messageCreators[MsgAuthToken] = func() IMessage { return new(AuthToken) }
 	messageCreators[MsgRt] = func() IMessage { return new(RTMessage) }
@@ -64,10 +65,12 @@ func init() {
 	messageCreators[MsgGroupSyncKey] = func() IMessage { return new(GroupSyncKey) }
 	messageCreators[MsgNotification] = func() IMessage { return new(SystemMessage) }
 	messageCreators[MsgVoipControl] = func() IMessage { return new(VOIPControl) }
+	messageCreators[MsgReconnect] = func() IMessage { return new(Reconnect) }
 
 	vmessageCreators[MsgGroupIm] = func() IVersionMessage { return new(IMMessage) }
 	vmessageCreators[MsgIm] = func() IVersionMessage { return new(IMMessage) }
 	vmessageCreators[MsgAuthStatus] = func() IVersionMessage { return new(AuthStatus) }
+	vmessageCreators[MsgAck] = func() IVersionMessage { return new(MessageACK) }
 
 	messageDescriptions[MsgAuthStatus] = "MSG_AUTH_STATUS"
 	messageDescriptions[MsgIm] = "MSG_IM"
@@ -95,6 +98,8 @@ func init() {
 	messageDescriptions[MsgSyncGroupEnd] = "MSG_SYNC_GROUP_END"
 	messageDescriptions[MsgSyncGroupNotify] = "MSG_SYNC_GROUP_NOTIFY"
 	messageDescriptions[MsgNotification] = "MSG_NOTIFICATION"
+	messageDescriptions[MsgResync] = "MSG_RESYNC"
+	messageDescriptions[MsgReconnect] = "MSG_RECONNECT"
 	messageDescriptions[MsgVoipControl] = "MSG_VOIP_CONTROL"
 
 	externalMessages[MsgAuthToken] = true
@@ -199,6 +204,7 @@ type AuthToken struct {
 	accessToken string
 	platformId  int8
 	device      string
+	session     string //可选，重连时恢复之前的会话
 }
 
 func (auth *AuthToken) ToData() []byte {
@@ -215,6 +221,12 @@ func (auth *AuthToken) ToData() []byte {
 	_ = binary.Write(buffer, binary.BigEndian, l)
 	buffer.Write([]byte(auth.device))
 
+	if len(auth.session) > 0 {
+		l = int8(len(auth.session))
+		_ = binary.Write(buffer, binary.BigEndian, l)
+		buffer.Write([]byte(auth.session))
+	}
+
 	buf := buffer.Bytes()
 	return buf
 }
@@ -244,6 +256,17 @@ func (auth *AuthToken) FromData(buff []byte) bool {
 
 	auth.accessToken = string(token)
 	auth.device = string(deviceId)
+
+	//旧版本客户端没有session字段
+	if buffer.Len() > 0 {
+		_ = binary.Read(buffer, binary.BigEndian, &l)
+		if int(l) > buffer.Len() || int(l) < 0 {
+			return false
+		}
+		session := make([]byte, l)
+		_, _ = buffer.Read(session)
+		auth.session = string(session)
+	}
 	return true
 }
 
@@ -252,8 +275,11 @@ func (auth *AuthToken) FromData(buff []byte) bool {
 //region AuthStatus
 
 type AuthStatus struct {
-	status int32
-	ip     int32 //兼容版本0
+	status    int32
+	ip        int32 //兼容版本0
+	heartbeat int32  //推荐的心跳间隔(秒), 版本2
+	session   string //会话token, 版本3
+	resumed   int8   //是否恢复了之前的会话, 版本3
 }
 
 func (auth *AuthStatus) ToData(version int) []byte {
@@ -262,6 +288,15 @@ func (auth *AuthStatus) ToData(version int) []byte {
 	if version == 0 {
 		_ = binary.Write(buffer, binary.BigEndian, auth.ip)
 	}
+	if version >= HeartbeatVersion {
+		_ = binary.Write(buffer, binary.BigEndian, auth.heartbeat)
+	}
+	if version >= SessionVersion {
+		l := int8(len(auth.session))
+		_ = binary.Write(buffer, binary.BigEndian, l)
+		buffer.Write([]byte(auth.session))
+		_ = binary.Write(buffer, binary.BigEndian, auth.resumed)
+	}
 	buf := buffer.Bytes()
 	return buf
 }
@@ -278,6 +313,23 @@ func (auth *AuthStatus) FromData(version int, buff []byte) bool {
 		}
 		_ = binary.Read(buffer, binary.BigEndian, &auth.ip)
 	}
+	if version >= HeartbeatVersion {
+		if len(buff) < 8 {
+			return false
+		}
+		_ = binary.Read(buffer, binary.BigEndian, &auth.heartbeat)
+	}
+	if version >= SessionVersion {
+		var l int8
+		err := binary.Read(buffer, binary.BigEndian, &l)
+		if err != nil || int(l) < 0 || int(l)+1 > buffer.Len() {
+			return false
+		}
+		session := make([]byte, l)
+		_, _ = buffer.Read(session)
+		auth.session = string(session)
+		_ = binary.Read(buffer, binary.BigEndian, &auth.resumed)
+	}
 	return true
 }
 
@@ -390,19 +442,30 @@ func (im *IMMessage) FromData(version int, buff []byte) bool {
 //region MessageACK
 
 type MessageACK struct {
-	seq int32
+	seq    int32
+	status int8 //0:成功 非0:消息保存失败, 版本4
 }
 
-func (ack *MessageACK) ToData() []byte {
+func (ack *MessageACK) ToData(version int) []byte {
 	buffer := new(bytes.Buffer)
 	_ = binary.Write(buffer, binary.BigEndian, ack.seq)
+	if version >= AckStatusVersion {
+		_ = binary.Write(buffer, binary.BigEndian, ack.status)
+	}
 	buf := buffer.Bytes()
 	return buf
 }
 
-func (ack *MessageACK) FromData(buff []byte) bool {
+func (ack *MessageACK) FromData(version int, buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
 	buffer := bytes.NewBuffer(buff)
 	_ = binary.Read(buffer, binary.BigEndian, &ack.seq)
+	//客户端发送的ack可以不带status
+	if version >= AckStatusVersion && buffer.Len() > 0 {
+		_ = binary.Read(buffer, binary.BigEndian, &ack.status)
+	}
 	return true
 }
 
@@ -448,6 +511,23 @@ func (sys *SystemMessage) FromData(buff []byte) bool {
 
 //endregion
 
+//region Reconnect
+
+type Reconnect struct {
+	address string //客户端重连的地址 ip:port, 为空时使用原有的地址
+}
+
+func (r *Reconnect) ToData() []byte {
+	return []byte(r.address)
+}
+
+func (r *Reconnect) FromData(buff []byte) bool {
+	r.address = string(buff)
+	return true
+}
+
+//endregion
+
 //region CustomerMessage
 
 type CustomerMessage struct {
@@ -5,6 +5,9 @@ import "encoding/json"
 import "os"
 import "runtime"
 import "runtime/pprof"
+import "net/url"
+import "strconv"
+import "sync/atomic"
 import log "github.com/golang/glog"
 
 type ServerSummary struct {
@@ -12,6 +15,14 @@ type ServerSummary struct {
 	nclients        int64
 	inMessageCount  int64
 	outMessageCount int64
+
+	droppedMessageCount int64 //待发送队列满时丢弃的消息数量
+	evictedCount        int64 //被踢出的慢连接数量
+
+	heartbeatTimeoutCount int64 //心跳超时被断开的连接数量
+	resumedCount          int64 //恢复会话的连接数量
+
+	storageReadFailoverCount int64 //master不可用时从slave读取的次数
 }
 
 func NewServerSummary() *ServerSummary {
@@ -26,6 +37,14 @@ func Summary(rw http.ResponseWriter, req *http.Request) {
 	obj["client_count"] = serverSummary.nclients
 	obj["in_message_count"] = serverSummary.inMessageCount
 	obj["out_message_count"] = serverSummary.outMessageCount
+	obj["dropped_message_count"] = atomic.LoadInt64(&serverSummary.droppedMessageCount)
+	obj["evicted_count"] = atomic.LoadInt64(&serverSummary.evictedCount)
+	obj["heartbeat_timeout_count"] = atomic.LoadInt64(&serverSummary.heartbeatTimeoutCount)
+	obj["resumed_count"] = atomic.LoadInt64(&serverSummary.resumedCount)
+	obj["storage_read_failover_count"] = atomic.LoadInt64(&serverSummary.storageReadFailoverCount)
+	obj["storage"] = GetStorageStats()
+	obj["session_count"] = sessionStore.Count()
+	obj["draining"] = IsDraining()
 
 	res, err := json.Marshal(obj)
 	if err != nil {
@@ -41,6 +60,44 @@ func Summary(rw http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// SlowConsumers 待发送消息堆积的连接
+func SlowConsumers(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+
+	minDepth := 1
+	if s := m.Get("min_depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		minDepth = n
+	}
+
+	limit := 100
+	if s := m.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		limit = n
+	}
+
+	stats := GetBackpressureStats(minDepth, limit)
+	conns := make([]map[string]interface{}, 0, len(stats))
+	for _, stat := range stats {
+		conns = append(conns, stat.ToMap())
+	}
+
+	obj := make(map[string]interface{})
+	obj["policy"] = config.slowConsumerPolicy
+	obj["queue_limit"] = config.messageQueueLimit
+	obj["queue_bytes_limit"] = config.messageQueueBytesLimit
+	obj["connections"] = conns
+	WriteHttpObj(obj, rw)
+}
+
 func Stack(rw http.ResponseWriter, req *http.Request) {
 	pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
 	rw.WriteHeader(200)
@@ -9,17 +9,14 @@ type PeerClient struct {
 }
 
 func (client *PeerClient) Login() {
-	channel := GetChannel(client.uid)
-
-	channel.Subscribe(client.appid, client.uid, client.online)
+	SubscribeUser(client.appid, client.uid, client.online)
 
 	SetUserUnreadCount(client.appid, client.uid, 0)
 }
 
 func (client *PeerClient) Logout() {
 	if client.uid > 0 {
-		channel := GetChannel(client.uid)
-		channel.Unsubscribe(client.appid, client.uid, client.online)
+		UnsubscribeUser(client.appid, client.uid, client.online)
 	}
 }
 
@@ -33,8 +30,6 @@ func (client *PeerClient) HandleSync(syncKey *SyncKey) {
 		lastId = GetSyncKey(client.appid, client.uid)
 	}
 
-	rpc := GetStorageRPCClient(client.uid)
-
 	s := &SyncHistory{
 		Appid:     client.appid,
 		Uid:       client.uid,
@@ -44,14 +39,13 @@ func (client *PeerClient) HandleSync(syncKey *SyncKey) {
 
 	log.Infof("syncing message:%d %d %d %d", client.appid, client.uid, client.deviceId, lastId)
 
-	resp, err := rpc.Call("SyncMessage", s)
+	ph, err := SyncMessage(s)
 	if err != nil {
 		log.Warning("sync message err:", err)
 		return
 	}
 	client.syncCount += 1
 
-	ph := resp.(*PeerHistoryMessage)
 	messages := ph.Messages
 
 	msgs := make([]*Message, 0, len(messages)+2)
@@ -85,7 +79,8 @@ func (client *PeerClient) HandleSync(syncKey *SyncKey) {
 		msgs = append(msgs, m)
 	}
 
-	if ph.LastMsgid < lastId && ph.LastMsgid > 0 {
+	//切换ims时两个sync key不能比较
+	if ph.LastMsgid < lastId && ph.LastMsgid > 0 && (ph.LastMsgid^lastId)&SyncKeyNewStorage == 0 {
 		sk.syncKey = ph.LastMsgid
 		log.Warningf("client last id:%d server last id:%d", lastId, ph.LastMsgid)
 	}
@@ -132,15 +127,16 @@ func (client *PeerClient) HandleIMMessage(message *Message) {
 
 	msgid, err := SaveMessage(client.appid, msg.receiver, client.deviceId, m)
 	if err != nil {
-		log.Errorf("save peer message:%d %d err:", msg.sender, msg.receiver, err)
+		log.Errorf("save peer message:%d %d err:%s", msg.sender, msg.receiver, err)
+		client.SendErrorAck(seq, err)
 		return
 	}
 
 	//保存到自己的消息队列，这样用户的其它登陆点也能接受到自己发出的消息
+	//接收者已经保存成功，失败时不能回复错误，否则客户端重发之后接收者会收到重复的消息
 	msgid2, err := SaveMessage(client.appid, msg.sender, client.deviceId, m)
 	if err != nil {
-		log.Errorf("save peer message:%d %d err:", msg.sender, msg.receiver, err)
-		return
+		log.Errorf("save peer message:%d %d to sender err:%s", msg.sender, msg.receiver, err)
 	}
 
 	//推送外部通知
@@ -151,10 +147,12 @@ func (client *PeerClient) HandleIMMessage(message *Message) {
 	client.SendMessage(msg.receiver, notify)
 
 	//发送给自己的其它登录点
-	notify = &Message{cmd: MsgSyncNotify, body: &SyncKey{msgid2}}
-	client.SendMessage(client.uid, notify)
+	if err == nil {
+		notify = &Message{cmd: MsgSyncNotify, body: &SyncKey{msgid2}}
+		client.SendMessage(client.uid, notify)
+	}
 
-	ack := &Message{cmd: MsgAck, body: &MessageACK{int32(seq)}}
+	ack := &Message{cmd: MsgAck, body: &MessageACK{seq: int32(seq)}}
 	r := client.EnqueueMessage(ack)
 	if !r {
 		log.Warning("send peer message ack error")
@@ -164,6 +162,15 @@ func (client *PeerClient) HandleIMMessage(message *Message) {
 	log.Infof("peer message sender:%d receiver:%d msgid:%d\n", msg.sender, msg.receiver, msgid)
 }
 
+// SendErrorAck 消息保存失败时通知客户端，旧版本的客户端没有ack会超时重发
+func (client *PeerClient) SendErrorAck(seq int, err error) {
+	if client.version < AckStatusVersion {
+		return
+	}
+	ack := &Message{cmd: MsgAck, body: &MessageACK{seq: int32(seq), status: AckStatus(err)}}
+	client.EnqueueMessage(ack)
+}
+
 func (client *PeerClient) HandleUnreadCount(u *MessageUnreadCount) {
 	SetUserUnreadCount(client.appid, client.uid, u.count)
 }
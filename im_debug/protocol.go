@@ -6,14 +6,31 @@ import "encoding/binary"
 import log "github.com/golang/glog"
 import "errors"
 import "encoding/hex"
+import "sync"
 
 const PlatformIos = 1
 const PlatformAndroid = 2
 const PlatformWeb = 3
 
 const DefaultVersion = 1
+
+//客户端协议版本>=2时AuthStatus包含心跳间隔，并且客户端会响应服务端的MsgPing
+const HeartbeatVersion = 2
+
+//客户端协议版本>=3时AuthStatus包含会话token，重连时可以通过AuthToken恢复会话
+const SessionVersion = 3
+
+//客户端协议版本>=3时支持MsgReconnect
+const ReconnectVersion = 3
+
+//版本4开始消息保存失败时回复带错误码的ack，之前的版本不回复ack，由客户端超时重发
+const AckStatusVersion = 4
+
 const MsgHeaderSize = 12
 
+const WriteBufferSize = 64 * 1024      //批量写入时单次写入的数据量
+const MaxPooledBufferSize = 256 * 1024 //超过该大小的缓冲区不放回pool
+
 type MessageCreator func() IMessage
 
 type VersionMessageCreator func() IVersionMessage
@@ -28,10 +45,13 @@ var vmessageCreators = make(map[int]VersionMessageCreator)
 var externalMessages [256]bool
 
 func WriteHeader(len int32, seq int32, cmd byte, version byte, flag byte, buffer io.Writer) {
-	_ = binary.Write(buffer, binary.BigEndian, len)
-	_ = binary.Write(buffer, binary.BigEndian, seq)
-	t := []byte{cmd, byte(version), flag, 0}
-	_, _ = buffer.Write(t)
+	var t [MsgHeaderSize]byte
+	binary.BigEndian.PutUint32(t[0:4], uint32(len))
+	binary.BigEndian.PutUint32(t[4:8], uint32(seq))
+	t[8] = cmd
+	t[9] = version
+	t[10] = flag
+	_, _ = buffer.Write(t[:])
 }
 
 func ReadHeader(buff []byte) (int, int, int, int, int) {
@@ -52,10 +72,28 @@ func WriteMessage(w *bytes.Buffer, msg *Message) {
 	w.Write(body)
 }
 
-func SendMessage(conn io.Writer, msg *Message) error {
-	buffer := new(bytes.Buffer)
-	WriteMessage(buffer, msg)
-	buf := buffer.Bytes()
+//编码消息时复用的缓冲区
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	//避免长期持有过大的缓冲区
+	if buffer.Cap() > MaxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buffer)
+}
+
+func writeFull(conn io.Writer, buf []byte) error {
 	n, err := conn.Write(buf)
 	if err != nil {
 		log.Info("sock write error:", err)
@@ -68,6 +106,32 @@ func SendMessage(conn io.Writer, msg *Message) error {
 	return nil
 }
 
+func SendMessage(conn io.Writer, msg *Message) error {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	WriteMessage(buffer, msg)
+	return writeFull(conn, buffer.Bytes())
+}
+
+// SendMessages 将多个消息编码到同一个缓冲区，缓冲区超过WriteBufferSize时才写入一次
+func SendMessages(conn io.Writer, msgs []*Message) error {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	for _, msg := range msgs {
+		WriteMessage(buffer, msg)
+		if buffer.Len() >= WriteBufferSize {
+			if err := writeFull(conn, buffer.Bytes()); err != nil {
+				return err
+			}
+			buffer.Reset()
+		}
+	}
+	if buffer.Len() == 0 {
+		return nil
+	}
+	return writeFull(conn, buffer.Bytes())
+}
+
 func ReceiveLimitMessage(conn io.Reader, limitSize int, external bool) *Message {
 	buff := make([]byte, 12)
 	_, err := io.ReadFull(conn, buff)
@@ -109,6 +173,50 @@ func ReceiveLimitMessage(conn io.Reader, limitSize int, external bool) *Message
 	return message
 }
 
+// DecodeLimitMessage 从缓冲区中解析一个完整的消息，返回消息和消耗的字节数
+// 数据不完整时返回(nil, 0, nil)
+func DecodeLimitMessage(buff []byte, limitSize int, external bool) (*Message, int, error) {
+	if len(buff) < MsgHeaderSize {
+		return nil, 0, nil
+	}
+
+	length, seq, cmd, version, flag := ReadHeader(buff[:MsgHeaderSize])
+	if length < 0 || length >= limitSize {
+		log.Info("invalid len:", length)
+		return nil, 0, errors.New("invalid length")
+	}
+
+	if external && !externalMessages[cmd] {
+		log.Warning("invalid external message cmd:", Command(cmd))
+		return nil, 0, errors.New("invalid external message")
+	}
+
+	if len(buff) < MsgHeaderSize+length {
+		return nil, 0, nil
+	}
+
+	//消息体不能引用调用者的缓冲区
+	body := make([]byte, length)
+	copy(body, buff[MsgHeaderSize:MsgHeaderSize+length])
+
+	message := new(Message)
+	message.cmd = cmd
+	message.seq = seq
+	message.version = version
+	message.flag = flag
+	if !message.FromData(body) {
+		log.Warningf("parse error:%d, %d %d %d %s", cmd, seq, version,
+			flag, hex.EncodeToString(body))
+		return nil, 0, errors.New("parse error")
+	}
+	return message, MsgHeaderSize + length, nil
+}
+
+// DecodeClientMessage 解析客户端消息(external messages)
+func DecodeClientMessage(buff []byte) (*Message, int, error) {
+	return DecodeLimitMessage(buff, 32*1024, true)
+}
+
 func ReceiveMessage(conn io.Reader) *Message {
 	return ReceiveLimitMessage(conn, 32*1024, false)
 }
@@ -0,0 +1,75 @@
+package main
+
+import "io"
+import "bytes"
+import "testing"
+
+//MsgSyncBegin..End之间一次发送的消息数量
+const benchBatchSize = 100
+
+//统计写操作的次数, 每次写操作对应一次系统调用
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+//合并写入之前的实现, 每个消息分配一个缓冲区并单独写入
+func sendMessageUnpooled(conn io.Writer, msg *Message) error {
+	buffer := new(bytes.Buffer)
+	WriteMessage(buffer, msg)
+	return writeFull(conn, buffer.Bytes())
+}
+
+func benchMessages() []*Message {
+	msgs := make([]*Message, benchBatchSize)
+	for i := range msgs {
+		im := &IMMessage{sender: 1, receiver: 2, msgid: int32(i), content: "benchmark message content"}
+		msgs[i] = &Message{cmd: MsgIm, seq: i, version: DefaultVersion, body: im}
+	}
+	return msgs
+}
+
+func reportWrites(b *testing.B, w *countingWriter) {
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSendMessageUnpooled(b *testing.B) {
+	msgs := benchMessages()
+	w := &countingWriter{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			_ = sendMessageUnpooled(w, msg)
+		}
+	}
+	reportWrites(b, w)
+}
+
+func BenchmarkSendMessage(b *testing.B) {
+	msgs := benchMessages()
+	w := &countingWriter{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			_ = SendMessage(w, msg)
+		}
+	}
+	reportWrites(b, w)
+}
+
+func BenchmarkSendMessages(b *testing.B) {
+	msgs := benchMessages()
+	w := &countingWriter{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = SendMessages(w, msgs)
+	}
+	reportWrites(b, w)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "sync/atomic"
+
+// WritePool 共享的写协程池，epoll模式下代替每个连接独立的写协程
+type WritePool struct {
+	c chan *Client
+}
+
+func NewWritePool(workers int) *WritePool {
+	pool := &WritePool{c: make(chan *Client, 10000)}
+	for i := 0; i < workers; i++ {
+		go pool.run()
+	}
+	return pool
+}
+
+// Schedule 连接有待发送的消息时加入写队列，同一个连接同时只会在一个写协程中处理
+func (pool *WritePool) Schedule(client *Client) {
+	if !atomic.CompareAndSwapInt32(&client.scheduled, 0, 1) {
+		return
+	}
+	select {
+	case pool.c <- client:
+	default:
+		//写协程中重新调度时不能阻塞
+		go func() {
+			pool.c <- client
+		}()
+	}
+}
+
+func (pool *WritePool) run() {
+	batch := make([]*Message, 0, WriteBatchLimit)
+	for client := range pool.c {
+		if !client.FlushPending(batch[:0]) {
+			//连接已关闭，不再调度
+			continue
+		}
+		atomic.StoreInt32(&client.scheduled, 0)
+		//清除标记之前可能有新的消息入队
+		if client.hasPending() {
+			pool.Schedule(client)
+		}
+	}
+}
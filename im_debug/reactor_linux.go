@@ -0,0 +1,324 @@
+package main
+
+import "net"
+import "sync"
+import "syscall"
+import "time"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+const EpollReadBufferSize = 16 * 1024
+
+//epoll模式下连接的写队列容量，消息由写协程池及时取走，不需要太大
+const EpollWtSize = 32
+const EpollPwtSize = 10
+
+//单个连接待处理的消息达到这个数量时暂停读取，由tcp流控限制客户端发送
+const EpollPendingLimit = 128
+
+// ReactorConn epoll模式下连接的状态，buff只在epoll协程中读写
+type ReactorConn struct {
+	fd       int
+	client   *Client
+	buff     []byte //未解析完整的数据，空闲连接不占用读缓冲区
+	lastRead int64  //最后一次收到数据的时间(秒)
+
+	mutex   sync.Mutex
+	pending []*Message //待处理的消息，nil表示连接已关闭，由mutex保护
+	running bool       //是否有协程正在处理pending
+	paused  bool       //待处理的消息过多，已经暂停读取
+}
+
+// Reactor 基于epoll的tcp连接处理，空闲的连接不再需要独立的读写协程
+// 连接有待处理的消息时才启动处理协程按顺序处理，处理消息时会阻塞在ims的rpc上，不能共享处理协程
+type Reactor struct {
+	epfd int
+
+	mutex sync.Mutex
+	conns map[int]*ReactorConn
+
+	writer *WritePool
+}
+
+func NewReactor(workers int) (*Reactor, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(Reactor)
+	r.epfd = epfd
+	r.conns = make(map[int]*ReactorConn)
+	r.writer = NewWritePool(workers)
+	return r, nil
+}
+
+func (r *Reactor) AddConn(conn *net.TCPConn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		log.Error("syscall conn err:", err)
+		_ = conn.Close()
+		return
+	}
+	fd := -1
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	if err != nil {
+		log.Error("get conn fd err:", err)
+		_ = conn.Close()
+		return
+	}
+
+	//transport持有conn，避免conn被回收时关闭fd
+	client := newClient(NewTCPTransport(conn), EpollWtSize, EpollPwtSize)
+	client.wakeup = func() {
+		r.writer.Schedule(client)
+	}
+
+	rc := &ReactorConn{fd: fd, client: client, lastRead: time.Now().Unix()}
+	client.closer = func() {
+		r.close(rc)
+	}
+	r.mutex.Lock()
+	old := r.conns[fd]
+	r.conns[fd] = rc
+	r.mutex.Unlock()
+
+	//所有的关闭都经过reactor，fd在移除之后才会关闭，不应该被复用
+	if old != nil {
+		log.Errorf("fd:%d is reused before removed from epoll", fd)
+		r.dispatch(old, nil)
+	}
+
+	event := &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	err = syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_ADD, fd, event)
+	if err != nil {
+		log.Error("epoll ctl err:", err)
+		if r.remove(rc) {
+			client.HandleClientClosed()
+		}
+	}
+}
+
+// remove 从epoll中移除连接，只有第一次调用返回true
+func (r *Reactor) remove(rc *ReactorConn) bool {
+	r.mutex.Lock()
+	c, ok := r.conns[rc.fd]
+	if !ok || c != rc {
+		r.mutex.Unlock()
+		return false
+	}
+	delete(r.conns, rc.fd)
+	r.mutex.Unlock()
+
+	_ = syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_DEL, rc.fd, nil)
+	return true
+}
+
+// close 关闭连接，在连接已经入队的消息处理完之后执行
+func (r *Reactor) close(rc *ReactorConn) {
+	if r.remove(rc) {
+		r.dispatch(rc, nil)
+	}
+}
+
+// dispatch 不阻塞epoll协程，待处理的消息过多时暂停读取该连接
+func (r *Reactor) dispatch(rc *ReactorConn, msg *Message) {
+	rc.mutex.Lock()
+	rc.pending = append(rc.pending, msg)
+	pause := msg != nil && !rc.paused && len(rc.pending) >= EpollPendingLimit
+	if pause {
+		rc.paused = true
+	}
+	start := !rc.running
+	rc.running = true
+	rc.mutex.Unlock()
+
+	if pause {
+		log.Infof("client:%d too many pending messages, pause reading", rc.client.uid)
+		r.setReading(rc, false)
+	}
+	if start {
+		go r.handle(rc)
+	}
+}
+
+// setReading 暂停或者恢复读取，已经从epoll中移除的连接不再修改
+func (r *Reactor) setReading(rc *ReactorConn, reading bool) {
+	if r.find(rc.fd) != rc {
+		return
+	}
+	var events uint32
+	if reading {
+		events = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	event := &syscall.EpollEvent{Events: events, Fd: int32(rc.fd)}
+	err := syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_MOD, rc.fd, event)
+	if err != nil {
+		log.Warningf("client:%d epoll ctl err:%s", rc.client.uid, err)
+	}
+}
+
+// next 取出下一个待处理的消息，没有消息时处理协程退出
+func (rc *ReactorConn) next() (*Message, bool, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if len(rc.pending) == 0 {
+		rc.pending = nil
+		rc.running = false
+		return nil, false, false
+	}
+	msg := rc.pending[0]
+	rc.pending[0] = nil
+	rc.pending = rc.pending[1:]
+	resume := rc.paused && len(rc.pending) <= EpollPendingLimit/2
+	if resume {
+		rc.paused = false
+	}
+	return msg, resume, true
+}
+
+// handle 按顺序处理连接的消息，关闭在之前入队的消息处理完之后执行
+func (r *Reactor) handle(rc *ReactorConn) {
+	client := rc.client
+	for {
+		msg, resume, ok := rc.next()
+		if !ok {
+			return
+		}
+		if resume {
+			r.setReading(rc, true)
+		}
+		if msg == nil {
+			client.HandleClientClosed()
+			continue
+		}
+		if atomic.LoadInt32(&client.closed) > 0 {
+			continue
+		}
+
+		t1 := time.Now().Unix()
+		client.HandleMessage(msg)
+		t2 := time.Now().Unix()
+		if t2-t1 > 2 {
+			log.Infof("client:%d handle message is too slow:%d %d", client.uid, t1, t2)
+		}
+
+		tc := atomic.LoadInt32(&client.timeoutCount)
+		if tc > 0 {
+			log.Infof("close client:%d, write blocked", client.uid)
+			if r.remove(rc) {
+				client.HandleClientClosed()
+			}
+		}
+	}
+}
+
+func (r *Reactor) find(fd int) *ReactorConn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.conns[fd]
+}
+
+// read 水平触发，每次事件只读一次，未读完的数据下次epoll_wait会再次返回
+func (r *Reactor) read(rc *ReactorConn, buff []byte) {
+	n, err := syscall.Read(rc.fd, buff)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if n <= 0 {
+		log.Infof("client:%d read err:%v", rc.client.uid, err)
+		r.close(rc)
+		return
+	}
+
+	atomic.StoreInt64(&rc.lastRead, time.Now().Unix())
+
+	data := buff[:n]
+	if len(rc.buff) > 0 {
+		rc.buff = append(rc.buff, data...)
+		data = rc.buff
+	}
+	for {
+		msg, l, err := DecodeClientMessage(data)
+		if err != nil {
+			log.Infof("client:%d invalid message:%s", rc.client.uid, err)
+			r.close(rc)
+			return
+		}
+		if msg == nil {
+			break
+		}
+		r.dispatch(rc, msg)
+		data = data[l:]
+	}
+
+	if len(data) > 0 {
+		rc.buff = append(rc.buff[:0], data...)
+	} else {
+		rc.buff = nil
+	}
+}
+
+func (r *Reactor) Run() {
+	events := make([]syscall.EpollEvent, 128)
+	buff := make([]byte, EpollReadBufferSize)
+	for {
+		n, err := syscall.EpollWait(r.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Fatal("epoll wait err:", err)
+		}
+		for i := 0; i < n; i++ {
+			rc := r.find(int(events[i].Fd))
+			if rc == nil {
+				continue
+			}
+			r.read(rc, buff)
+		}
+	}
+}
+
+// CheckIdle 关闭长时间没有数据的连接，代替tcp模式下的读超时
+func (r *Reactor) CheckIdle() {
+	for {
+		time.Sleep(60 * time.Second)
+
+		now := time.Now().Unix()
+		timeout := int64(config.ClientTimeout("tcp") / time.Second)
+		idles := make([]*ReactorConn, 0)
+		r.mutex.Lock()
+		for _, rc := range r.conns {
+			if now-atomic.LoadInt64(&rc.lastRead) > timeout {
+				idles = append(idles, rc)
+			}
+		}
+		r.mutex.Unlock()
+
+		for _, rc := range idles {
+			log.Infof("client:%d socket read timeout", rc.client.uid)
+			r.close(rc)
+		}
+	}
+}
+
+func (r *Reactor) handleClient(conn net.Conn) {
+	log.Infoln("handle new epoll connection")
+	r.AddConn(conn.(*net.TCPConn))
+}
+
+// ListenEpoll epoll模式监听普通tcp连接
+func ListenEpoll(port int) {
+	r, err := NewReactor(config.epollWorkers)
+	if err != nil {
+		log.Error("create epoll err:", err)
+		Listen(handleClient, port)
+		return
+	}
+	go r.Run()
+	go r.CheckIdle()
+	Listen(r.handleClient, port)
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import log "github.com/golang/glog"
+
+// ListenEpoll 非linux平台不支持epoll，使用每个连接独立读写协程的方式
+func ListenEpoll(port int) {
+	log.Warning("epoll mode is only supported on linux")
+	Listen(handleClient, port)
+}
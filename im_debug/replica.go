@@ -0,0 +1,137 @@
+package main
+
+import "time"
+import "strings"
+import "sync/atomic"
+import "im_research/hashring"
+import log "github.com/golang/glog"
+
+//ims列表中每一项的格式为 master[@权重][,slave...]
+//写消息只发送到master, master不可用时读请求发送到延迟满足要求的slave
+
+const StorageCheckTimeout = 2 * time.Second
+
+// SplitReplicas 去掉slave之后的ims列表，和每个master对应的slave
+func SplitReplicas(pool []string) ([]string, map[string][]string) {
+	masters := make([]string, 0, len(pool))
+	replicas := make(map[string][]string)
+	for _, s := range pool {
+		addrs := strings.Split(s, ",")
+		masters = append(masters, addrs[0])
+		if len(addrs) > 1 {
+			node, err := hashring.ParseNode(addrs[0])
+			if err != nil {
+				continue
+			}
+			replicas[node.Name] = addrs[1:]
+		}
+	}
+	return masters, replicas
+}
+
+// normalizePool 和GetStorageNodes返回的格式一致，用于比较成员是否变化
+func normalizePool(pool []string) []string {
+	nodes := make([]string, 0, len(pool))
+	for _, s := range pool {
+		addrs := strings.Split(s, ",")
+		node, err := hashring.ParseNode(addrs[0])
+		if err == nil {
+			addrs[0] = node.String()
+		}
+		nodes = append(nodes, strings.Join(addrs, ","))
+	}
+	return nodes
+}
+
+func (sc *StorageRPCClient) IsHealthy() bool {
+	return atomic.LoadInt32(&sc.healthy) > 0
+}
+
+func (sc *StorageRPCClient) Staleness() int64 {
+	return atomic.LoadInt64(&sc.staleness)
+}
+
+func (sc *StorageRPCClient) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	old := atomic.SwapInt32(&sc.healthy, v)
+	if old != v {
+		log.Infof("storage:%s healthy:%t", sc.addr, healthy)
+	}
+}
+
+// CheckHealth 通过GetReplicaStatus检查ims是否可用以及slave的延迟
+func (sc *StorageRPCClient) CheckHealth() {
+	resp, err := sc.dc.CallTimeout("GetReplicaStatus", nil, StorageCheckTimeout)
+	if err != nil {
+		sc.setHealthy(false)
+		return
+	}
+	status := resp.(*ReplicaStatus)
+	atomic.StoreInt64(&sc.staleness, status.Staleness)
+	sc.setHealthy(true)
+}
+
+// ReadClients 读请求依次尝试的ims
+// master可用时优先读master, 否则读延迟不超过storage_max_staleness的slave, 最后仍然尝试master
+func (sc *StorageRPCClient) ReadClients() []*StorageRPCClient {
+	clients := make([]*StorageRPCClient, 0, len(sc.replicas)+1)
+	healthy := sc.IsHealthy()
+	if healthy {
+		clients = append(clients, sc)
+	}
+	for _, r := range sc.replicas {
+		if r.IsHealthy() && r.Staleness() <= int64(config.storageMaxStaleness/time.Second) {
+			clients = append(clients, r)
+		}
+	}
+	if !healthy {
+		clients = append(clients, sc)
+	}
+	return clients
+}
+
+// CallStorageRead 调用用户所属ims的读接口，失败时尝试下一个ims
+func CallStorageRead(dc *StorageRPCClient, method string, req interface{}) (interface{}, error) {
+	var err error
+	for _, c := range dc.ReadClients() {
+		var resp interface{}
+		resp, err = c.Call(method, req)
+		if err == nil {
+			if c != dc {
+				atomic.AddInt64(&serverSummary.storageReadFailoverCount, 1)
+			}
+			return resp, nil
+		}
+		log.Warningf("storage:%s %s err:%s", c.addr, method, err)
+		if err != ErrBreakerOpen {
+			c.setHealthy(false)
+		}
+	}
+	return nil, err
+}
+
+func getStorageClients() []*StorageRPCClient {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	clients := make([]*StorageRPCClient, 0, len(rpcClients))
+	for _, c := range rpcClients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// StorageHealthService 定时检查所有ims和slave
+func StorageHealthService() {
+	for {
+		for _, c := range getStorageClients() {
+			c.CheckHealth()
+			for _, r := range c.replicas {
+				r.CheckHealth()
+			}
+		}
+		time.Sleep(config.storageCheckInterval)
+	}
+}
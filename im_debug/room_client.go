@@ -11,8 +11,7 @@ type RoomClient struct {
 
 func (client *RoomClient) Logout() {
 	if client.roomId > 0 {
-		channel := GetRoomChannel(client.roomId)
-		channel.UnsubscribeRoom(client.appid, client.roomId)
+		UnsubscribeRoom(client.appid, client.roomId)
 		route := appRoute.FindOrAddRoute(client.appid)
 		route.RemoveRoomClient(client.roomId, client.Client())
 	}
@@ -42,16 +41,14 @@ func (client *RoomClient) HandleEnterRoom(room *Room) {
 	}
 	route := appRoute.FindOrAddRoute(client.appid)
 	if client.roomId > 0 {
-		channel := GetRoomChannel(client.roomId)
-		channel.UnsubscribeRoom(client.appid, client.roomId)
+		UnsubscribeRoom(client.appid, client.roomId)
 
 		route.RemoveRoomClient(client.roomId, client.Client())
 	}
 
 	client.roomId = roomId
 	route.AddRoomClient(client.roomId, client.Client())
-	channel := GetRoomChannel(client.roomId)
-	channel.SubscribeRoom(client.appid, client.roomId)
+	SubscribeRoom(client.appid, client.roomId)
 }
 
 func (client *RoomClient) Client() *Client {
@@ -76,8 +73,7 @@ func (client *RoomClient) HandleLeaveRoom(room *Room) {
 
 	route := appRoute.FindOrAddRoute(client.appid)
 	route.RemoveRoomClient(client.roomId, client.Client())
-	channel := GetRoomChannel(client.roomId)
-	channel.UnsubscribeRoom(client.appid, client.roomId)
+	UnsubscribeRoom(client.appid, client.roomId)
 	client.roomId = 0
 }
 
@@ -112,5 +108,5 @@ func (client *RoomClient) HandleRoomIM(roomIm *RoomMessage, seq int) {
 	channel := GetRoomChannel(client.roomId)
 	channel.PublishRoom(amsg)
 
-	client.wt <- &Message{cmd: MsgAck, body: &MessageACK{int32(seq)}}
+	client.EnqueueMessage(&Message{cmd: MsgAck, body: &MessageACK{seq: int32(seq)}})
 }
@@ -81,6 +81,33 @@ func (route *Route) RemoveClient(client *Client) bool {
 	return false
 }
 
+// ReplaceClient 恢复会话时用新的连接替换宽限期内占位的连接
+func (route *Route) ReplaceClient(old *Client, client *Client) {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+	if set, ok := route.clients[old.uid]; ok {
+		set.Remove(old)
+	}
+	set, ok := route.clients[client.uid]
+	if !ok {
+		set = NewClientSet()
+		route.clients[client.uid] = set
+	}
+	set.Add(client)
+
+	if old.roomId > 0 {
+		if set, ok := route.roomClients[old.roomId]; ok {
+			set.Remove(old)
+		}
+		set, ok := route.roomClients[old.roomId]
+		if !ok {
+			set = NewClientSet()
+			route.roomClients[old.roomId] = set
+		}
+		set.Add(client)
+	}
+}
+
 func (route *Route) FindClientSet(uid int64) ClientSet {
 	route.mutex.Lock()
 	defer route.mutex.Unlock()
@@ -104,6 +131,19 @@ func (route *Route) IsOnline(uid int64) bool {
 	return false
 }
 
+func (route *Route) GetClients() []*Client {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(route.clients))
+	for _, set := range route.clients {
+		for c := range set {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
 func (route *Route) GetUserIDs() IntSet {
 	return NewIntSet()
 }
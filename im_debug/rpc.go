@@ -17,10 +17,10 @@ func SendIMMessage(im *IMMessage, appid int64) {
 		return
 	}
 
-	//保存到发送者自己的消息队列
+	//保存到发送者自己的消息队列，失败时仍然通知接收者
 	msgid2, err := SaveMessage(appid, im.sender, 0, m)
 	if err != nil {
-		return
+		log.Errorf("save peer message:%d %d to sender err:%s", im.sender, im.receiver, err)
 	}
 
 	//推送外部通知
@@ -31,8 +31,10 @@ func SendIMMessage(im *IMMessage, appid int64) {
 	SendAppMessage(appid, im.receiver, notify)
 
 	//发送同步的通知消息
-	notify = &Message{cmd: MsgSyncNotify, body: &SyncKey{syncKey: msgid2}}
-	SendAppMessage(appid, im.sender, notify)
+	if err == nil {
+		notify = &Message{cmd: MsgSyncNotify, body: &SyncKey{syncKey: msgid2}}
+		SendAppMessage(appid, im.sender, notify)
+	}
 
 	atomic.AddInt64(&serverSummary.inMessageCount, 1)
 }
@@ -140,22 +142,19 @@ func LoadLatestMessage(w http.ResponseWriter, req *http.Request) {
 	}
 	log.Infof("appid:%d uid:%d limit:%d", appid, uid, limit)
 
-	rpc := GetStorageRPCClient(uid)
-
 	s := &HistoryRequest{
 		Appid: appid,
 		Uid:   uid,
 		Limit: int32(limit),
 	}
 
-	resp, err := rpc.Call("GetLatestMessage", s)
+	hm, err := GetLatestMessage(s)
 	if err != nil {
 		log.Warning("get latest message err:", err)
 		WriteHttpError(400, "internal error", w)
 		return
 	}
 
-	hm := resp.([]*HistoryMessage)
 	messages := make([]*EMessage, 0)
 	for _, msg := range hm {
 		m := &Message{cmd: int(msg.Cmd), version: DefaultVersion}
@@ -239,8 +238,6 @@ func LoadHistoryMessage(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	rpc := GetStorageRPCClient(uid)
-
 	s := &SyncHistory{
 		Appid:     appid,
 		Uid:       uid,
@@ -248,13 +245,12 @@ func LoadHistoryMessage(w http.ResponseWriter, req *http.Request) {
 		LastMsgid: msgid,
 	}
 
-	resp, err := rpc.Call("SyncMessage", s)
+	ph, err := SyncMessage(s)
 	if err != nil {
 		log.Warning("sync message err:", err)
 		return
 	}
 
-	ph := resp.(*PeerHistoryMessage)
 	messages := ph.Messages
 
 	if len(messages) > 0 {
@@ -329,7 +325,7 @@ func GetOfflineCount(w http.ResponseWriter, req *http.Request) {
 	lastId := GetSyncKey(appid, uid)
 	syncKey := SyncHistory{Appid: appid, Uid: uid, LastMsgid: lastId}
 
-	dc := GetStorageRPCClient(uid)
+	dc := GetStorageClient(uid)
 
 	resp, err := dc.Call("GetNewCount", syncKey)
 
@@ -454,7 +450,7 @@ func SendRoomMessage(w http.ResponseWriter, req *http.Request) {
 	route := appRoute.FindOrAddRoute(appid)
 	clients := route.FindRoomClientSet(roomId)
 	for c, _ := range clients {
-		c.wt <- msg
+		c.EnqueueNonBlockMessage(msg)
 	}
 
 	amsg := &AppMessage{appid: appid, receiver: roomId, message: msg}
@@ -0,0 +1,263 @@
+package main
+
+import "sync"
+import "time"
+import "crypto/rand"
+import "encoding/hex"
+import "container/list"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+// Session 断开连接之后保留的会话，宽限期内重连时恢复订阅、聊天室和未发送的消息
+// 保留期间不取消imr上的订阅，断开的连接留在路由中占位，发给它的消息缓存在会话中，过期之后才取消
+type Session struct {
+	token string
+
+	appid          int64
+	uid            int64
+	deviceId       int64
+	device         string
+	platformId     int8
+	forbidden      int32
+	notificationOn bool
+	online         bool
+	syncCount      int64
+	roomId         int64
+
+	client   *Client    //断开的连接，宽限期内在路由中占位
+	messages *list.List //断开时未发送的消息和宽限期内收到的消息，由client.mutex保护
+}
+
+// holdMessage 会话保留期间缓存发给已断开连接的消息，超过队列长度时丢弃最早的消息
+func (client *Connection) holdMessage(msg *Message) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	session := client.held
+	if session == nil {
+		return false
+	}
+	session.messages.PushBack(NewQueuedMessage(msg))
+	for session.messages.Len() > config.messageQueueLimit {
+		session.messages.Remove(session.messages.Front())
+		atomic.AddInt64(&serverSummary.droppedMessageCount, 1)
+	}
+	return true
+}
+
+// release 断开的连接不再缓存消息，返回缓存的消息
+func (session *Session) release() *list.List {
+	client := session.client
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.held = nil
+	return session.messages
+}
+
+// Expire 会话过期，从路由中移除占位的连接并取消imr上的订阅
+func (session *Session) Expire() {
+	log.Infof("session expired appid:%d uid:%d device id:%d", session.appid, session.uid, session.deviceId)
+	session.release()
+	session.client.RemoveClient()
+	if session.roomId > 0 {
+		UnsubscribeRoom(session.appid, session.roomId)
+	}
+	UnsubscribeUser(session.appid, session.uid, session.online)
+}
+
+type SessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	store := new(SessionStore)
+	store.sessions = make(map[string]*Session)
+	return store
+}
+
+// Add 保存会话，超过宽限期没有恢复时过期
+func (store *SessionStore) Add(session *Session, grace time.Duration) {
+	store.mutex.Lock()
+	store.sessions[session.token] = session
+	store.mutex.Unlock()
+
+	time.AfterFunc(grace, func() {
+		if store.remove(session) {
+			session.Expire()
+		}
+	})
+}
+
+// Take 取出会话，同一个会话只能被恢复或者过期一次
+func (store *SessionStore) Take(token string) *Session {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	session, ok := store.sessions[token]
+	if !ok {
+		return nil
+	}
+	delete(store.sessions, token)
+	return session
+}
+
+func (store *SessionStore) remove(session *Session) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if s, ok := store.sessions[session.token]; ok && s == session {
+		delete(store.sessions, session.token)
+		return true
+	}
+	return false
+}
+
+func (store *SessionStore) Count() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return len(store.sessions)
+}
+
+// ExpireAll 所有会话立即过期
+func (store *SessionStore) ExpireAll() {
+	store.mutex.Lock()
+	sessions := store.sessions
+	store.sessions = make(map[string]*Session)
+	store.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.Expire()
+	}
+}
+
+func NewSessionToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Error("rand read err:", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// SaveSession 连接断开时保留会话，返回false时需要正常清理订阅
+func (client *Client) SaveSession() bool {
+	if len(client.session) == 0 || config.sessionGracePeriod <= 0 {
+		return false
+	}
+	//被踢出的慢连接需要重新同步
+	if atomic.LoadInt32(&client.evicted) > 0 {
+		return false
+	}
+	if IsDraining() {
+		return false
+	}
+
+	session := &Session{
+		token:          client.session,
+		appid:          client.appid,
+		uid:            client.uid,
+		deviceId:       client.deviceId,
+		device:         client.device,
+		platformId:     client.platformId,
+		forbidden:      atomic.LoadInt32(&client.forbidden),
+		notificationOn: client.notificationOn,
+		online:         client.online,
+		syncCount:      client.syncCount,
+		roomId:         client.roomId,
+		client:         client,
+	}
+
+	client.mutex.Lock()
+	session.messages = client.messages
+	client.messages = list.New()
+	client.pendingBytes = 0
+	client.held = session
+	client.mutex.Unlock()
+
+	log.Infof("save session appid:%d uid:%d device id:%d room id:%d messages:%d",
+		session.appid, session.uid, session.deviceId, session.roomId, session.messages.Len())
+	sessionStore.Add(session, config.sessionGracePeriod)
+	return true
+}
+
+// ResumeSession 使用会话token恢复之前的连接，不需要重新订阅和全量同步
+// 会话token只用于找到保留的会话，仍然需要校验access token并且用户必须一致
+func (client *Client) ResumeSession(login *AuthToken, version int) bool {
+	appid, uid, fb, on, err := client.AuthToken(login.accessToken)
+	session := sessionStore.Take(login.session)
+	if session == nil {
+		log.Infof("session:%s non exists", login.session)
+		return false
+	}
+	if err != nil || uid == 0 || appid != session.appid || uid != session.uid {
+		log.Warningf("session appid:%d uid:%d access token mismatch:%d %d err:%v",
+			session.appid, session.uid, appid, uid, err)
+		session.Expire()
+		return false
+	}
+	if session.device != login.device || session.platformId != login.platformId {
+		log.Warningf("session device:%s %d mismatch:%s %d", session.device, session.platformId,
+			login.device, login.platformId)
+		session.Expire()
+		return false
+	}
+
+	client.appid = session.appid
+	client.uid = session.uid
+	client.deviceId = session.deviceId
+	client.device = session.device
+	client.platformId = session.platformId
+	//断开期间禁言和通知状态可能发生变化，以access token中的为准
+	client.forbidden = int32(fb)
+	client.notificationOn = on
+	client.online = session.online
+	client.syncCount = session.syncCount
+	client.version = version
+	client.tm = time.Now()
+	client.session = NewSessionToken()
+	client.roomId = session.roomId
+
+	log.Infof("resume session appid:%d uid:%d device id:%d room id:%d",
+		client.appid, client.uid, client.deviceId, session.roomId)
+
+	interval := config.HeartbeatInterval(client.conn.Name(), client.platformId)
+	status := &AuthStatus{
+		status:    0,
+		ip:        client.publicIp,
+		heartbeat: int32(interval / time.Second),
+		session:   client.session,
+		resumed:   1,
+	}
+
+	//持有断开连接的锁，替换路由之前发给它的消息都在会话中
+	//AuthStatus和缓存的消息按顺序放入新连接的待发送队列之后再替换路由，新的消息只会排在它们之后
+	old := session.client
+	old.mutex.Lock()
+	messages := session.messages
+	count := messages.Len()
+	client.mutex.Lock()
+	client.messages.PushBack(NewQueuedMessage(&Message{cmd: MsgAuthStatus, version: version, body: status}))
+	for e := messages.Front(); e != nil; e = e.Next() {
+		qm := e.Value.(*QueuedMessage)
+		client.messages.PushBack(qm)
+		client.pendingBytes += int64(qm.size)
+	}
+	client.mutex.Unlock()
+
+	//imr上的订阅在会话保留期间没有取消，替换路由中占位的连接之后新的消息直接发给新的连接
+	route := appRoute.FindOrAddRoute(client.appid)
+	route.ReplaceClient(old, client)
+	old.held = nil
+	old.mutex.Unlock()
+
+	select {
+	case client.lwt <- 1:
+	default:
+	}
+	client.wake()
+	log.Infof("session appid:%d uid:%d resumed messages:%d", client.appid, client.uid, count)
+
+	client.StartHeartbeat(interval)
+	atomic.AddInt64(&serverSummary.nclients, 1)
+	atomic.AddInt64(&serverSummary.resumedCount, 1)
+	return true
+}
@@ -52,6 +52,13 @@ type HistoryRequest struct {
 	Limit int32
 }
 
+// ReplicaStatus 和ims_debug/storage_rpc.go中的定义保持一致
+type ReplicaStatus struct {
+	IsSlave   bool
+	Staleness int64 //数据最多落后master的秒数
+	NextMsgid int64
+}
+
 func SyncMessageInterface(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 	return nil
 }
@@ -76,3 +83,7 @@ func GetNewCountInterface(addr string, s *SyncHistory) (int64, error) {
 func GetLatestMessageInterface(addr string, r *HistoryRequest) []*HistoryMessage {
 	return nil
 }
+
+func GetReplicaStatusInterface() *ReplicaStatus {
+	return nil
+}
@@ -61,7 +61,7 @@ func SubscribeRedis() bool {
 	}
 
 	psc := redis.PubSubConn{Conn: c}
-	_ = psc.Subscribe("speak_forbidden")
+	_ = psc.Subscribe("speak_forbidden", ClusterKey)
 
 	for {
 		switch v := psc.Receive().(type) {
@@ -69,6 +69,8 @@ func SubscribeRedis() bool {
 			log.Infof("%s: message: %s\n", v.Channel, v.Data)
 			if v.Channel == "speak_forbidden" {
 				HandleForbidden(string(v.Data))
+			} else if v.Channel == ClusterKey {
+				go ReloadCluster()
 			}
 		case redis.Subscription:
 			log.Infof("%s: %s %d\n", v.Channel, v.Kind, v.Count)
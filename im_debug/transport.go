@@ -0,0 +1,82 @@
+package main
+
+import "net"
+import "time"
+
+// Transport 客户端连接的传输层抽象，新增传输方式(包括测试用的内存传输)只需实现该接口
+type Transport interface {
+	ReadMessage() *Message
+	WriteMessage(msg *Message) error
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Name() string
+}
+
+// BatchTransport 支持将多个消息合并为一次写操作的传输层
+// websocket和engine.io每个消息对应一帧，不能合并
+type BatchTransport interface {
+	WriteMessages(msgs []*Message) error
+}
+
+// TCPTransport 普通tcp连接
+type TCPTransport struct {
+	conn    net.Conn
+	timeout time.Duration //读超时
+}
+
+func NewTCPTransport(conn net.Conn) *TCPTransport {
+	return &TCPTransport{conn: conn, timeout: config.ClientTimeout("tcp")}
+}
+
+func (t *TCPTransport) ReadMessage() *Message {
+	_ = t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+	return ReceiveClientMessage(t.conn)
+}
+
+func (t *TCPTransport) WriteMessage(msg *Message) error {
+	_ = t.conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
+	return SendMessage(t.conn, msg)
+}
+
+func (t *TCPTransport) WriteMessages(msgs []*Message) error {
+	_ = t.conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
+	return SendMessages(t.conn, msgs)
+}
+
+// CloseRead 只关闭读方向，读协程(或者epoll)按照正常的流程清理连接
+func (t *TCPTransport) CloseRead() error {
+	if conn, ok := t.conn.(*net.TCPConn); ok {
+		return conn.CloseRead()
+	}
+	return t.conn.Close()
+}
+
+func (t *TCPTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *TCPTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *TCPTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *TCPTransport) Name() string {
+	return "tcp"
+}
+
+// TLSTransport ssl连接，读写方式与tcp相同
+type TLSTransport struct {
+	TCPTransport
+}
+
+func NewTLSTransport(conn net.Conn) *TLSTransport {
+	return &TLSTransport{TCPTransport{conn: conn, timeout: config.ClientTimeout("tls")}}
+}
+
+func (t *TLSTransport) Name() string {
+	return "tls"
+}
@@ -3,7 +3,9 @@ package main
 import (
 	log "github.com/golang/glog"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"time"
 )
 
 func CheckOrigin(r *http.Request) bool {
@@ -24,21 +26,27 @@ func serveWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	conn.SetReadLimit(64 * 1024)
+	log.Info("new websocket connection, remote address:", conn.RemoteAddr())
+	log.Infof("new conn: %v", conn)
+	transport := NewWebsocketTransport(conn)
+	client := NewClient(transport)
 	conn.SetPongHandler(func(string) error {
 		log.Info("browser websocket pong...")
-		return nil
+		client.HandlePong()
+		//只回复pong的连接也不会读超时
+		return conn.SetReadDeadline(time.Now().Add(transport.timeout))
 	})
-	log.Info("new websocket connection, remote address:", conn.RemoteAddr())
-	log.Info("new conn: %s", conn)
-	client := NewClient(conn)
 	client.Run()
 }
 
 func StartWebsocketServer(address string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/oasis/ws", serveWebsocket)
-	err := http.ListenAndServe(address, mux)
-	if err != nil {
+	server := &http.Server{Addr: address, Handler: mux}
+	//drain时关闭监听，已经升级的websocket连接不受影响
+	AddListener(server)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("listen err:%s", err)
 	}
 }
@@ -57,16 +65,56 @@ func ReadWebsocketMessage(conn *websocket.Conn) *Message {
 	}
 }
 
-func SendWebsocketMessage(conn *websocket.Conn, msg *Message) {
+func SendWebsocketMessage(conn *websocket.Conn, msg *Message) error {
 	w, err := conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		log.Info("get next writer fail")
-		return
+		return err
 	}
 	err = SendMessage(w, msg)
 	if err != nil {
 		log.Info("send message fail")
-		return
+		return err
 	}
-	_ = w.Close()
+	return w.Close()
+}
+
+// WebsocketTransport websocket连接
+type WebsocketTransport struct {
+	conn    *websocket.Conn
+	timeout time.Duration //读超时
+}
+
+func NewWebsocketTransport(conn *websocket.Conn) *WebsocketTransport {
+	return &WebsocketTransport{conn: conn, timeout: config.ClientTimeout("websocket")}
+}
+
+func (t *WebsocketTransport) ReadMessage() *Message {
+	_ = t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+	return ReadWebsocketMessage(t.conn)
+}
+
+// Ping 发送websocket ping控制帧，浏览器会自动回复pong
+func (t *WebsocketTransport) Ping() error {
+	return t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+}
+
+func (t *WebsocketTransport) WriteMessage(msg *Message) error {
+	return SendWebsocketMessage(t.conn, msg)
+}
+
+func (t *WebsocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *WebsocketTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *WebsocketTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *WebsocketTransport) Name() string {
+	return "websocket"
 }
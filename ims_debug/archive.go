@@ -0,0 +1,562 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "sync"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "net/url"
+import "net/http"
+import "compress/gzip"
+import "encoding/binary"
+import "path/filepath"
+import "im_research/ims_debug/lru"
+import log "github.com/golang/glog"
+
+//冷数据归档: 超过archive_days天的已经写满的block压缩之后移动到archive_root目录, 默认storage_root/archive
+//archive_root可以在另外的磁盘上, 归档的临时文件写在archive_root中, 恢复的临时文件写在storage_root中
+//归档文件按照ArchiveChunkSize分段, 每一段是独立的gzip, 读取时只解压需要的段
+//归档的是block文件原来的内容(包括压缩的block的remap表), 读取时和block文件相同
+//master和slave各自归档, 不影响同步和校验
+
+//归档文件头 magic|version|ArchiveMagic|分段大小|分段数量|原来的大小|归档时间
+//之后是每一段在归档文件中的位置, 每一项8字节
+const ArchiveMagic = 0x41524348
+
+const ArchiveDir = "archive"
+
+//归档文件的分段大小
+const ArchiveChunkSize = 256 * 1024
+
+//缓存的解压之后的分段数量
+const ArchiveCacheSize = 256
+
+//检查是否需要归档的间隔
+const ArchiveInterval = time.Hour
+
+type ArchiveReport struct {
+	Block  int   `json:"block"`
+	Before int64 `json:"before"` //归档之前文件的大小
+	After  int64 `json:"after"`  //归档文件的大小
+	Chunks int   `json:"chunks"`
+	Time   int64 `json:"time"`
+}
+
+// BlockFile 读取block文件的内容, block文件或者归档文件
+type BlockFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+//解压之后的分段, 归档时间区分同一个block不同的归档文件
+type chunkKey struct {
+	blockNo int
+	created int64
+	chunk   int
+}
+
+var chunkMutex sync.Mutex
+var chunkCache = lru.New(ArchiveCacheSize)
+
+//同一时间只有一个归档
+var archiveMutex sync.Mutex
+
+// archivedFile 读取归档文件, 按照归档之前的位置读取
+type archivedFile struct {
+	file      *os.File
+	blockNo   int
+	created   int64
+	size      int64   //归档之前的大小
+	chunkSize int64   //分段大小
+	offsets   []int64 //每一段在归档文件中的位置, 最后一项是归档文件的大小
+	pos       int64
+}
+
+func (storage *StorageFile) archivePath(blockNo int) string {
+	return filepath.Join(storage.archiveRoot, fmt.Sprintf("message_%d", blockNo))
+}
+
+// openArchivedFile 打开归档文件, 不存在时返回nil
+func (storage *StorageFile) openArchivedFile(blockNo int) BlockFile {
+	path := storage.archivePath(blockNo)
+	a, err := openArchive(path, blockNo)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Infof("message block file:%s nonexist", path)
+			return nil
+		}
+		log.Fatalf("open archive:%s err:%s", path, err)
+	}
+	return a
+}
+
+func openArchive(path string, blockNo int) (*archivedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	a, err := readArchiveHeader(file, blockNo)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func readArchiveHeader(file *os.File, blockNo int) (*archivedFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	var magic, version, flag, chunkSize, count, size int32
+	var created int64
+	buffer := bytes.NewBuffer(header)
+	binary.Read(buffer, binary.BigEndian, &magic)
+	binary.Read(buffer, binary.BigEndian, &version)
+	binary.Read(buffer, binary.BigEndian, &flag)
+	binary.Read(buffer, binary.BigEndian, &chunkSize)
+	binary.Read(buffer, binary.BigEndian, &count)
+	binary.Read(buffer, binary.BigEndian, &size)
+	binary.Read(buffer, binary.BigEndian, &created)
+	if magic != Magic || flag != ArchiveMagic {
+		return nil, fmt.Errorf("invalid archive header magic:%x flag:%x", magic, flag)
+	}
+	if chunkSize <= 0 || size < 0 || int64(count) != (int64(size)+int64(chunkSize)-1)/int64(chunkSize) ||
+		HeaderSize+int64(count)*8 > info.Size() {
+		return nil, fmt.Errorf("invalid archive chunk size:%d count:%d size:%d", chunkSize, count, size)
+	}
+
+	table := make([]byte, int(count)*8)
+	if _, err := file.ReadAt(table, HeaderSize); err != nil {
+		return nil, err
+	}
+	a := &archivedFile{
+		file:      file,
+		blockNo:   blockNo,
+		created:   created,
+		size:      int64(size),
+		chunkSize: int64(chunkSize),
+		offsets:   make([]int64, count+1),
+	}
+	buffer = bytes.NewBuffer(table)
+	for i := 0; i < int(count); i++ {
+		binary.Read(buffer, binary.BigEndian, &a.offsets[i])
+	}
+	a.offsets[count] = info.Size()
+	return a, nil
+}
+
+// chunk 解压之后的第i段
+func (a *archivedFile) chunk(i int) ([]byte, error) {
+	key := chunkKey{a.blockNo, a.created, i}
+	chunkMutex.Lock()
+	v, ok := chunkCache.Get(key)
+	chunkMutex.Unlock()
+	if ok {
+		return v.([]byte), nil
+	}
+
+	start, end := a.offsets[i], a.offsets[i+1]
+	if start < HeaderSize || end < start {
+		return nil, fmt.Errorf("archive block:%d invalid chunk:%d", a.blockNo, i)
+	}
+	compressed := make([]byte, end-start)
+	if _, err := a.file.ReadAt(compressed, start); err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	expect := a.size - int64(i)*a.chunkSize
+	if expect > a.chunkSize {
+		expect = a.chunkSize
+	}
+	if int64(len(data)) != expect {
+		return nil, fmt.Errorf("archive block:%d chunk:%d size:%d expect:%d", a.blockNo, i, len(data), expect)
+	}
+
+	chunkMutex.Lock()
+	chunkCache.Add(key, data)
+	chunkMutex.Unlock()
+	return data, nil
+}
+
+func (a *archivedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < a.size {
+		i := int(off / a.chunkSize)
+		data, err := a.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], data[off-int64(i)*a.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (a *archivedFile) Read(p []byte) (int, error) {
+	if a.pos >= a.size {
+		return 0, io.EOF
+	}
+	n, err := a.ReadAt(p, a.pos)
+	a.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (a *archivedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += a.pos
+	case io.SeekEnd:
+		offset += a.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	a.pos = offset
+	return offset, nil
+}
+
+func (a *archivedFile) Close() error {
+	return a.file.Close()
+}
+
+// blockFileSize block文件的大小, 归档文件返回归档之前的大小
+func blockFileSize(file BlockFile) (int64, error) {
+	if a, ok := file.(*archivedFile); ok {
+		return a.size, nil
+	}
+	info, err := file.(*os.File).Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// statBlock block文件的信息, block已经归档时返回归档文件的信息
+func (storage *StorageFile) statBlock(blockNo int) (os.FileInfo, error) {
+	info, err := os.Stat(fmt.Sprintf("%s/message_%d", storage.root, blockNo))
+	if os.IsNotExist(err) {
+		return os.Stat(storage.archivePath(blockNo))
+	}
+	return info, err
+}
+
+func (storage *StorageFile) IsArchived(blockNo int) bool {
+	if _, err := os.Stat(fmt.Sprintf("%s/message_%d", storage.root, blockNo)); !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Stat(storage.archivePath(blockNo))
+	return err == nil
+}
+
+func (storage *StorageFile) removeArchive(blockNo int) error {
+	err := os.Remove(storage.archivePath(blockNo))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cleanArchive 删除没有完成的归档, block文件和归档文件同时存在时以block文件为准
+func (storage *StorageFile) cleanArchive() {
+	files, _ := filepath.Glob(filepath.Join(storage.archiveRoot, "message_*"))
+	for _, f := range files {
+		base := filepath.Base(f)
+		b, err := strconv.Atoi(base[8:])
+		if err != nil {
+			log.Infof("remove incomplete archive:%s", f)
+			_ = os.Remove(f)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(storage.root, base)); err == nil {
+			log.Infof("remove incomplete archive:%s", f)
+			_ = os.Remove(f)
+			continue
+		}
+		a, err := openArchive(f, b)
+		if err != nil {
+			log.Fatalf("archive:%s err:%s", f, err)
+		}
+		a.Close()
+	}
+}
+
+// writeArchive 把block文件压缩到归档目录的临时文件, 返回文件路径
+func (storage *StorageFile) writeArchive(blockNo int, created int64) (string, int, error) {
+	src, err := os.Open(fmt.Sprintf("%s/message_%d", storage.root, blockNo))
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	size := info.Size()
+	if size < HeaderSize {
+		return "", 0, fmt.Errorf("block:%d header isn't complete", blockNo)
+	}
+	header := make([]byte, HeaderSize)
+	if _, err = src.ReadAt(header, 0); err != nil {
+		return "", 0, err
+	}
+	count := int((size + ArchiveChunkSize - 1) / ArchiveChunkSize)
+
+	if err = os.MkdirAll(storage.archiveRoot, 0755); err != nil {
+		return "", 0, err
+	}
+	tmp := filepath.Join(storage.archiveRoot, fmt.Sprintf("message_%d.tmp", blockNo))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	buffer := new(bytes.Buffer)
+	buffer.Write(header[:8])
+	binary.Write(buffer, binary.BigEndian, int32(ArchiveMagic))
+	binary.Write(buffer, binary.BigEndian, int32(ArchiveChunkSize))
+	binary.Write(buffer, binary.BigEndian, int32(count))
+	binary.Write(buffer, binary.BigEndian, int32(size))
+	binary.Write(buffer, binary.BigEndian, created)
+	//分段的位置在压缩之后写入
+	buffer.Write(make([]byte, count*8))
+	if _, err = file.Write(buffer.Bytes()); err != nil {
+		return "", 0, err
+	}
+
+	offsets := make([]int64, count)
+	offset := int64(buffer.Len())
+	chunk := make([]byte, ArchiveChunkSize)
+	for i := 0; i < count; i++ {
+		n, err := io.ReadFull(src, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", 0, err
+		}
+		buffer.Reset()
+		w := gzip.NewWriter(buffer)
+		if _, err = w.Write(chunk[:n]); err != nil {
+			return "", 0, err
+		}
+		if err = w.Close(); err != nil {
+			return "", 0, err
+		}
+		if _, err = file.Write(buffer.Bytes()); err != nil {
+			return "", 0, err
+		}
+		offsets[i] = offset
+		offset += int64(buffer.Len())
+	}
+
+	buffer.Reset()
+	for _, o := range offsets {
+		binary.Write(buffer, binary.BigEndian, o)
+	}
+	if _, err = file.WriteAt(buffer.Bytes(), HeaderSize); err != nil {
+		return "", 0, err
+	}
+	if err = file.Sync(); err != nil {
+		return "", 0, err
+	}
+	return tmp, count, nil
+}
+
+// ArchiveBlock 归档已经写满的block
+func (storage *Storage) ArchiveBlock(blockNo int) (*ArchiveReport, error) {
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+	if blockNo >= current || blockNo < storage.getBlockNo(storage.Watermark()) {
+		return nil, fmt.Errorf("block:%d isn't sealed", blockNo)
+	}
+
+	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && storage.IsArchived(blockNo) {
+		return nil, fmt.Errorf("block:%d is archived", blockNo)
+	} else if err != nil {
+		return nil, err
+	}
+
+	created := time.Now().UnixNano()
+	tmp, count, err := storage.writeArchive(blockNo, created)
+	if err != nil {
+		return nil, err
+	}
+	//保留原来的修改时间, 保留策略按照修改时间删除block
+	_ = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	info2, err := os.Stat(path)
+	if err != nil || info2.Size() != info.Size() || !info2.ModTime().Equal(info.ModTime()) {
+		//归档期间block被删除, 压缩或者被修复
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("block:%d changed during archiving", blockNo)
+	}
+	dst := storage.archivePath(blockNo)
+	if err = os.Rename(tmp, dst); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(path); err != nil {
+		return nil, err
+	}
+	storage.files.Remove(blockNo)
+	storage.resetBlockVersions()
+
+	report := &ArchiveReport{Block: blockNo, Before: info.Size(), Chunks: count, Time: time.Now().Unix()}
+	if info2, err = os.Stat(dst); err == nil {
+		report.After = info2.Size()
+	}
+	return report, nil
+}
+
+// restoreBlock 把归档的block恢复到原来的位置, 需要持有storage.mutex
+func (storage *StorageFile) restoreBlock(blockNo int) error {
+	if !storage.IsArchived(blockNo) {
+		return nil
+	}
+	a, err := openArchive(storage.archivePath(blockNo), blockNo)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	info, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	//和block文件在同一个文件系统中, 之后rename到原来的位置
+	dir := filepath.Join(storage.root, CompactDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("message_%d", blockNo))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, a)
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+
+	if err = os.Rename(tmp, fmt.Sprintf("%s/message_%d", storage.root, blockNo)); err != nil {
+		return err
+	}
+	storage.files.Remove(blockNo)
+	storage.resetBlockVersions()
+	log.Infof("restore archived block:%d", blockNo)
+	return storage.removeArchive(blockNo)
+}
+
+// RunArchive 归档修改时间超过days天的已经写满的block
+func (storage *Storage) RunArchive(days int) []*ArchiveReport {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+
+	deadline := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	reports := make([]*ArchiveReport, 0)
+	for _, b := range storage.listBlocks() {
+		if b >= current {
+			break
+		}
+		if b < storage.getBlockNo(storage.Watermark()) || storage.IsArchived(b) {
+			continue
+		}
+		//加密的消息不能压缩
+		if storage.BlockVersion(b) == FVersion3 {
+			continue
+		}
+		info, err := storage.statBlock(b)
+		if err != nil || !info.ModTime().Before(deadline) {
+			continue
+		}
+		//和压缩不同时进行
+		compactMutex.Lock()
+		report, err := storage.ArchiveBlock(b)
+		compactMutex.Unlock()
+		if err != nil {
+			log.Warningf("archive block:%d err:%s", b, err)
+			continue
+		}
+		log.Infof("archive block:%d size:%d->%d chunks:%d", b, report.Before, report.After, report.Chunks)
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// ArchiveLoop master和slave各自归档
+func ArchiveLoop() {
+	ticker := time.NewTicker(ArchiveInterval)
+	for range ticker.C {
+		if config.archiveDays > 0 {
+			storage.RunArchive(config.archiveDays)
+		}
+	}
+}
+
+// Archive 立即归档 /archive?block=, 没有参数时按照archive_days归档
+func Archive(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	reports := make([]*ArchiveReport, 0)
+	if len(m.Get("block")) > 0 {
+		blockNo, err := strconv.Atoi(m.Get("block"))
+		if err != nil {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		archiveMutex.Lock()
+		compactMutex.Lock()
+		report, err := storage.ArchiveBlock(blockNo)
+		compactMutex.Unlock()
+		archiveMutex.Unlock()
+		if err != nil {
+			WriteHttpError(400, err.Error(), rw)
+			return
+		}
+		reports = append(reports, report)
+	} else if config.archiveDays > 0 {
+		reports = storage.RunArchive(config.archiveDays)
+	}
+	obj := make(map[string]interface{})
+	obj["blocks"] = reports
+	WriteHttpObj(obj, rw)
+}
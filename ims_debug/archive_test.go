@@ -0,0 +1,88 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "bytes"
+import "testing"
+import "math/rand"
+import "encoding/binary"
+import "path/filepath"
+
+//归档之后按照原来的位置读取, 跨越分段和文件末尾的读取和原来的内容相同
+func TestArchiveReadAt(t *testing.T) {
+	root := t.TempDir()
+	storage := &StorageFile{root: root, archiveRoot: filepath.Join(root, ArchiveDir)}
+
+	size := ArchiveChunkSize*5/2 + 123
+	block := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(block[HeaderSize:])
+	//一部分重复的内容, 压缩之后的分段大小不同
+	copy(block[ArchiveChunkSize:], bytes.Repeat([]byte("im"), ArchiveChunkSize/4))
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.BigEndian, int32(Magic))
+	binary.Write(header, binary.BigEndian, int32(FVersion2))
+	copy(block, header.Bytes())
+	if err := os.WriteFile(fmt.Sprintf("%s/message_0", root), block, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, count, err := storage.writeArchive(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("chunk count:%d expect:3", count)
+	}
+	a, err := openArchive(tmp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.size != int64(size) {
+		t.Fatalf("archive size:%d expect:%d", a.size, size)
+	}
+
+	tests := []struct {
+		off int64
+		n   int
+	}{
+		{0, HeaderSize},
+		{100, 1000},
+		{ArchiveChunkSize - 10, 20}, //跨越一个分段
+		{ArchiveChunkSize - 10, ArchiveChunkSize + 20}, //跨越两个分段
+		{0, size},               //整个文件
+		{int64(size) - 50, 50},  //文件末尾
+		{int64(size) - 50, 100}, //超过文件末尾
+		{int64(size), 10},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.n)
+		n, err := a.ReadAt(p, test.off)
+		expect := int64(test.n)
+		if test.off+expect > int64(size) {
+			expect = int64(size) - test.off
+		}
+		if int64(n) != expect {
+			t.Errorf("off:%d len:%d read:%d expect:%d", test.off, test.n, n, expect)
+			continue
+		}
+		if n < test.n && err != io.EOF {
+			t.Errorf("off:%d len:%d short read err:%v", test.off, test.n, err)
+		} else if n == test.n && err != nil {
+			t.Errorf("off:%d len:%d err:%s", test.off, test.n, err)
+		}
+		if !bytes.Equal(p[:n], block[test.off:test.off+int64(n)]) {
+			t.Errorf("off:%d len:%d content mismatch", test.off, test.n)
+		}
+	}
+
+	//顺序读取
+	if _, err := a.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(a)
+	if err != nil || !bytes.Equal(data, block) {
+		t.Errorf("read all len:%d err:%v", len(data), err)
+	}
+}
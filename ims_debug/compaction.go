@@ -0,0 +1,697 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "net/url"
+import "net/http"
+import "encoding/binary"
+import "path/filepath"
+import log "github.com/golang/glog"
+
+//block压缩: 重写已经写满的block, 去掉被删除用户的消息
+//msgid是消息在block中的位置, 压缩之后的文件头之后是remap表, 记录保留的消息原来的位置和压缩之后的位置
+//LoadMessage通过remap表找到消息, 不在remap表中的消息已经被删除
+//按照原来的位置顺序读取时(同步, 快照, 校验, 重建索引)删除的消息用MSG_HOLE填充, master和slave得到相同的内容
+//master和slave根据同样的tombstone各自压缩
+
+const MSG_HOLE = 248 //内部文件存储使用, 填充压缩时删除的消息
+
+//压缩之后的文件头 magic|version|CompactMagic|压缩之前的大小|remap数量|压缩时最大的tombstone
+const CompactMagic = 0x434d5054
+
+//remap表每一项 压缩之前的位置|压缩之后的位置 = 8字节
+const RemapEntrySize = 8
+
+//填充记录消息体的最大长度
+const MaxHoleSize = 16 * 1024
+
+//压缩的临时文件目录
+const CompactDir = "compact"
+
+//检查是否需要压缩的间隔
+const CompactionInterval = time.Hour
+
+func init() {
+	messageCreators[MSG_HOLE] = func() IMessage { return new(Hole) }
+	messageDescriptions[MSG_HOLE] = "MSG_HOLE"
+}
+
+//region Hole
+
+type Hole struct {
+	size int
+}
+
+func (hole *Hole) ToData() []byte {
+	return make([]byte, hole.size)
+}
+
+func (hole *Hole) FromData(buff []byte) bool {
+	hole.size = len(buff)
+	return true
+}
+
+//endregion
+
+type BlockRemap struct {
+	size     int64   //压缩之前block的大小
+	mark     int64   //压缩时最大的tombstone, 之后没有新的tombstone时不需要再压缩
+	fileSize int64   //压缩之后文件的大小
+	offsets  []int32 //保留的消息压缩之前的位置, 递增
+	targets  []int32 //压缩之后的位置
+}
+
+// lookup 压缩之前的位置对应的压缩之后的位置
+func (remap *BlockRemap) lookup(offset int) (int, bool) {
+	i := sort.Search(len(remap.offsets), func(i int) bool { return int(remap.offsets[i]) >= offset })
+	if i < len(remap.offsets) && int(remap.offsets[i]) == offset {
+		return int(remap.targets[i]), true
+	}
+	return 0, false
+}
+
+func (remap *BlockRemap) recordSize(i int) int64 {
+	if i+1 < len(remap.targets) {
+		return int64(remap.targets[i+1] - remap.targets[i])
+	}
+	return remap.fileSize - int64(remap.targets[i])
+}
+
+// readBlockRemap 没有压缩的block返回nil
+func readBlockRemap(file BlockFile) (*BlockRemap, error) {
+	fileSize, err := blockFileSize(file)
+	if err != nil {
+		return nil, err
+	}
+	if fileSize < HeaderSize {
+		return nil, nil
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	var flag, size, count int32
+	var mark int64
+	buffer := bytes.NewBuffer(header[8:])
+	binary.Read(buffer, binary.BigEndian, &flag)
+	binary.Read(buffer, binary.BigEndian, &size)
+	binary.Read(buffer, binary.BigEndian, &count)
+	binary.Read(buffer, binary.BigEndian, &mark)
+	if flag != CompactMagic {
+		return nil, nil
+	}
+	if count < 0 || HeaderSize+int64(count)*RemapEntrySize > fileSize {
+		return nil, fmt.Errorf("invalid remap count:%d", count)
+	}
+	table := make([]byte, int(count)*RemapEntrySize)
+	if _, err := file.ReadAt(table, HeaderSize); err != nil {
+		return nil, err
+	}
+	remap := &BlockRemap{
+		size:     int64(size),
+		mark:     mark,
+		fileSize: fileSize,
+		offsets:  make([]int32, count),
+		targets:  make([]int32, count),
+	}
+	buffer = bytes.NewBuffer(table)
+	for i := 0; i < int(count); i++ {
+		binary.Read(buffer, binary.BigEndian, &remap.offsets[i])
+		binary.Read(buffer, binary.BigEndian, &remap.targets[i])
+	}
+	return remap, nil
+}
+
+// blockRemap 压缩的block的remap表, 需要持有storage.mutex
+func (storage *StorageFile) blockRemap(blockNo int) *BlockRemap {
+	if remap, ok := storage.remaps[blockNo]; ok {
+		return remap
+	}
+	file := storage.getFile(blockNo)
+	if file == nil {
+		return nil
+	}
+	remap, err := readBlockRemap(file)
+	if err != nil {
+		log.Errorf("block:%d read remap err:%s", blockNo, err)
+		return nil
+	}
+	storage.remaps[blockNo] = remap
+	return remap
+}
+
+// IsRemoved msgid的消息在压缩时被删除
+func (storage *StorageFile) IsRemoved(msgid int64) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	remap := storage.blockRemap(storage.getBlockNo(msgid))
+	if remap == nil {
+		return false
+	}
+	offset := storage.getBlockOffset(msgid)
+	_, ok := remap.lookup(offset)
+	return !ok && int64(offset) < remap.size
+}
+
+func holeOverhead(version int) int64 {
+	return int64(len(EncodeRecord(&Message{cmd: MSG_HOLE, body: &Hole{}}, version)))
+}
+
+// holeSize 长度为gap的空白中第一个填充记录的大小, 剩下的空白可以继续填充
+func holeSize(gap int64, overhead int64) int64 {
+	n := overhead + MaxHoleSize
+	if gap <= n {
+		return gap
+	}
+	if gap-n < overhead {
+		n -= overhead
+	}
+	return n
+}
+
+// BlockReader 按照压缩之前的位置读取block
+type BlockReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// compactedReader 读取压缩的block, 删除的消息用MSG_HOLE填充
+type compactedReader struct {
+	file     BlockFile
+	remap    *BlockRemap
+	version  int
+	overhead int64
+	pos      int64
+
+	hole   []byte //最近一次生成的填充记录
+	holeAt int64
+}
+
+func (r *compactedReader) Read(p []byte) (int, error) {
+	remap := r.remap
+	if r.pos >= remap.size {
+		return 0, io.EOF
+	}
+	if r.pos < HeaderSize {
+		header := new(bytes.Buffer)
+		binary.Write(header, binary.BigEndian, int32(Magic))
+		binary.Write(header, binary.BigEndian, int32(r.version))
+		header.Write(make([]byte, HeaderSize-8))
+		n := copy(p, header.Bytes()[r.pos:])
+		r.pos += int64(n)
+		return n, nil
+	}
+	if r.hole != nil && r.pos >= r.holeAt && r.pos < r.holeAt+int64(len(r.hole)) {
+		n := copy(p, r.hole[r.pos-r.holeAt:])
+		r.pos += int64(n)
+		return n, nil
+	}
+
+	//最后一条开始位置不大于pos的消息
+	i := sort.Search(len(remap.offsets), func(i int) bool { return int64(remap.offsets[i]) > r.pos }) - 1
+	gapStart := int64(HeaderSize)
+	if i >= 0 {
+		start := int64(remap.offsets[i])
+		size := remap.recordSize(i)
+		if r.pos < start+size {
+			n := start + size - r.pos
+			if int64(len(p)) < n {
+				n = int64(len(p))
+			}
+			m, err := r.file.ReadAt(p[:n], int64(remap.targets[i])+r.pos-start)
+			r.pos += int64(m)
+			if err == io.EOF && int64(m) == n {
+				err = nil
+			}
+			return m, err
+		}
+		gapStart = start + size
+	}
+	gapEnd := remap.size
+	if i+1 < len(remap.offsets) {
+		gapEnd = int64(remap.offsets[i+1])
+	}
+
+	s := gapStart
+	if r.hole != nil && r.holeAt >= gapStart && r.holeAt <= r.pos {
+		s = r.holeAt
+	}
+	for {
+		n := holeSize(gapEnd-s, r.overhead)
+		if r.pos < s+n {
+			if n >= r.overhead {
+				r.hole = EncodeRecord(&Message{cmd: MSG_HOLE, body: &Hole{int(n - r.overhead)}}, r.version)
+			} else {
+				r.hole = make([]byte, n)
+			}
+			r.holeAt = s
+			break
+		}
+		s += n
+	}
+	n := copy(p, r.hole[r.pos-r.holeAt:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *compactedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.remap.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *compactedReader) Close() error {
+	return r.file.Close()
+}
+
+// openBlockReader 按照压缩之前的位置读取block, 从文件开头读取, 文件不存在时返回nil
+func (storage *StorageFile) openBlockReader(blockNo int) BlockReader {
+	file := storage.openReadFile(blockNo)
+	if file == nil {
+		return nil
+	}
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		log.Fatalf("block:%d seek err:%s", blockNo, err)
+	}
+	remap, err := readBlockRemap(file)
+	if err != nil {
+		log.Fatalf("block:%d read remap err:%s", blockNo, err)
+	}
+	if remap == nil {
+		return file
+	}
+	version := storage.BlockVersion(blockNo)
+	return &compactedReader{file: file, remap: remap, version: version, overhead: holeOverhead(version)}
+}
+
+type CompactionReport struct {
+	Block   int   `json:"block"`
+	Records int   `json:"records"` //压缩之前的消息数量
+	Removed int   `json:"removed"` //删除的消息数量
+	Before  int64 `json:"before"`  //压缩之前文件的大小
+	After   int64 `json:"after"`   //压缩之后文件的大小, 没有压缩时为0
+	Time    int64 `json:"time"`
+}
+
+type compactRecord struct {
+	offset int64
+	size   int64
+	dead   bool
+	hole   bool
+}
+
+//离线消息记录指向的消息
+type compactRef struct {
+	appid int64
+	dead  bool //被删除用户的离线消息链
+}
+
+//同一时间只有一个压缩
+var compactMutex sync.Mutex
+
+//已经检查过的block和检查时最大的tombstone, 重启之后从压缩的block头部的mark恢复
+var compactChecked = make(map[int]int64)
+
+// offlineTarget 离线消息记录的接收者和指向的消息
+func offlineTarget(msg *Message) (UserID, int64, bool) {
+	if msg.cmd == MSG_OFFLINE {
+		off := msg.body.(*OfflineMessage)
+		return UserID{off.appid, off.receiver}, off.msgid, true
+	} else if msg.cmd == MSG_OFFLINE_V2 {
+		off := msg.body.(*OfflineMessage2)
+		return UserID{off.appid, off.receiver}, off.msgid, true
+	}
+	return UserID{}, 0, false
+}
+
+// scanDeadRecords 找到block中被删除的消息, 返回block中的消息和block是否已经压缩过
+// 消息的离线消息记录在同一个block或者下一个block中, 所有的离线消息记录都属于被删除的用户或者发送者被删除时消息被删除
+func (storage *Storage) scanDeadRecords(blockNo int, tombstones map[UserID]int64) ([]*compactRecord, bool, error) {
+	erased := func(id UserID, msgid int64) bool {
+		t, ok := tombstones[id]
+		return ok && msgid < t
+	}
+
+	reader := storage.openBlockReader(blockNo)
+	if reader == nil {
+		return nil, false, fmt.Errorf("block:%d doesn't exist", blockNo)
+	}
+	defer reader.Close()
+	_, compacted := reader.(*compactedReader)
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = reader.Seek(HeaderSize, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	version := storage.BlockVersion(blockNo)
+	key := storage.BlockKey(blockNo)
+	records := make([]*compactRecord, 0)
+	contents := make(map[int64]*Message)
+	refs := make(map[int64][]compactRef)
+	r := &countReader{r: reader}
+	for pos := int64(HeaderSize); pos < size; pos = HeaderSize + r.n {
+		msg := storage.ReadMessage(r, version, key)
+		if msg == nil {
+			return nil, false, fmt.Errorf("block:%d read message:%d err", blockNo, storage.getMsgid(blockNo, int(pos)))
+		}
+		msgid := storage.getMsgid(blockNo, int(pos))
+		record := &compactRecord{offset: pos, size: HeaderSize + r.n - pos}
+		if msg.cmd == MSG_HOLE {
+			record.dead = true
+			record.hole = true
+		} else if receiver, target, ok := offlineTarget(msg); ok {
+			record.dead = erased(receiver, msgid)
+			refs[target] = append(refs[target], compactRef{receiver.appid, record.dead})
+		} else if _, ok := messageSender(msg, 0); ok {
+			contents[msgid] = msg
+		}
+		records = append(records, record)
+	}
+
+	//block结尾的消息的离线消息记录在下一个block
+	if next := storage.openBlockReader(blockNo + 1); next != nil {
+		defer next.Close()
+		if _, err = next.Seek(HeaderSize, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		nextVersion := storage.BlockVersion(blockNo + 1)
+		nextKey := storage.BlockKey(blockNo + 1)
+		nr := &countReader{r: next}
+		for {
+			msgid := storage.getMsgid(blockNo+1, int(HeaderSize+nr.n))
+			msg := storage.ReadMessage(nr, nextVersion, nextKey)
+			if msg == nil {
+				break
+			}
+			receiver, target, ok := offlineTarget(msg)
+			if !ok {
+				continue
+			}
+			//之后的离线消息记录指向下一个block中的消息
+			if storage.getBlockNo(target) != blockNo {
+				break
+			}
+			refs[target] = append(refs[target], compactRef{receiver.appid, erased(receiver, msgid)})
+		}
+	}
+
+	for _, record := range records {
+		msgid := storage.getMsgid(blockNo, int(record.offset))
+		msg, ok := contents[msgid]
+		if !ok || len(refs[msgid]) == 0 {
+			continue
+		}
+		dead := true
+		for _, ref := range refs[msgid] {
+			sender, _ := messageSender(msg, ref.appid)
+			if !ref.dead && !erased(sender, msgid) {
+				dead = false
+				break
+			}
+		}
+		record.dead = dead
+	}
+	return records, compacted, nil
+}
+
+// CompactBlock 重写已经写满的block, 去掉被删除的消息
+func (storage *Storage) CompactBlock(blockNo int) (*CompactionReport, error) {
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+	if blockNo >= current || blockNo < storage.getBlockNo(storage.Watermark()) {
+		return nil, fmt.Errorf("block:%d isn't sealed", blockNo)
+	}
+
+	tombstones := storage.Tombstones()
+	var mark int64
+	for _, t := range tombstones {
+		if t > mark {
+			mark = t
+		}
+	}
+
+	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
+	info, err := storage.statBlock(blockNo)
+	if err != nil {
+		return nil, err
+	}
+	records, compacted, err := storage.scanDeadRecords(blockNo, tombstones)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CompactionReport{Block: blockNo, Before: info.Size(), Time: time.Now().Unix()}
+	live := make([]*compactRecord, 0, len(records))
+	for _, record := range records {
+		//已经压缩的block中的填充记录不在文件中
+		if record.hole && compacted {
+			continue
+		}
+		report.Records++
+		if record.dead {
+			report.Removed++
+		} else {
+			live = append(live, record)
+		}
+	}
+	if report.Removed == 0 {
+		return report, nil
+	}
+
+	tmp, err := storage.writeCompactedBlock(blockNo, live, mark)
+	if err != nil {
+		return nil, err
+	}
+	//保留原来的修改时间, 保留策略按照修改时间删除block
+	_ = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	info2, err := storage.statBlock(blockNo)
+	if err != nil || info2.Size() != info.Size() || !info2.ModTime().Equal(info.ModTime()) {
+		//压缩期间block被删除, 归档或者被修复
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("block:%d changed during compaction", blockNo)
+	}
+	//归档的block压缩之后写回原来的位置, 之后重新归档
+	if err = os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if err = storage.removeArchive(blockNo); err != nil {
+		return nil, err
+	}
+	storage.files.Remove(blockNo)
+	storage.resetBlockVersions()
+	invalidateChecksum(blockNo)
+
+	if info2, err = os.Stat(path); err == nil {
+		report.After = info2.Size()
+	}
+	return report, nil
+}
+
+// writeCompactedBlock 写入临时文件, 返回文件路径
+func (storage *Storage) writeCompactedBlock(blockNo int, live []*compactRecord, mark int64) (string, error) {
+	reader := storage.openBlockReader(blockNo)
+	if reader == nil {
+		return "", fmt.Errorf("block:%d doesn't exist", blockNo)
+	}
+	defer reader.Close()
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(storage.root, CompactDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("message_%d", blockNo))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int32(Magic))
+	binary.Write(buffer, binary.BigEndian, int32(storage.BlockVersion(blockNo)))
+	binary.Write(buffer, binary.BigEndian, int32(CompactMagic))
+	binary.Write(buffer, binary.BigEndian, int32(size))
+	binary.Write(buffer, binary.BigEndian, int32(len(live)))
+	binary.Write(buffer, binary.BigEndian, mark)
+	buffer.Write(make([]byte, HeaderSize-buffer.Len()))
+
+	target := int64(HeaderSize + len(live)*RemapEntrySize)
+	for _, record := range live {
+		binary.Write(buffer, binary.BigEndian, int32(record.offset))
+		binary.Write(buffer, binary.BigEndian, int32(target))
+		target += record.size
+	}
+	if _, err = file.Write(buffer.Bytes()); err != nil {
+		return "", err
+	}
+
+	for _, record := range live {
+		data := make([]byte, record.size)
+		if _, err = reader.Seek(record.offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		if _, err = file.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err = file.Sync(); err != nil {
+		return "", err
+	}
+	return tmp, nil
+}
+
+// expandBlock 把压缩的block恢复成原来的格式, 删除的消息用MSG_HOLE填充, 需要持有storage.mutex
+func (storage *Storage) expandBlock(blockNo int) error {
+	reader := storage.openBlockReader(blockNo)
+	if reader == nil {
+		return nil
+	}
+	defer reader.Close()
+	if _, ok := reader.(*compactedReader); !ok {
+		return nil
+	}
+
+	dir := filepath.Join(storage.root, CompactDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("message_%d", blockNo))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fmt.Sprintf("%s/message_%d", storage.root, blockNo)); err != nil {
+		return err
+	}
+	if err = storage.removeArchive(blockNo); err != nil {
+		return err
+	}
+	storage.files.Remove(blockNo)
+	storage.resetBlockVersions()
+	invalidateChecksum(blockNo)
+	return nil
+}
+
+// RunCompaction 压缩在上一次检查之后有新的tombstone的block, force时检查所有已经写满的block
+func (storage *Storage) RunCompaction(force bool) []*CompactionReport {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+
+	var mark int64
+	for _, t := range storage.Tombstones() {
+		if t > mark {
+			mark = t
+		}
+	}
+
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+
+	reports := make([]*CompactionReport, 0)
+	for _, b := range storage.listBlocks() {
+		if b >= current {
+			break
+		}
+		//tombstone之前的消息才会被删除
+		if mark <= storage.getMsgid(b, HeaderSize) && !force {
+			continue
+		}
+		if _, ok := compactChecked[b]; !ok {
+			storage.mutex.Lock()
+			remap := storage.blockRemap(b)
+			storage.mutex.Unlock()
+			if remap != nil {
+				compactChecked[b] = remap.mark
+			}
+		}
+		if checked, ok := compactChecked[b]; ok && checked >= mark && !force {
+			continue
+		}
+		report, err := storage.CompactBlock(b)
+		if err != nil {
+			log.Warningf("compact block:%d err:%s", b, err)
+			continue
+		}
+		compactChecked[b] = mark
+		if report.Removed > 0 {
+			log.Infof("compact block:%d records:%d removed:%d size:%d->%d",
+				b, report.Records, report.Removed, report.Before, report.After)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// CompactionLoop master和slave各自压缩
+func CompactionLoop() {
+	ticker := time.NewTicker(CompactionInterval)
+	for range ticker.C {
+		storage.RunCompaction(false)
+	}
+}
+
+// Compact 立即压缩 /compact?block=, 没有参数时检查所有已经写满的block
+func Compact(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	reports := make([]*CompactionReport, 0)
+	if len(m.Get("block")) > 0 {
+		blockNo, err := strconv.Atoi(m.Get("block"))
+		if err != nil {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		compactMutex.Lock()
+		report, err := storage.CompactBlock(blockNo)
+		compactMutex.Unlock()
+		if err != nil {
+			WriteHttpError(400, err.Error(), rw)
+			return
+		}
+		reports = append(reports, report)
+	} else {
+		reports = storage.RunCompaction(true)
+	}
+	obj := make(map[string]interface{})
+	obj["blocks"] = reports
+	WriteHttpObj(obj, rw)
+}
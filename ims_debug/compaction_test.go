@@ -0,0 +1,116 @@
+package main
+
+import "os"
+import "io"
+import "bytes"
+import "strings"
+import "testing"
+import "encoding/binary"
+import "path/filepath"
+
+//压缩之后按照原来的位置读取, 保留的消息位置不变, 删除的消息被MSG_HOLE填满
+func TestCompactedReader(t *testing.T) {
+	for _, version := range []int{FVersion1, FVersion2} {
+		tests := []struct {
+			content string
+			dead    bool
+		}{
+			{"first", false},
+			{"deleted", true},
+			{"second", false},
+			{strings.Repeat("x", 3*MaxHoleSize+100), true}, //大于MaxHoleSize的空白
+			{"deleted", true},
+			{"third", false},
+			{strings.Repeat("y", MaxHoleSize), true},
+			{"fourth", false},
+			{"tail", true},
+		}
+
+		header := new(bytes.Buffer)
+		binary.Write(header, binary.BigEndian, int32(Magic))
+		binary.Write(header, binary.BigEndian, int32(version))
+		header.Write(make([]byte, HeaderSize-header.Len()))
+		block := header.Bytes()
+
+		//相邻的删除的消息合并成一个空白
+		live := make([]*compactRecord, 0)
+		gaps := make([]*compactRecord, 0)
+		for i, test := range tests {
+			data := EncodeRecord(testMessage(i, test.content), version)
+			record := &compactRecord{offset: int64(len(block)), size: int64(len(data)), dead: test.dead}
+			if !test.dead {
+				live = append(live, record)
+			} else if n := len(gaps); n > 0 && gaps[n-1].offset+gaps[n-1].size == record.offset {
+				gaps[n-1].size += record.size
+			} else {
+				gaps = append(gaps, record)
+			}
+			block = append(block, data...)
+		}
+
+		buffer := new(bytes.Buffer)
+		binary.Write(buffer, binary.BigEndian, int32(Magic))
+		binary.Write(buffer, binary.BigEndian, int32(version))
+		binary.Write(buffer, binary.BigEndian, int32(CompactMagic))
+		binary.Write(buffer, binary.BigEndian, int32(len(block)))
+		binary.Write(buffer, binary.BigEndian, int32(len(live)))
+		binary.Write(buffer, binary.BigEndian, int64(0))
+		buffer.Write(make([]byte, HeaderSize-buffer.Len()))
+		target := int64(HeaderSize + len(live)*RemapEntrySize)
+		for _, record := range live {
+			binary.Write(buffer, binary.BigEndian, int32(record.offset))
+			binary.Write(buffer, binary.BigEndian, int32(target))
+			target += record.size
+		}
+		for _, record := range live {
+			buffer.Write(block[record.offset : record.offset+record.size])
+		}
+
+		path := filepath.Join(t.TempDir(), "message_0")
+		if err := os.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remap, err := readBlockRemap(file)
+		if err != nil || remap == nil {
+			t.Fatalf("version:%x read remap:%v err:%v", version, remap, err)
+		}
+		reader := &compactedReader{file: file, remap: remap, version: version, overhead: holeOverhead(version)}
+		expanded, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("version:%x read err:%s", version, err)
+		}
+
+		if len(expanded) != len(block) {
+			t.Fatalf("version:%x size:%d expect:%d", version, len(expanded), len(block))
+		}
+		if !bytes.Equal(expanded[:HeaderSize], block[:HeaderSize]) {
+			t.Errorf("version:%x header mismatch", version)
+		}
+		for _, record := range live {
+			end := record.offset + record.size
+			if !bytes.Equal(expanded[record.offset:end], block[record.offset:end]) {
+				t.Errorf("version:%x record:%d mismatch", version, record.offset)
+			}
+		}
+
+		storage := new(StorageFile)
+		for _, record := range gaps {
+			r := bytes.NewReader(expanded[record.offset : record.offset+record.size])
+			for r.Len() > 0 {
+				m := storage.ReadMessage(r, version, nil)
+				if m == nil || m.cmd != MSG_HOLE {
+					t.Errorf("version:%x gap:%d invalid hole at:%d", version, record.offset, record.size-int64(r.Len()))
+					break
+				}
+				if size := len(m.body.(*Hole).ToData()); size > MaxHoleSize {
+					t.Errorf("version:%x gap:%d hole size:%d", version, record.offset, size)
+				}
+			}
+		}
+	}
+}
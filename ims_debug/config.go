@@ -1,6 +1,8 @@
 package main
 
+import "time"
 import "strconv"
+import "path/filepath"
 import "log"
 import "github.com/richmonkey/cfg"
 
@@ -19,6 +21,19 @@ type StorageConfig struct {
 	isPushSystem  bool
 	groupLimit    int //普通群离线消息的数量限制
 	limit         int //离线消息的数量限制
+
+	syncAckCount   int           //半同步复制需要等待的slave数量, 0表示异步复制
+	syncAckTimeout time.Duration //等待slave的超时时间
+
+	syncSnapshot bool //新的slave通过快照同步
+
+	retentionDays int   //删除超过天数的block, 0表示不删除
+	retentionSize int64 //block文件的总大小超过之后删除最早的block(字节), 0表示不限制
+
+	archiveDays int    //归档超过天数的block, 0表示不归档
+	archiveRoot string //归档文件的目录, 默认storage_root/archive
+
+	masterKeyFile string //master key文件, 为空时不加密
 }
 
 func getInt(appCfg map[string]string, key string) int64 {
@@ -77,5 +92,16 @@ func readStorageCfg(cfgPath string) *StorageConfig {
 	config.isPushSystem = getOptInt(appCfg, "is_push_system", 0) == 1
 	config.limit = int(getOptInt(appCfg, "limit", OfflineDefaultLimit))
 	config.groupLimit = int(getOptInt(appCfg, "group_limit", GroupOfflineDefaultLimit))
+	config.syncAckCount = int(getOptInt(appCfg, "sync_ack_count", 0))
+	config.syncAckTimeout = time.Duration(getOptInt(appCfg, "sync_ack_timeout", 1000)) * time.Millisecond
+	config.syncSnapshot = getOptInt(appCfg, "sync_snapshot", 1) == 1
+	config.retentionDays = int(getOptInt(appCfg, "retention_days", 0))
+	config.retentionSize = getOptInt(appCfg, "retention_size", 0) * 1024 * 1024
+	config.archiveDays = int(getOptInt(appCfg, "archive_days", 0))
+	config.archiveRoot = getOptString(appCfg, "archive_root")
+	if len(config.archiveRoot) == 0 {
+		config.archiveRoot = filepath.Join(config.storageRoot, ArchiveDir)
+	}
+	config.masterKeyFile = getOptString(appCfg, "master_key_file")
 	return config
 }
@@ -0,0 +1,527 @@
+package main
+
+import "io"
+import "os"
+import "fmt"
+import "sync"
+import "bufio"
+import "bytes"
+import "errors"
+import "strings"
+import "strconv"
+import "crypto/aes"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/cipher"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/binary"
+import log "github.com/golang/glog"
+
+//静态加密: 3.0格式的block中的消息用block的data key通过AES-GCM加密, 保存为MSG_SEALED
+//block的第一条消息是MSG_BLOCK_KEY, 保存用master key加密之后的data key, 和其它消息一样同步给slave
+//nonce由消息的位置和内容计算, master和slave写入相同的内容, 快照, 校验和修复不需要解密
+//MSG_HOLE和MSG_BLOCK_KEY不加密, 加密之后消息的长度只和原来的长度有关
+//master key从本地的key文件读取, 每一行是 id 十六进制的32字节key, 最大的id用于新的block
+//新建block时重新读取key文件, key文件中增加新的master key之后新的block使用新的key, 旧的key需要保留
+//peer_index和tombstone_index每次写入时使用新的data key加密
+//master和slave需要相同的key文件, 开启之前需要先升级所有的slave
+
+const MSG_SEALED = 246    //内部文件存储使用, 加密之后的消息
+const MSG_BLOCK_KEY = 247 //内部文件存储使用, block的data key
+
+const NonceSize = 12
+const TagSize = 16
+const DataKeySize = 32
+
+//加密之后的消息增加的长度 MSG_SEALED的消息头|nonce|tag
+const SealOverhead = MsgHeaderSize + NonceSize + TagSize
+
+//加密的索引文件 IndexMagic|master key id|data key的长度|data key, 之后每一段 密文的长度|nonce|密文
+const IndexMagic = 0x494d4958
+
+func init() {
+	messageCreators[MSG_SEALED] = func() IMessage { return new(Sealed) }
+	messageCreators[MSG_BLOCK_KEY] = func() IMessage { return new(BlockKeyRecord) }
+
+	messageDescriptions[MSG_SEALED] = "MSG_SEALED"
+	messageDescriptions[MSG_BLOCK_KEY] = "MSG_BLOCK_KEY"
+}
+
+//region Sealed
+
+//nonce|密文
+type Sealed struct {
+	data []byte
+}
+
+func (sealed *Sealed) ToData() []byte {
+	return sealed.data
+}
+
+func (sealed *Sealed) FromData(buff []byte) bool {
+	if len(buff) < NonceSize+TagSize {
+		return false
+	}
+	sealed.data = buff
+	return true
+}
+
+//endregion
+
+//region BlockKeyRecord
+
+type BlockKeyRecord struct {
+	keyId   int32  //master key的id
+	wrapped []byte //nonce|加密之后的data key
+}
+
+func (record *BlockKeyRecord) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, record.keyId)
+	buffer.Write(record.wrapped)
+	return buffer.Bytes()
+}
+
+func (record *BlockKeyRecord) FromData(buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &record.keyId)
+	record.wrapped = buff[4:]
+	return true
+}
+
+//endregion
+
+// isSealedCmd 3.0格式的block中需要加密的消息
+func isSealedCmd(cmd int) bool {
+	return cmd != MSG_HOLE && cmd != MSG_BLOCK_KEY
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSum(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Keyring 本地key文件中的master key
+type Keyring struct {
+	keys   map[int32][]byte
+	active int32 //最大的id, 加密新的data key
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warningf("master key file:%s is accessible by other users, mode:%s", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{keys: make(map[int32][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d invalid line", path, i+1)
+		}
+		id, err := strconv.ParseInt(fields[0], 10, 32)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%s:%d invalid key id", path, i+1)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d key must be 32 bytes in hex", path, i+1)
+		}
+		if _, ok := k.keys[int32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d duplicate key id:%d", path, i+1, id)
+		}
+		k.keys[int32(id)] = key
+		if int32(id) > k.active {
+			k.active = int32(id)
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("%s doesn't contain any key", path)
+	}
+	return k, nil
+}
+
+// wrap 用当前的master key加密data key
+func (k *Keyring) wrap(dataKey []byte, aad string) (int32, []byte, error) {
+	aead, err := newGCM(k.keys[k.active])
+	if err != nil {
+		return 0, nil, err
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return 0, nil, err
+	}
+	return k.active, aead.Seal(nonce, nonce, dataKey, []byte(aad)), nil
+}
+
+func (k *Keyring) unwrap(keyId int32, wrapped []byte, aad string) ([]byte, error) {
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("master key:%d doesn't exist", keyId)
+	}
+	if len(wrapped) < NonceSize+TagSize {
+		return nil, errors.New("invalid data key")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, wrapped[:NonceSize], wrapped[NonceSize:], []byte(aad))
+}
+
+var keyringMutex sync.RWMutex
+var keyring *Keyring
+
+// currentKeyring 没有配置master key时返回nil
+func currentKeyring() *Keyring {
+	keyringMutex.RLock()
+	defer keyringMutex.RUnlock()
+	return keyring
+}
+
+func setKeyring(k *Keyring) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	keyring = k
+}
+
+// reloadKeyring 重新读取master_key_file, 读取失败时继续使用之前的key
+func reloadKeyring() error {
+	if config == nil || len(config.masterKeyFile) == 0 {
+		return nil
+	}
+	k, err := LoadKeyring(config.masterKeyFile)
+	if err != nil {
+		return err
+	}
+	if old := currentKeyring(); old == nil || old.active != k.active {
+		log.Infof("master key file:%s keys:%d active key:%d", config.masterKeyFile, len(k.keys), k.active)
+	}
+	setKeyring(k)
+	return nil
+}
+
+// keyringFor 包含keyId的master key, slave同步master轮换之后的block时重新读取key文件
+func keyringFor(keyId int32) *Keyring {
+	k := currentKeyring()
+	if k != nil {
+		if _, ok := k.keys[keyId]; ok {
+			return k
+		}
+	}
+	if err := reloadKeyring(); err != nil {
+		log.Error("reload master key err:", err)
+	}
+	return currentKeyring()
+}
+
+// newBlockVersion 新建block的格式, 配置了master key时使用加密的格式
+func newBlockVersion() int {
+	if err := reloadKeyring(); err != nil {
+		log.Error("reload master key err:", err)
+	}
+	if currentKeyring() != nil {
+		return FVersion3
+	}
+	return FVersion
+}
+
+// BlockKey block的data key, 加密消息的key和计算nonce的key从data key派生
+type BlockKey struct {
+	keyId    int32
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newBlockKey(keyId int32, dataKey []byte) (*BlockKey, error) {
+	aead, err := newGCM(hmacSum(dataKey, "ims block encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &BlockKey{keyId: keyId, aead: aead, nonceKey: hmacSum(dataKey, "ims block nonce")}, nil
+}
+
+func blockKeyAAD(blockNo int) string {
+	return fmt.Sprintf("message_%d", blockNo)
+}
+
+// createBlockKey 新的block生成data key, 返回data key和写入block的第一条消息
+func createBlockKey(blockNo int) (*BlockKey, *Message, error) {
+	k := currentKeyring()
+	if k == nil {
+		return nil, nil, errors.New("master key file isn't configured")
+	}
+	dataKey := make([]byte, DataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	keyId, wrapped, err := k.wrap(dataKey, blockKeyAAD(blockNo))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := newBlockKey(keyId, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &Message{cmd: MSG_BLOCK_KEY, body: &BlockKeyRecord{keyId: keyId, wrapped: wrapped}}, nil
+}
+
+// openBlockKey 用master key解密block中的data key
+func openBlockKey(blockNo int, record *BlockKeyRecord) (*BlockKey, error) {
+	k := keyringFor(record.keyId)
+	if k == nil {
+		return nil, fmt.Errorf("block:%d is encrypted, master key file isn't configured", blockNo)
+	}
+	dataKey, err := k.unwrap(record.keyId, record.wrapped, blockKeyAAD(blockNo))
+	if err != nil {
+		return nil, fmt.Errorf("block:%d open data key err:%s", blockNo, err)
+	}
+	return newBlockKey(record.keyId, dataKey)
+}
+
+// seal 加密消息, nonce由消息的位置和内容计算, 相同的位置和内容得到相同的密文
+func (key *BlockKey) seal(msg *Message, msgid int64) *Message {
+	buffer := new(bytes.Buffer)
+	WriteMessage(buffer, msg)
+	plain := buffer.Bytes()
+
+	mac := hmac.New(sha256.New, key.nonceKey)
+	binary.Write(mac, binary.BigEndian, msgid)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:NonceSize:NonceSize]
+	data := key.aead.Seal(nonce, nonce, plain, nil)
+	return &Message{cmd: MSG_SEALED, body: &Sealed{data: data}}
+}
+
+func (key *BlockKey) open(sealed *Sealed) *Message {
+	plain, err := key.aead.Open(nil, sealed.data[:NonceSize], sealed.data[NonceSize:], nil)
+	if err != nil {
+		log.Warning("decrypt message err:", err)
+		return nil
+	}
+	return ReceiveMessage(bytes.NewReader(plain))
+}
+
+// openRecord 3.0格式的block中读取的消息, 解密MSG_SEALED
+func openRecord(msg *Message, key *BlockKey) *Message {
+	if msg.cmd != MSG_SEALED {
+		if isSealedCmd(msg.cmd) {
+			log.Warning("unencrypted message in encrypted block:", Command(msg.cmd))
+			return nil
+		}
+		return msg
+	}
+	if key == nil {
+		log.Warning("data key doesn't exist")
+		return nil
+	}
+	return key.open(msg.body.(*Sealed))
+}
+
+// setWriteKey 当前写入的block的data key, 需要持有storage.mutex
+func (storage *StorageFile) setWriteKey(key *BlockKey) {
+	storage.key = key
+	storage.versionMutex.Lock()
+	defer storage.versionMutex.Unlock()
+	if key != nil {
+		storage.keys[storage.blockNo] = key
+	} else {
+		delete(storage.keys, storage.blockNo)
+	}
+}
+
+// loadBlockKey 读取block的第一条消息中的data key, block中还没有消息时返回nil
+func (storage *StorageFile) loadBlockKey(blockNo int) (*BlockKey, error) {
+	if storage.BlockVersion(blockNo) != FVersion3 {
+		return nil, nil
+	}
+	file := storage.openBlockReader(blockNo)
+	if file == nil {
+		return nil, nil
+	}
+	defer file.Close()
+	if _, err := file.Seek(HeaderSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	msg := storage.ReadMessage(file, FVersion3, nil)
+	if msg == nil {
+		return nil, nil
+	}
+	if msg.cmd != MSG_BLOCK_KEY {
+		return nil, fmt.Errorf("block:%d first message:%s isn't data key", blockNo, Command(msg.cmd))
+	}
+	return openBlockKey(blockNo, msg.body.(*BlockKeyRecord))
+}
+
+// BlockKey block的data key, 3.0之前的格式返回nil
+func (storage *StorageFile) BlockKey(blockNo int) *BlockKey {
+	storage.versionMutex.Lock()
+	key, ok := storage.keys[blockNo]
+	storage.versionMutex.Unlock()
+	if ok {
+		return key
+	}
+
+	key, err := storage.loadBlockKey(blockNo)
+	if err != nil {
+		log.Error("load block key err:", err)
+		return nil
+	}
+	if key == nil {
+		return nil
+	}
+	storage.versionMutex.Lock()
+	storage.keys[blockNo] = key
+	storage.versionMutex.Unlock()
+	return key
+}
+
+// sealedWriter 加密的索引文件, 每次Write写入一段, 段的序号作为附加数据防止调整顺序
+type sealedWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func segmentAAD(seq uint64) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, seq)
+	return aad
+}
+
+func (sw *sealedWriter) Write(p []byte) (int, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	data := sw.aead.Seal(nonce, nonce, p, segmentAAD(sw.seq))
+	sw.seq++
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int32(len(data)-NonceSize))
+	buffer.Write(data)
+	if _, err := sw.w.Write(buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sealIndex 配置了master key时写入加密的索引文件, name是索引文件的名称
+func sealIndex(w io.Writer, name string) (io.Writer, error) {
+	k := currentKeyring()
+	if k == nil {
+		return w, nil
+	}
+	dataKey := make([]byte, DataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	keyId, wrapped, err := k.wrap(dataKey, name)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int32(IndexMagic))
+	binary.Write(buffer, binary.BigEndian, keyId)
+	binary.Write(buffer, binary.BigEndian, int32(len(wrapped)))
+	buffer.Write(wrapped)
+	if _, err = w.Write(buffer.Bytes()); err != nil {
+		return nil, err
+	}
+	return &sealedWriter{w: w, aead: aead}, nil
+}
+
+type sealedReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	seq  uint64
+	buf  []byte
+}
+
+func (sr *sealedReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		var length int32
+		if err := binary.Read(sr.r, binary.BigEndian, &length); err != nil {
+			return 0, err
+		}
+		if length < TagSize || length > 64*1024*1024 {
+			return 0, fmt.Errorf("invalid sealed segment length:%d", length)
+		}
+		data := make([]byte, NonceSize+int(length))
+		if _, err := io.ReadFull(sr.r, data); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		plain, err := sr.aead.Open(nil, data[:NonceSize], data[NonceSize:], segmentAAD(sr.seq))
+		if err != nil {
+			return 0, err
+		}
+		sr.seq++
+		sr.buf = plain
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// openIndex 读取索引文件, 兼容没有加密的索引文件
+func openIndex(r io.Reader, name string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4)
+	if err != nil || binary.BigEndian.Uint32(head) != IndexMagic {
+		return br, nil
+	}
+
+	var magic, keyId, length int32
+	binary.Read(br, binary.BigEndian, &magic)
+	binary.Read(br, binary.BigEndian, &keyId)
+	if err = binary.Read(br, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 0 || length > 1024 {
+		return nil, fmt.Errorf("%s invalid data key length:%d", name, length)
+	}
+	wrapped := make([]byte, length)
+	if _, err = io.ReadFull(br, wrapped); err != nil {
+		return nil, err
+	}
+	k := keyringFor(keyId)
+	if k == nil {
+		return nil, fmt.Errorf("%s is encrypted, master key file isn't configured", name)
+	}
+	dataKey, err := k.unwrap(keyId, wrapped, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s open data key err:%s", name, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReader{r: br, aead: aead}, nil
+}
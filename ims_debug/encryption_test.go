@@ -0,0 +1,146 @@
+package main
+
+import "io"
+import "bytes"
+import "testing"
+
+func testKeyring() *Keyring {
+	return &Keyring{keys: map[int32][]byte{1: bytes.Repeat([]byte{1}, DataKeySize)}, active: 1}
+}
+
+func TestSealOpen(t *testing.T) {
+	setKeyring(testKeyring())
+	defer setKeyring(nil)
+
+	key, record, err := createBlockKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.cmd != MSG_BLOCK_KEY {
+		t.Fatalf("block key record cmd:%d", record.cmd)
+	}
+	reopened, err := openBlockKey(0, record.body.(*BlockKeyRecord))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBlockKey(1, record.body.(*BlockKeyRecord)); err == nil {
+		t.Error("data key is opened for another block")
+	}
+
+	msg := testMessage(1, "hello world")
+	sealed := key.seal(msg, 100)
+	if sealed.cmd != MSG_SEALED {
+		t.Fatalf("sealed cmd:%d", sealed.cmd)
+	}
+	if m := openRecord(sealed, reopened); !equalMessage(m, msg) {
+		t.Error("open sealed message mismatch")
+	}
+
+	//相同的位置和内容得到相同的密文, master和slave写入相同的内容
+	if !bytes.Equal(key.seal(msg, 100).ToData(), sealed.ToData()) {
+		t.Error("seal isn't deterministic")
+	}
+	if bytes.Equal(key.seal(msg, 200).ToData(), sealed.ToData()) {
+		t.Error("same nonce for different msgid")
+	}
+
+	data := append([]byte{}, sealed.ToData()...)
+	data[len(data)-1] ^= 0xff
+	if m := key.open(&Sealed{data: data}); m != nil {
+		t.Error("tampered message is opened")
+	}
+	other, _, err := createBlockKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := openRecord(sealed, other); m != nil {
+		t.Error("message is opened with another data key")
+	}
+	//加密的block中没有加密的消息
+	if m := openRecord(&Message{cmd: MSG_BLOCK_KEY, body: record.body}, key); m == nil {
+		t.Error("block key record is rejected")
+	}
+}
+
+func TestSealedRecordRoundTrip(t *testing.T) {
+	setKeyring(testKeyring())
+	defer setKeyring(nil)
+
+	key, _, err := createBlockKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := new(StorageFile)
+	for i, content := range []string{"", "hello", string(bytes.Repeat([]byte("x"), 16*1024))} {
+		msg := testMessage(i, content)
+		data := EncodeRecord(key.seal(msg, int64(1000*i)), FVersion3)
+		r := bytes.NewReader(data)
+		m := storage.ReadMessage(r, FVersion3, key)
+		if !equalMessage(m, msg) {
+			t.Errorf("content len:%d read message mismatch", len(content))
+		}
+		if r.Len() != 0 {
+			t.Errorf("content len:%d %d bytes left", len(content), r.Len())
+		}
+	}
+}
+
+func TestSealIndex(t *testing.T) {
+	parts := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("index"), 10000), []byte("last")}
+	expect := bytes.Join(parts, nil)
+	write := func(name string) []byte {
+		buffer := new(bytes.Buffer)
+		w, err := sealIndex(buffer, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range parts {
+			if _, err := w.Write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buffer.Bytes()
+	}
+
+	//没有配置master key时不加密
+	plain := write("peer_index")
+	if !bytes.Equal(plain, expect) {
+		t.Error("unencrypted index mismatch")
+	}
+	r, err := openIndex(bytes.NewReader(plain), "peer_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, expect) {
+		t.Errorf("read unencrypted index err:%v", err)
+	}
+
+	setKeyring(testKeyring())
+	defer setKeyring(nil)
+	sealed := write("peer_index")
+	if bytes.Contains(sealed, []byte("index")) {
+		t.Error("index isn't encrypted")
+	}
+	r, err = openIndex(bytes.NewReader(sealed), "peer_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, expect) {
+		t.Errorf("read encrypted index err:%v", err)
+	}
+
+	//data key和索引文件的名称绑定
+	if _, err := openIndex(bytes.NewReader(sealed), "tombstone_index"); err == nil {
+		t.Error("index is opened with another name")
+	}
+	//修改内容之后读取失败
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0xff
+	r, err = openIndex(bytes.NewReader(tampered), "peer_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("tampered index is read")
+	}
+}
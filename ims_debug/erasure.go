@@ -0,0 +1,419 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "net/url"
+import "net/http"
+import "sync/atomic"
+import "encoding/json"
+import "encoding/binary"
+import "path/filepath"
+import log "github.com/golang/glog"
+
+//删除用户的消息(GDPR): 在block中写入tombstone记录, 从messageIndex中删除用户的离线消息链
+//其他用户的离线消息链中tombstone之前由该用户发送的消息在读取时跳过
+//tombstone和普通消息一样同步到slave, 重建索引时重新执行
+//block文件是只读的, 消息在压缩block时才从磁盘上删除, tombstones是等待压缩删除的用户
+//旧版本的slave不能解析tombstone记录, 使用之前需要先升级所有的slave
+
+const MSG_TOMBSTONE = 249              //内部文件存储使用, 删除用户的消息
+const MSG_STORAGE_SYNC_TOMBSTONE = 233 //master->slave 快照中的tombstone_index, 只有存在tombstone时发送
+
+//审计记录, 每一行是一个json对象
+const ErasureAuditFile = "erasure_audit.log"
+
+//tombstone_index每一项 appid uid msgid = 24字节
+const TombstoneIndexSize = 24
+
+const MaxErasureReasonSize = 1024
+
+var ErrInvalidErasure = errors.New("invalid erasure request")
+
+func init() {
+	messageCreators[MSG_TOMBSTONE] = func() IMessage { return new(Tombstone) }
+	messageCreators[MSG_STORAGE_SYNC_TOMBSTONE] = func() IMessage { return new(SyncTombstone) }
+
+	messageDescriptions[MSG_TOMBSTONE] = "MSG_TOMBSTONE"
+	messageDescriptions[MSG_STORAGE_SYNC_TOMBSTONE] = "MSG_STORAGE_SYNC_TOMBSTONE"
+}
+
+type EraseRequest struct {
+	Appid    int64
+	Uid      int64
+	Operator string //执行删除的管理员
+	Reason   string
+}
+
+type EraseResult struct {
+	Tombstone int64 //tombstone记录的msgid, 之前该用户的消息都被删除
+	LastMsgid int64 //被删除的离线消息链的最后一条消息
+}
+
+type ErasureAudit struct {
+	Time      int64  `json:"time"`
+	Appid     int64  `json:"appid"`
+	Uid       int64  `json:"uid"`
+	Operator  string `json:"operator"`
+	Reason    string `json:"reason"`
+	Tombstone int64  `json:"tombstone"`
+	LastMsgid int64  `json:"last_msgid"`
+}
+
+//region Tombstone
+
+type Tombstone struct {
+	appid     int64
+	uid       int64
+	timestamp int32
+	operator  string
+	reason    string
+}
+
+func (t *Tombstone) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, t.appid)
+	binary.Write(buffer, binary.BigEndian, t.uid)
+	binary.Write(buffer, binary.BigEndian, t.timestamp)
+	binary.Write(buffer, binary.BigEndian, int16(len(t.operator)))
+	buffer.Write([]byte(t.operator))
+	buffer.Write([]byte(t.reason))
+	return buffer.Bytes()
+}
+
+func (t *Tombstone) FromData(buff []byte) bool {
+	if len(buff) < 22 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &t.appid)
+	binary.Read(buffer, binary.BigEndian, &t.uid)
+	binary.Read(buffer, binary.BigEndian, &t.timestamp)
+	var l int16
+	binary.Read(buffer, binary.BigEndian, &l)
+	if l < 0 || int(l) > buffer.Len() {
+		return false
+	}
+	t.operator = string(buffer.Next(int(l)))
+	t.reason = string(buffer.Bytes())
+	return true
+}
+
+//endregion
+
+//region SyncTombstone
+
+//格式和tombstone_index文件相同
+type SyncTombstone struct {
+	data []byte
+}
+
+func (t *SyncTombstone) ToData() []byte {
+	return t.data
+}
+
+func (t *SyncTombstone) FromData(buff []byte) bool {
+	if len(buff)%TombstoneIndexSize != 0 {
+		return false
+	}
+	t.data = buff
+	return true
+}
+
+//endregion
+
+// messageSender 消息的发送者，不能确定发送者时返回false
+func messageSender(msg *Message, appid int64) (UserID, bool) {
+	switch body := msg.body.(type) {
+	case *IMMessage:
+		return UserID{appid, body.sender}, true
+	case *CustomerMessage:
+		if msg.cmd == MsgCustomer {
+			return UserID{body.customerAppid, body.customerId}, true
+		}
+	}
+	return UserID{}, false
+}
+
+// applyTombstone 删除用户的离线消息链, 需要持有storage.mutex
+func (peerStorage *PeerStorage) applyTombstone(t *Tombstone, msgid int64) {
+	id := UserID{t.appid, t.uid}
+	delete(peerStorage.messageIndex, id)
+	if msgid > peerStorage.tombstones[id] {
+		peerStorage.tombstones[id] = msgid
+	}
+	if msgid > peerStorage.lastId {
+		peerStorage.lastId = msgid
+	}
+}
+
+// IsErased msgid的消息由已经被删除的用户发送, appid是离线消息链所属的appid
+func (peerStorage *PeerStorage) IsErased(msg *Message, msgid int64, appid int64) bool {
+	sender, ok := messageSender(msg, appid)
+	if !ok {
+		return false
+	}
+	peerStorage.mutex.Lock()
+	defer peerStorage.mutex.Unlock()
+	tombstone, ok := peerStorage.tombstones[sender]
+	return ok && msgid < tombstone
+}
+
+// EraseUser 写入tombstone, 返回tombstone的msgid和被删除的离线消息链的最后一条消息
+func (peerStorage *PeerStorage) EraseUser(appid int64, uid int64, operator string, reason string) (int64, int64) {
+	peerStorage.mutex.Lock()
+	defer peerStorage.mutex.Unlock()
+	lastId, _ := peerStorage.getLastMessageID(appid, uid)
+	t := &Tombstone{appid: appid, uid: uid, timestamp: int32(time.Now().Unix()), operator: operator, reason: reason}
+	msgid := peerStorage.saveMessage(&Message{cmd: MSG_TOMBSTONE, body: t})
+	peerStorage.applyTombstone(t, msgid)
+	return msgid, lastId
+}
+
+// Tombstones 等待压缩时删除消息的用户和对应的tombstone
+func (peerStorage *PeerStorage) Tombstones() map[UserID]int64 {
+	peerStorage.mutex.Lock()
+	defer peerStorage.mutex.Unlock()
+	return peerStorage.cloneTombstones()
+}
+
+func (peerStorage *PeerStorage) cloneTombstones() map[UserID]int64 {
+	tombstones := make(map[UserID]int64)
+	for k, v := range peerStorage.tombstones {
+		tombstones[k] = v
+	}
+	return tombstones
+}
+
+// setTombstones 快照或者tombstone_index中的tombstone, tombstone之前的离线消息链已经被删除
+func (peerStorage *PeerStorage) setTombstones(tombstones map[UserID]int64) {
+	for id, msgid := range tombstones {
+		if ui, ok := peerStorage.messageIndex[id]; ok && ui.lastId < msgid {
+			delete(peerStorage.messageIndex, id)
+		}
+		if msgid > peerStorage.tombstones[id] {
+			peerStorage.tombstones[id] = msgid
+		}
+	}
+}
+
+// pruneTombstones watermark之前的消息已经被删除, 不再需要tombstone
+func (peerStorage *PeerStorage) pruneTombstones(watermark int64) int {
+	pruned := 0
+	for id, msgid := range peerStorage.tombstones {
+		if msgid < watermark {
+			delete(peerStorage.tombstones, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+func encodeTombstones(tombstones map[UserID]int64) []byte {
+	buffer := new(bytes.Buffer)
+	for id, msgid := range tombstones {
+		binary.Write(buffer, binary.BigEndian, id.appid)
+		binary.Write(buffer, binary.BigEndian, id.uid)
+		binary.Write(buffer, binary.BigEndian, msgid)
+	}
+	return buffer.Bytes()
+}
+
+func decodeTombstones(data []byte, tombstones map[UserID]int64) {
+	buffer := bytes.NewBuffer(data)
+	for buffer.Len() >= TombstoneIndexSize {
+		id := UserID{}
+		var msgid int64
+		binary.Read(buffer, binary.BigEndian, &id.appid)
+		binary.Read(buffer, binary.BigEndian, &id.uid)
+		binary.Read(buffer, binary.BigEndian, &msgid)
+		tombstones[id] = msgid
+	}
+}
+
+func (peerStorage *PeerStorage) readTombstoneIndex() map[UserID]int64 {
+	tombstones := make(map[UserID]int64)
+	path := fmt.Sprintf("%s/tombstone_index", peerStorage.root)
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("open file:", err)
+		}
+		return tombstones
+	}
+	defer file.Close()
+	r, err := openIndex(file, "tombstone_index")
+	if err != nil {
+		log.Fatal("open tombstone index err:", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		log.Fatal("read tombstone index err:", err)
+	}
+	decodeTombstones(data, tombstones)
+	return tombstones
+}
+
+// saveTombstoneIndex 在peer_index之前写入，peer_index中的离线消息链不会包含tombstone之前的消息
+func (peerStorage *PeerStorage) saveTombstoneIndex(tombstones map[UserID]int64) {
+	path := fmt.Sprintf("%s/tombstone_index_t", peerStorage.root)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatal("open file:", err)
+	}
+	w, err := sealIndex(file, "tombstone_index")
+	if err != nil {
+		log.Fatal("seal tombstone index err:", err)
+	}
+	_, err = w.Write(encodeTombstones(tombstones))
+	if err != nil {
+		log.Fatal("write file:", err)
+	}
+	err = file.Sync()
+	if err != nil {
+		log.Info("sync file err:", err)
+	}
+	_ = file.Close()
+
+	path2 := fmt.Sprintf("%s/tombstone_index", peerStorage.root)
+	err = os.Rename(path, path2)
+	if err != nil {
+		log.Fatal("rename tombstone index file err:", err)
+	}
+}
+
+// writeErasureAudit 追加审计记录，写入磁盘之后返回
+func writeErasureAudit(root string, audit *ErasureAudit) error {
+	file, err := os.OpenFile(filepath.Join(root, ErasureAuditFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readErasureAudit 最近的limit条审计记录
+func readErasureAudit(root string, limit int) ([]*ErasureAudit, error) {
+	file, err := os.Open(filepath.Join(root, ErasureAuditFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	audits := make([]*ErasureAudit, 0)
+	decoder := json.NewDecoder(file)
+	for {
+		audit := &ErasureAudit{}
+		err := decoder.Decode(audit)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		audits = append(audits, audit)
+	}
+	if limit > 0 && len(audits) > limit {
+		audits = audits[len(audits)-limit:]
+	}
+	return audits, nil
+}
+
+// Erase 只有master可以删除，等待slave写入tombstone之后返回
+func Erase(r *EraseRequest) (*EraseResult, error) {
+	if r.Uid == 0 || len(r.Operator) == 0 || len(r.Operator) > 255 || len(r.Reason) > MaxErasureReasonSize {
+		return nil, ErrInvalidErasure
+	}
+	if err := LockWrite(); err != nil {
+		return nil, err
+	}
+	msgid, lastId := storage.EraseUser(r.Appid, r.Uid, r.Operator, r.Reason)
+	UnlockWrite()
+
+	audit := &ErasureAudit{
+		Time:      time.Now().Unix(),
+		Appid:     r.Appid,
+		Uid:       r.Uid,
+		Operator:  r.Operator,
+		Reason:    r.Reason,
+		Tombstone: msgid,
+		LastMsgid: lastId,
+	}
+	if err := writeErasureAudit(storage.root, audit); err != nil {
+		//tombstone已经写入, 审计记录仍然保存在block中
+		log.Error("write erasure audit err:", err)
+	}
+	log.Warningf("erase appid:%d uid:%d operator:%s reason:%s tombstone:%d last msgid:%d",
+		r.Appid, r.Uid, r.Operator, r.Reason, msgid, lastId)
+
+	WaitSyncAck(msgid)
+	return &EraseResult{Tombstone: msgid, LastMsgid: lastId}, nil
+}
+
+func EraseUser(addr string, r *EraseRequest) (*EraseResult, error) {
+	atomic.AddInt64(&serverSummary.requestCount, 1)
+	return Erase(r)
+}
+
+// EraseHandler POST /erase?appid=&uid=&operator=&reason=
+func EraseHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteHttpError(405, "method not allowed", rw)
+		return
+	}
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	appid, err1 := strconv.ParseInt(m.Get("appid"), 10, 64)
+	uid, err2 := strconv.ParseInt(m.Get("uid"), 10, 64)
+	if err1 != nil || err2 != nil {
+		WriteHttpError(400, "invalid query param", rw)
+		return
+	}
+	r := &EraseRequest{Appid: appid, Uid: uid, Operator: m.Get("operator"), Reason: m.Get("reason")}
+	result, err := Erase(r)
+	if err == ErrInvalidErasure {
+		WriteHttpError(400, err.Error(), rw)
+		return
+	} else if err != nil {
+		WriteHttpError(500, err.Error(), rw)
+		return
+	}
+	obj := make(map[string]interface{})
+	obj["tombstone"] = result.Tombstone
+	obj["last_msgid"] = result.LastMsgid
+	WriteHttpObj(obj, rw)
+}
+
+// Erasures 等待压缩的tombstone和最近的审计记录 /erasures?limit=
+func Erasures(rw http.ResponseWriter, req *http.Request) {
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	limit, err := strconv.Atoi(m.Get("limit"))
+	if err != nil {
+		limit = 100
+	}
+	pending := make([]map[string]interface{}, 0)
+	for id, msgid := range storage.Tombstones() {
+		pending = append(pending, map[string]interface{}{"appid": id.appid, "uid": id.uid, "tombstone": msgid})
+	}
+	audits, err := readErasureAudit(storage.root, limit)
+	if err != nil {
+		WriteHttpError(500, err.Error(), rw)
+		return
+	}
+	obj := make(map[string]interface{})
+	obj["pending"] = pending
+	obj["audit"] = audits
+	WriteHttpObj(obj, rw)
+}
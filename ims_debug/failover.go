@@ -0,0 +1,244 @@
+package main
+
+import "os"
+import "fmt"
+import "sync"
+import "errors"
+import "strconv"
+import "path/filepath"
+import "github.com/richmonkey/cfg"
+import log "github.com/golang/glog"
+
+//master切换时使用递增的epoch作为fencing token
+//提升slave需要更大的epoch, 之前的master收到更大的epoch之后不再接受写入
+//epoch和当前的master地址保存在storage_root/replica文件中，重启之后优先于配置文件中的master_address
+//写入消息的rpc不带epoch, fence只有在旧的master可以访问时才生效, 旧的master被网络隔离时是尽力而为的:
+//im重新加载路由之前仍然可能写入旧的master, 这些消息不会出现在新的master上,
+//直到旧的master连接到新epoch的slave或者master时才停止写入, 切换之前需要先停止旧的master的进程
+
+const ReplicaStateFile = "replica"
+
+var ErrReadOnly = errors.New("storage is read only")
+var ErrStaleEpoch = errors.New("stale epoch")
+
+type PromoteRequest struct {
+	Epoch       int64
+	MasterMsgid int64 //master的NextMsgid, slave必须已经同步到该位置
+	Force       bool  //master的位置未知时强制提升
+}
+
+type ReplicateRequest struct {
+	MasterAddress string //新master的sync_listen地址
+	Epoch         int64
+}
+
+//保护slave, epoch, fenced
+//写入消息时持有读锁，fence返回之后不会再有新的消息写入
+var roleMutex sync.RWMutex
+var epoch int64
+var fenced bool //旧的master被fence之后只读
+
+// ReplicaState 保存在文件中的状态
+type ReplicaState struct {
+	Epoch         int64
+	MasterAddress string
+	Fenced        bool
+}
+
+func replicaStatePath() string {
+	return filepath.Join(config.storageRoot, ReplicaStateFile)
+}
+
+// LoadReplicaState 文件不存在时返回nil
+func LoadReplicaState() *ReplicaState {
+	path := replicaStatePath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	appCfg := make(map[string]string)
+	err := cfg.Load(path, appCfg)
+	if err != nil {
+		log.Fatal("load replica state err:", err)
+	}
+	state := &ReplicaState{}
+	state.Epoch, err = strconv.ParseInt(appCfg["epoch"], 10, 64)
+	if err != nil {
+		log.Fatal("invalid replica epoch:", appCfg["epoch"])
+	}
+	state.MasterAddress = appCfg["master_address"]
+	state.Fenced = appCfg["fenced"] == "1"
+	return state
+}
+
+func saveReplicaState(state *ReplicaState) error {
+	fenced := 0
+	if state.Fenced {
+		fenced = 1
+	}
+	data := fmt.Sprintf("epoch=%d\nfenced=%d\n", state.Epoch, fenced)
+	if len(state.MasterAddress) > 0 {
+		data += fmt.Sprintf("master_address=%s\n", state.MasterAddress)
+	}
+
+	path := replicaStatePath()
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// currentState 需要持有roleMutex
+func currentState() *ReplicaState {
+	state := &ReplicaState{Epoch: epoch, Fenced: fenced}
+	if slave != nil {
+		state.MasterAddress = slave.addr
+	}
+	return state
+}
+
+// StartReplica 启动时根据保存的状态或者配置文件决定是master还是slave
+func StartReplica() {
+	masterAddress := config.masterAddress
+	state := LoadReplicaState()
+	if state != nil {
+		if state.MasterAddress != masterAddress {
+			log.Warningf("master address:%s in replica state overrides config:%s", state.MasterAddress, masterAddress)
+		}
+		masterAddress = state.MasterAddress
+		epoch = state.Epoch
+		fenced = state.Fenced
+	}
+	log.Infof("replica epoch:%d master address:%s fenced:%t", epoch, masterAddress, fenced)
+
+	if len(masterAddress) > 0 {
+		slave = NewSlave(masterAddress, epoch)
+		slave.Start()
+	}
+}
+
+func CurrentEpoch() int64 {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	return epoch
+}
+
+func IsFenced() bool {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	return fenced
+}
+
+// LockWrite 写入消息之前调用，slave和被fence的master不能写入
+func LockWrite() error {
+	roleMutex.RLock()
+	if slave != nil || fenced {
+		roleMutex.RUnlock()
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func UnlockWrite() {
+	roleMutex.RUnlock()
+}
+
+// Fence 停止写入，newEpoch小于当前的epoch时失败
+func Fence(newEpoch int64) error {
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+	if newEpoch < epoch {
+		return ErrStaleEpoch
+	}
+	state := currentState()
+	state.Epoch = newEpoch
+	state.Fenced = true
+	if err := saveReplicaState(state); err != nil {
+		log.Error("save replica state err:", err)
+		return err
+	}
+	epoch = newEpoch
+	fenced = true
+	log.Warningf("storage fenced, epoch:%d", epoch)
+	return nil
+}
+
+// Promote 停止同步，确认已经同步到master的位置之后作为master接受写入
+func Promote(r *PromoteRequest) error {
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+	if r.Epoch <= epoch {
+		return ErrStaleEpoch
+	}
+	if r.MasterMsgid == 0 && !r.Force {
+		return errors.New("master msgid is required")
+	}
+
+	var masterAddress string
+	if slave != nil {
+		masterAddress = slave.addr
+		slave.Stop()
+		slave = nil
+	}
+
+	next := storage.NextMsgid()
+	if next < r.MasterMsgid {
+		log.Warningf("next msgid:%d is behind master:%d, refuse to promote", next, r.MasterMsgid)
+		if len(masterAddress) > 0 {
+			slave = NewSlave(masterAddress, epoch)
+			slave.Start()
+		}
+		return fmt.Errorf("next msgid:%d is behind master msgid:%d", next, r.MasterMsgid)
+	}
+
+	state := &ReplicaState{Epoch: r.Epoch}
+	if err := saveReplicaState(state); err != nil {
+		log.Error("save replica state err:", err)
+		if len(masterAddress) > 0 {
+			slave = NewSlave(masterAddress, epoch)
+			slave.Start()
+		}
+		return err
+	}
+	epoch = r.Epoch
+	fenced = false
+	log.Warningf("promoted to master, epoch:%d next msgid:%d", epoch, next)
+	return nil
+}
+
+// Replicate 从新的master同步, 也用于把旧的master降级为slave
+func Replicate(r *ReplicateRequest) error {
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+	if r.Epoch < epoch {
+		return ErrStaleEpoch
+	}
+	if len(r.MasterAddress) == 0 {
+		return errors.New("master address is required")
+	}
+
+	state := &ReplicaState{Epoch: r.Epoch, MasterAddress: r.MasterAddress}
+	if err := saveReplicaState(state); err != nil {
+		log.Error("save replica state err:", err)
+		return err
+	}
+
+	if slave != nil {
+		slave.Stop()
+	}
+	epoch = r.Epoch
+	fenced = false
+	slave = NewSlave(r.MasterAddress, epoch)
+	slave.Start()
+	log.Warningf("replicate from:%s epoch:%d", r.MasterAddress, epoch)
+	return nil
+}
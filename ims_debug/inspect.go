@@ -0,0 +1,410 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "sort"
+import "flag"
+import "bufio"
+import "strconv"
+import "encoding/json"
+import "path/filepath"
+import "im_research/ims_debug/lru"
+
+//离线查看storage_root中的block文件，除了repair之外不修改任何文件
+//ims inspect storage_root blocks|check|dump|user|export|repair [options]
+
+const inspectUsage = `usage: ims inspect storage_root command [options]
+  blocks                              list block files
+  check                               validate magic and crc of every record
+  dump [-from msgid] [-limit n]       print records, from must be msgid of a record
+  user -appid id -uid id [-peer]      follow offline chain of user from peer_index
+  export -from msgid -to msgid [-o file]
+                                      export records in [from, to) to json
+  repair -block n                     truncate the last block at the first bad record and remove peer_index,
+                                      ims must be stopped
+options:
+  -key file                           master key file of encrypted blocks
+  -archive dir                        archive_root of archived blocks, default storage_root/archive`
+
+type InspectRecord struct {
+	Msgid   int64  `json:"msgid"`
+	Cmd     int    `json:"cmd"`
+	Name    string `json:"name"`
+	Seq     int    `json:"seq"`
+	Version int    `json:"version"`
+	Flag    int    `json:"flag"`
+	Body    string `json:"body"` //解码之后的消息内容
+	Data    []byte `json:"data"` //消息体的原始内容
+}
+
+func newInspectRecord(msgid int64, msg *Message) *InspectRecord {
+	return &InspectRecord{
+		Msgid:   msgid,
+		Cmd:     msg.cmd,
+		Name:    Command(msg.cmd).String(),
+		Seq:     msg.seq,
+		Version: msg.version,
+		Flag:    msg.flag,
+		Body:    fmt.Sprintf("%+v", msg.body),
+		Data:    msg.ToData(),
+	}
+}
+
+func (r *InspectRecord) String() string {
+	return fmt.Sprintf("%d %s seq:%d version:%d flag:%d %s", r.Msgid, r.Name, r.Seq, r.Version, r.Flag, r.Body)
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newInspectStorage 只读, 不打开写入文件也不恢复不完整的消息
+func newInspectStorage(root string) *PeerStorage {
+	f := new(StorageFile)
+	f.root = root
+	f.archiveRoot = filepath.Join(root, ArchiveDir)
+	f.files = lru.New(LruSize)
+	f.files.OnEvicted = onFileEvicted
+	f.versions = make(map[int]int)
+	f.remaps = make(map[int]*BlockRemap)
+	f.keys = make(map[int]*BlockKey)
+	return NewPeerStorage(f)
+}
+
+// listBlocks 按照编号排序的block, 包括已经归档的block
+func (storage *StorageFile) listBlocks() []int {
+	files, _ := filepath.Glob(filepath.Join(storage.root, "message_*"))
+	archived, _ := filepath.Glob(filepath.Join(storage.archiveRoot, "message_*"))
+	blocks := make([]int, 0, len(files)+len(archived))
+	exists := make(map[int]bool)
+	for _, f := range append(files, archived...) {
+		b, err := strconv.Atoi(filepath.Base(f)[8:])
+		if err != nil || exists[b] {
+			continue
+		}
+		exists[b] = true
+		blocks = append(blocks, b)
+	}
+	sort.Ints(blocks)
+	return blocks
+}
+
+// scanBlock 从offset开始顺序读取block中的消息，f返回false时停止
+// 返回停止的位置和文件的大小，位置小于文件大小并且f没有停止时表示之后的消息不完整
+// 压缩的block按照压缩之前的位置读取, 删除的消息是MSG_HOLE
+func scanBlock(st *PeerStorage, blockNo int, offset int64, f func(msgid int64, msg *Message) bool) (int64, int64, error) {
+	file := st.openBlockReader(blockNo)
+	if file == nil {
+		return 0, 0, fmt.Errorf("block:%d doesn't exist", blockNo)
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < HeaderSize {
+		offset = HeaderSize
+	}
+	if _, err = file.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, 0, err
+	}
+
+	version := st.BlockVersion(blockNo)
+	key := st.BlockKey(blockNo)
+	r := &countReader{r: bufio.NewReaderSize(file, 1024*1024)}
+	pos := offset
+	for pos < size {
+		msg := st.ReadMessage(r, version, key)
+		if msg == nil {
+			break
+		}
+		if !f(st.getMsgid(blockNo, int(pos)), msg) {
+			break
+		}
+		pos = offset + r.n
+	}
+	return pos, size, nil
+}
+
+func inspectBlocks(st *PeerStorage) {
+	for _, b := range st.listBlocks() {
+		info, err := st.statBlock(b)
+		if err != nil {
+			fmt.Printf("block:%d err:%s\n", b, err)
+			continue
+		}
+		version := st.BlockVersion(b)
+		size := info.Size()
+		extra := ""
+		if st.IsArchived(b) {
+			if file := st.getFile(b); file != nil {
+				size, _ = blockFileSize(file)
+			}
+			extra = fmt.Sprintf(" archived:%d", info.Size())
+		}
+		if remap := st.blockRemap(b); remap != nil {
+			extra += fmt.Sprintf(" compacted:%d records:%d", size, len(remap.offsets))
+			size = remap.size
+		}
+		fmt.Printf("block:%d size:%d version:%d.%d first msgid:%d next msgid:%d%s\n", b, size,
+			version>>16, version&0xffff, st.getMsgid(b, HeaderSize), st.getMsgid(b, int(size)), extra)
+	}
+}
+
+func inspectCheck(st *PeerStorage) bool {
+	ok := true
+	for _, b := range st.listBlocks() {
+		count := 0
+		pos, size, err := scanBlock(st, b, HeaderSize, func(msgid int64, msg *Message) bool {
+			count++
+			return true
+		})
+		if err != nil {
+			fmt.Printf("block:%d err:%s\n", b, err)
+			ok = false
+			continue
+		}
+		if size < HeaderSize {
+			fmt.Printf("block:%d header isn't complete, size:%d\n", b, size)
+			ok = false
+		} else if pos < size {
+			fmt.Printf("block:%d records:%d bad record at offset:%d msgid:%d, %d bytes after\n",
+				b, count, pos, st.getMsgid(b, int(pos)), size-pos)
+			ok = false
+		} else {
+			fmt.Printf("block:%d records:%d ok\n", b, count)
+		}
+	}
+	return ok
+}
+
+// inspectRange 按顺序读取[from, to)之间的消息, to为0时读取到结尾
+func inspectRange(st *PeerStorage, from int64, to int64, f func(msgid int64, msg *Message) bool) {
+	stop := false
+	for _, b := range st.listBlocks() {
+		if b < st.getBlockNo(from) || stop {
+			continue
+		}
+		var offset int64
+		if b == st.getBlockNo(from) {
+			offset = int64(st.getBlockOffset(from))
+		}
+		pos, size, err := scanBlock(st, b, offset, func(msgid int64, msg *Message) bool {
+			if to > 0 && msgid >= to {
+				stop = true
+				return false
+			}
+			if !f(msgid, msg) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "block:%d err:%s\n", b, err)
+		} else if !stop && pos < size {
+			fmt.Fprintf(os.Stderr, "block:%d bad record at msgid:%d\n", b, st.getMsgid(b, int(pos)))
+		}
+	}
+}
+
+func inspectUser(st *PeerStorage, appid int64, uid int64, peer bool, limit int) {
+	if !st.readPeerIndex() {
+		fmt.Println("peer_index doesn't exist")
+		return
+	}
+	lastId, lastPeerId := st.getLastMessageID(appid, uid)
+	fmt.Printf("appid:%d uid:%d last id:%d last peer id:%d\n", appid, uid, lastId, lastPeerId)
+
+	msgid := lastId
+	if peer {
+		msgid = lastPeerId
+	}
+	for i := 0; msgid > 0 && i < limit; i++ {
+		msg := st.LoadMessage(msgid)
+		if msg == nil {
+			fmt.Printf("load message:%d err\n", msgid)
+			return
+		}
+		fmt.Println(newInspectRecord(msgid, msg))
+
+		var target, prev int64
+		switch off := msg.body.(type) {
+		case *OfflineMessage:
+			target, prev = off.msgid, off.prevMsgid
+		case *OfflineMessage2:
+			target, prev = off.msgid, off.prevMsgid
+			if peer {
+				prev = off.prevPeerMsgid
+			}
+		default:
+			fmt.Printf("message:%d isn't offline message\n", msgid)
+			return
+		}
+
+		m := st.LoadMessage(target)
+		if m == nil {
+			fmt.Printf("  load message:%d err\n", target)
+		} else {
+			fmt.Printf("  %s\n", newInspectRecord(target, m))
+		}
+		msgid = prev
+	}
+}
+
+// inspectRepair 截断block中第一条不完整的消息之后的内容, 删除索引文件，ims启动时重建索引
+func inspectRepair(st *PeerStorage, blockNo int) error {
+	if st.IsArchived(blockNo) {
+		return fmt.Errorf("block:%d is archived", blockNo)
+	}
+	if st.blockRemap(blockNo) != nil {
+		return fmt.Errorf("block:%d is compacted", blockNo)
+	}
+	count := 0
+	pos, size, err := scanBlock(st, blockNo, HeaderSize, func(msgid int64, msg *Message) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if size < HeaderSize || pos >= size {
+		fmt.Printf("block:%d records:%d ok\n", blockNo, count)
+		return nil
+	}
+	if blocks := st.listBlocks(); blockNo != blocks[len(blocks)-1] {
+		//之后的block中还有消息, 截断会丢失坏记录之后有效的消息
+		return fmt.Errorf("block:%d has bad record at msgid:%d, only the last block can be truncated",
+			blockNo, st.getMsgid(blockNo, int(pos)))
+	}
+
+	path := fmt.Sprintf("%s/message_%d", st.root, blockNo)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	report, err := st.truncateBlock(file, blockNo, pos, size)
+	if err != nil {
+		return err
+	}
+	st.removePeerIndex()
+	fmt.Printf("block:%d records:%d truncated at msgid:%d, discarded %d bytes, backup:%s\n",
+		blockNo, count, report.Msgid, report.Discarded, report.Backup)
+	fmt.Println("peer_index removed, it will be recreated when ims starts")
+	return nil
+}
+
+func inspectExport(st *PeerStorage, from int64, to int64, w io.Writer) error {
+	records := make([]*InspectRecord, 0)
+	inspectRange(st, from, to, func(msgid int64, msg *Message) bool {
+		records = append(records, newInspectRecord(msgid, msg))
+		return true
+	})
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(records)
+}
+
+// Inspect ims inspect子命令, 返回进程的退出码
+func Inspect(args []string) int {
+	if len(args) < 2 {
+		fmt.Println(inspectUsage)
+		return 2
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	st := newInspectStorage(args[0])
+
+	fs := flag.NewFlagSet(args[1], flag.ContinueOnError)
+	from := fs.Int64("from", 0, "first msgid")
+	to := fs.Int64("to", 0, "end msgid, exclusive")
+	limit := fs.Int("limit", 100, "max records")
+	appid := fs.Int64("appid", 0, "appid")
+	uid := fs.Int64("uid", 0, "uid")
+	peer := fs.Bool("peer", false, "follow peer message chain only")
+	output := fs.String("o", "", "output file, default stdout")
+	block := fs.Int("block", -1, "block number")
+	keyFile := fs.String("key", "", "master key file")
+	archiveRoot := fs.String("archive", "", "archive_root, default storage_root/archive")
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+	if len(*archiveRoot) > 0 {
+		st.archiveRoot = *archiveRoot
+	}
+	if len(*keyFile) > 0 {
+		k, err := LoadKeyring(*keyFile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		setKeyring(k)
+	}
+
+	switch args[1] {
+	case "blocks":
+		inspectBlocks(st)
+	case "check":
+		if !inspectCheck(st) {
+			return 1
+		}
+	case "dump":
+		count := 0
+		inspectRange(st, *from, 0, func(msgid int64, msg *Message) bool {
+			fmt.Println(newInspectRecord(msgid, msg))
+			count++
+			return count < *limit
+		})
+	case "user":
+		if *uid == 0 {
+			fmt.Println(inspectUsage)
+			return 2
+		}
+		inspectUser(st, *appid, *uid, *peer, *limit)
+	case "export":
+		if *to <= *from {
+			fmt.Println("-to must be greater than -from")
+			return 2
+		}
+		w := io.Writer(os.Stdout)
+		if len(*output) > 0 {
+			f, err := os.Create(*output)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := inspectExport(st, *from, *to, w); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	case "repair":
+		if *block < 0 {
+			fmt.Println(inspectUsage)
+			return 2
+		}
+		if err := inspectRepair(st, *block); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	default:
+		fmt.Println(inspectUsage)
+		return 2
+	}
+	return 0
+}
@@ -5,12 +5,18 @@ import "encoding/json"
 import "os"
 import "runtime"
 import "runtime/pprof"
+import "sync/atomic"
 import log "github.com/golang/glog"
 
 type ServerSummary struct {
 	requestCount      int64
 	peerMessageCount  int64
 	groupMessageCount int64
+
+	syncAckCount        int64 //半同步复制等待成功的次数
+	syncAckTimeoutCount int64 //等待slave超时的次数
+	syncAckWaitTime     int64 //等待slave的总时间(微秒)
+	syncAckAsyncCount   int64 //slave不足或者没有追上时不等待的次数
 }
 
 func NewServerSummary() *ServerSummary {
@@ -23,6 +29,15 @@ func Summary(resp http.ResponseWriter, req *http.Request) {
 	data["request_count"] = serverSummary.requestCount
 	data["peer_message_count"] = serverSummary.peerMessageCount
 	data["group_message_count"] = serverSummary.groupMessageCount
+	data["sync_ack_count"] = atomic.LoadInt64(&serverSummary.syncAckCount)
+	data["sync_ack_timeout_count"] = atomic.LoadInt64(&serverSummary.syncAckTimeoutCount)
+	data["sync_ack_wait_time"] = atomic.LoadInt64(&serverSummary.syncAckWaitTime)
+	data["sync_ack_async_count"] = atomic.LoadInt64(&serverSummary.syncAckAsyncCount)
+	data["slaves"] = GetSlaveStats()
+	data["watermark"] = storage.Watermark()
+	if storage.recovery != nil {
+		data["recovery"] = storage.recovery
+	}
 
 	body, err := json.Marshal(data)
 	if err != nil {
@@ -27,11 +27,15 @@ type PeerStorage struct {
 	//消息索引全部放在内存中,在程序退出时,再全部保存到文件中，
 	//如果索引文件不存在或上次保存失败，则在程序启动的时候，从消息DB中重建索引，这需要遍历每一条消息
 	messageIndex map[UserID]*UserIndex //记录每个用户最近的消息ID
+
+	//被删除的用户和tombstone的msgid, 之前该用户发送的消息在读取时跳过
+	tombstones map[UserID]int64
 }
 
 func NewPeerStorage(f *StorageFile) *PeerStorage {
 	storage := &PeerStorage{StorageFile: f}
 	storage.messageIndex = make(map[UserID]*UserIndex)
+	storage.tombstones = make(map[UserID]int64)
 	return storage
 }
 
@@ -98,9 +102,11 @@ func (peerStorage *PeerStorage) SetLastMessageID(appid int64, receiver int64, la
 func (peerStorage *PeerStorage) LoadHistoryMessages(appid int64, receiver int64, syncMsgid int64, groupLimit int, limit int) ([]*EMessage, int64) {
 	var lastMsgid int64
 	lastId, _ := peerStorage.GetLastMessageID(appid, receiver)
+	watermark := peerStorage.Watermark()
 	messages := make([]*EMessage, 0, 10)
 	for {
-		if lastId == 0 {
+		//watermark之前的消息已经被删除
+		if lastId == 0 || lastId < watermark {
 			break
 		}
 
@@ -129,20 +135,22 @@ func (peerStorage *PeerStorage) LoadHistoryMessages(appid int64, receiver int64,
 		if lastMsgid == 0 {
 			lastMsgid = off.msgid
 		}
-		if off.msgid <= syncMsgid {
+		if off.msgid <= syncMsgid || off.msgid < watermark {
 			break
 		}
 
 		msg = peerStorage.LoadMessage(off.msgid)
-		if msg == nil {
+		if msg == nil && !peerStorage.IsRemoved(off.msgid) {
 			break
 		}
-		if msg.cmd != MsgGroupIm &&
-			msg.cmd != MsgGroupNotification &&
-			msg.cmd != MsgIm &&
-			msg.cmd != MsgCustomer &&
-			msg.cmd != MsgCustomerSupport &&
-			msg.cmd != MsgSystem {
+		//压缩时已经被删除的消息
+		if msg == nil ||
+			msg.cmd != MsgGroupIm &&
+				msg.cmd != MsgGroupNotification &&
+				msg.cmd != MsgIm &&
+				msg.cmd != MsgCustomer &&
+				msg.cmd != MsgCustomerSupport &&
+				msg.cmd != MsgSystem || peerStorage.IsErased(msg, off.msgid, appid) {
 			if groupLimit > 0 && len(messages) >= groupLimit {
 				lastId = off.prevPeerMsgid
 			} else {
@@ -177,9 +185,11 @@ func (peerStorage *PeerStorage) LoadHistoryMessages(appid int64, receiver int64,
 
 func (peerStorage *PeerStorage) LoadLatestMessages(appid int64, receiver int64, limit int) []*EMessage {
 	lastId, _ := peerStorage.GetLastMessageID(appid, receiver)
+	watermark := peerStorage.Watermark()
 	messages := make([]*EMessage, 0, 10)
 	for {
-		if lastId == 0 {
+		//watermark之前的消息已经被删除
+		if lastId == 0 || lastId < watermark {
 			break
 		}
 
@@ -206,15 +216,20 @@ func (peerStorage *PeerStorage) LoadLatestMessages(appid int64, receiver int64,
 			prevMsgid = off.prevMsgid
 		}
 
+		if msgid < watermark {
+			break
+		}
 		msg = peerStorage.LoadMessage(msgid)
-		if msg == nil {
+		if msg == nil && !peerStorage.IsRemoved(msgid) {
 			break
 		}
-		if msg.cmd != MsgGroupIm &&
-			msg.cmd != MsgGroupNotification &&
-			msg.cmd != MsgIm &&
-			msg.cmd != MsgCustomer &&
-			msg.cmd != MsgCustomerSupport {
+		//压缩时已经被删除的消息
+		if msg == nil ||
+			msg.cmd != MsgGroupIm &&
+				msg.cmd != MsgGroupNotification &&
+				msg.cmd != MsgIm &&
+				msg.cmd != MsgCustomer &&
+				msg.cmd != MsgCustomerSupport || peerStorage.IsErased(msg, msgid, appid) {
 			lastId = prevMsgid
 			continue
 		}
@@ -249,8 +264,9 @@ func (peerStorage *PeerStorage) GetNewCount(appid int64, uid int64, lastReceived
 	count := 0
 	log.Infof("last id:%d last received id:%d", lastId, lastReceivedId)
 
+	watermark := peerStorage.Watermark()
 	msgid := lastId
-	for msgid > 0 {
+	for msgid > 0 && msgid >= watermark {
 		msg := peerStorage.LoadMessage(msgid)
 		if msg == nil {
 			log.Warningf("load message:%d error\n", msgid)
@@ -268,11 +284,11 @@ func (peerStorage *PeerStorage) GetNewCount(appid int64, uid int64, lastReceived
 		}
 
 		msg = peerStorage.LoadMessage(off.msgid)
-		if msg == nil {
+		if msg == nil && !peerStorage.IsRemoved(off.msgid) {
 			break
 		}
 
-		if !peerStorage.isSender(msg, appid, uid) {
+		if msg != nil && !peerStorage.isSender(msg, appid, uid) && !peerStorage.IsErased(msg, off.msgid, appid) {
 			count += 1
 			break
 		}
@@ -286,7 +302,7 @@ func (peerStorage *PeerStorage) createPeerIndex() {
 	log.Info("create message index begin:", time.Now().UnixNano())
 
 	for i := 0; i <= peerStorage.blockNo; i++ {
-		file := peerStorage.openReadFile(i)
+		file := peerStorage.openBlockReader(i)
 		if file == nil {
 			//历史消息被删除
 			continue
@@ -298,13 +314,15 @@ func (peerStorage *PeerStorage) createPeerIndex() {
 			_ = file.Close()
 			break
 		}
+		version := peerStorage.BlockVersion(i)
+		key := peerStorage.BlockKey(i)
 		for {
 			msgid, err := file.Seek(0, os.SEEK_CUR)
 			if err != nil {
 				log.Info("seek file err:", err)
 				break
 			}
-			msg := peerStorage.ReadMessage(file)
+			msg := peerStorage.ReadMessage(file, version, key)
 			if msg == nil {
 				break
 			}
@@ -323,6 +341,9 @@ func (peerStorage *PeerStorage) createPeerIndex() {
 					_, lastPeerId = peerStorage.getLastMessageID(off.appid, off.receiver)
 				}
 				peerStorage.setLastMessageID(off.appid, off.receiver, msgid, lastPeerId)
+			} else if msg.cmd == MSG_TOMBSTONE {
+				msgid = int64(i)*BlockSize + msgid
+				peerStorage.applyTombstone(msg.body.(*Tombstone), msgid)
 			}
 		}
 
@@ -338,7 +359,7 @@ func (peerStorage *PeerStorage) repairPeerIndex() {
 	off := peerStorage.getBlockOffset(peerStorage.lastId)
 
 	for i := first; i <= peerStorage.blockNo; i++ {
-		file := peerStorage.openReadFile(i)
+		file := peerStorage.openBlockReader(i)
 		if file == nil {
 			//历史消息被删除
 			continue
@@ -355,13 +376,15 @@ func (peerStorage *PeerStorage) repairPeerIndex() {
 			_ = file.Close()
 			break
 		}
+		version := peerStorage.BlockVersion(i)
+		key := peerStorage.BlockKey(i)
 		for {
 			msgid, err := file.Seek(0, os.SEEK_CUR)
 			if err != nil {
 				log.Info("seek file err:", err)
 				break
 			}
-			msg := peerStorage.ReadMessage(file)
+			msg := peerStorage.ReadMessage(file, version, key)
 			if msg == nil {
 				break
 			}
@@ -378,6 +401,9 @@ func (peerStorage *PeerStorage) repairPeerIndex() {
 					_, lastPeerId = peerStorage.getLastMessageID(off.appid, off.receiver)
 				}
 				peerStorage.setLastMessageID(off.appid, off.receiver, msgid, lastPeerId)
+			} else if msg.cmd == MSG_TOMBSTONE {
+				msgid = int64(i)*BlockSize + msgid
+				peerStorage.applyTombstone(msg.body.(*Tombstone), msgid)
 			}
 		}
 
@@ -397,14 +423,23 @@ func (peerStorage *PeerStorage) readPeerIndex() bool {
 		return false
 	}
 	defer file.Close()
+	//索引可以从block重建, 不能解密时重建索引
+	r, err := openIndex(file, "peer_index")
+	if err != nil {
+		log.Error("open peer index err:", err)
+		return false
+	}
 	const IndexSize = 32
 	data := make([]byte, IndexSize*1000)
 
 	for {
-		n, err := file.Read(data)
-		if err != nil {
+		n, err := io.ReadFull(r, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
 			if err != io.EOF {
-				log.Fatal("read err:", err)
+				log.Error("read peer index err:", err)
+				peerStorage.messageIndex = make(map[UserID]*UserIndex)
+				peerStorage.lastId = 0
+				return false
 			}
 			break
 		}
@@ -453,6 +488,10 @@ func (peerStorage *PeerStorage) savePeerIndex(messageIndex map[UserID]*UserIndex
 		log.Fatal("open file:", err)
 	}
 	defer file.Close()
+	w, err := sealIndex(file, "peer_index")
+	if err != nil {
+		log.Fatal("seal peer index err:", err)
+	}
 
 	buffer := new(bytes.Buffer)
 	index := 0
@@ -466,7 +505,7 @@ func (peerStorage *PeerStorage) savePeerIndex(messageIndex map[UserID]*UserIndex
 		//batch write to file
 		if index%1000 == 0 {
 			buf := buffer.Bytes()
-			n, err := file.Write(buf)
+			n, err := w.Write(buf)
 			if err != nil {
 				log.Fatal("write file:", err)
 			}
@@ -479,7 +518,7 @@ func (peerStorage *PeerStorage) savePeerIndex(messageIndex map[UserID]*UserIndex
 	}
 
 	buf := buffer.Bytes()
-	n, err := file.Write(buf)
+	n, err := w.Write(buf)
 	if err != nil {
 		log.Fatal("write file:", err)
 	}
@@ -512,6 +551,7 @@ func (peerStorage *PeerStorage) execMessage(msg *Message, msgid int64) {
 			_, lastPeerId = peerStorage.getLastMessageID(off.appid, off.receiver)
 		}
 		peerStorage.setLastMessageID(off.appid, off.receiver, msgid, lastPeerId)
-
+	} else if msg.cmd == MSG_TOMBSTONE {
+		peerStorage.applyTombstone(msg.body.(*Tombstone), msgid)
 	}
 }
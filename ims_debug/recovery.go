@@ -0,0 +1,174 @@
+package main
+
+import "os"
+import "fmt"
+import "time"
+import "bytes"
+import "encoding/binary"
+import "path/filepath"
+import log "github.com/golang/glog"
+
+//断电之后最后一个block文件的结尾可能是不完整的消息
+//启动时从文件结尾向前找到最后一条完整的消息，之后的内容保存到recovery目录，然后截断文件
+
+const RecoveryDir = "recovery"
+
+//消息在文件中的最大长度 magic|header|body|crc32|magic, 加密的消息增加SealOverhead
+const MaxRecordSize = 4 + 12 + 32*1024 + SealOverhead + 4 + 4
+
+type RecoveryReport struct {
+	Block     int    `json:"block"`
+	Offset    int64  `json:"offset"`    //截断之后的文件大小
+	Msgid     int64  `json:"msgid"`     //截断的位置，之后的消息被丢弃
+	Discarded int64  `json:"discarded"` //丢弃的字节数
+	Backup    string `json:"backup"`    //丢弃内容的备份
+	Time      int64  `json:"time"`
+}
+
+func isMagic(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == Magic
+}
+
+// findRecordEnd data从文件的base位置开始, 返回最后一条完整消息的结束位置, 没有找到时返回-1
+func (storage *StorageFile) findRecordEnd(data []byte, base int64, version int, key *BlockKey) int64 {
+	minSize := 4 + 12 + 4
+	if version != FVersion1 {
+		minSize += 4
+	}
+	for e := len(data); e >= minSize; e-- {
+		if !isMagic(data[e-4 : e]) {
+			continue
+		}
+		for s := e - minSize; s >= 0 && s >= e-MaxRecordSize; s-- {
+			if !isMagic(data[s : s+4]) {
+				continue
+			}
+			r := bytes.NewReader(data[s:e])
+			if storage.ReadMessage(r, version, key) != nil && r.Len() == 0 {
+				return base + int64(e)
+			}
+		}
+	}
+	return -1
+}
+
+// lastRecordEnd 从文件结尾向前查找，每次扩大查找的范围
+func (storage *StorageFile) lastRecordEnd(file *os.File, size int64, version int, key *BlockKey) (int64, error) {
+	window := int64(2 * MaxRecordSize)
+	for {
+		start := size - window
+		if start < HeaderSize {
+			start = HeaderSize
+		}
+		data := make([]byte, size-start)
+		_, err := file.ReadAt(data, start)
+		if err != nil {
+			return 0, err
+		}
+		if end := storage.findRecordEnd(data, start, version, key); end >= 0 {
+			return end, nil
+		}
+		if start == HeaderSize {
+			return HeaderSize, nil
+		}
+		window *= 2
+	}
+}
+
+// recoverFile 截断block结尾不完整的消息，文件完整时返回nil
+func (storage *StorageFile) recoverFile(blockNo int) *RecoveryReport {
+	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Fatal("open file:", err)
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatal("seek file")
+	}
+	if size <= HeaderSize {
+		//文件头不完整时在打开写入文件时截断
+		return nil
+	}
+	_, err = file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		log.Fatal("seek file")
+	}
+	magic, version := storage.ReadHeader(file)
+	if magic != Magic || !isValidVersion(version) {
+		log.Fatalf("block:%d invalid file header magic:%x version:%x", blockNo, magic, version)
+	}
+
+	//data key不可用时不能判断消息是否完整, 不能截断
+	key, err := storage.loadBlockKey(blockNo)
+	if err != nil {
+		log.Fatalf("block:%d load data key err:%s", blockNo, err)
+	}
+
+	end, err := storage.lastRecordEnd(file, size, version, key)
+	if err != nil {
+		log.Fatal("read file err:", err)
+	}
+	if end == size {
+		return nil
+	}
+
+	report, err := storage.truncateBlock(file, blockNo, end, size)
+	if err != nil {
+		log.Fatal("truncate block err:", err)
+	}
+	log.Warningf("block:%d truncated at offset:%d msgid:%d, discarded %d bytes, backup:%s",
+		blockNo, end, report.Msgid, report.Discarded, report.Backup)
+	return report
+}
+
+// truncateBlock 把end之后的内容保存到recovery目录之后截断文件
+func (storage *StorageFile) truncateBlock(file *os.File, blockNo int, end int64, size int64) (*RecoveryReport, error) {
+	tail := make([]byte, size-end)
+	_, err := file.ReadAt(tail, end)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(storage.root, RecoveryDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	backup := filepath.Join(dir, fmt.Sprintf("message_%d_%d_%d", blockNo, end, now))
+	bf, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = bf.Write(tail)
+	if err == nil {
+		err = bf.Sync()
+	}
+	_ = bf.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Truncate(end)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RecoveryReport{
+		Block:     blockNo,
+		Offset:    end,
+		Msgid:     storage.getMsgid(blockNo, int(end)),
+		Discarded: size - end,
+		Backup:    backup,
+		Time:      now,
+	}
+	return report, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestFindRecordEnd(t *testing.T) {
+	for _, version := range []int{FVersion1, FVersion2} {
+		records := [][]byte{
+			EncodeRecord(testMessage(1, "first"), version),
+			EncodeRecord(testMessage(2, "second message"), version),
+			EncodeRecord(testMessage(3, "third"), version),
+		}
+		data := make([]byte, 0)
+		ends := make([]int64, 0)
+		for _, r := range records {
+			data = append(data, r...)
+			ends = append(ends, int64(len(data)))
+		}
+		last := len(records[2])
+
+		tests := []struct {
+			name string
+			data []byte
+			end  int64
+		}{
+			{"complete", data, ends[2]},
+			{"one byte of last record", data[:ends[1]+1], ends[1]},
+			{"half of last record", data[:ends[1]+int64(last/2)], ends[1]},
+			{"last record without tail magic", data[:ends[2]-4], ends[1]},
+			{"last record without one byte", data[:ends[2]-1], ends[1]},
+			{"zero tail", append(append([]byte{}, data...), make([]byte, 100)...), ends[2]},
+			{"partial first record", data[:ends[0]-1], -1},
+			{"empty", data[:0], -1},
+		}
+		storage := new(StorageFile)
+		for _, test := range tests {
+			end := storage.findRecordEnd(test.data, HeaderSize, version, nil)
+			expect := test.end
+			if expect >= 0 {
+				expect += HeaderSize
+			}
+			if end != expect {
+				t.Errorf("version:%x %s end:%d expect:%d", version, test.name, end, expect)
+			}
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import "os"
+import "sort"
+import "sync"
+import "bytes"
+import "errors"
+import "sync/atomic"
+import "encoding/binary"
+import "path/filepath"
+import log "github.com/golang/glog"
+
+//迁移用户离线消息链使用的rpc, 由reshard工具调用
+//源ims冻结迁移中的用户之后复制最后的增量, 然后切换路由, 目标ims上的离线消息链和源ims上的顺序一致
+//客户端本地保存的sync key仍然是源ims上的msgid, 目标ims记录导入的消息在两个ims上的msgid, 同步时转换
+//目标ims返回给导入的用户的msgid带上SyncKeyImported标记, 没有标记的sync key都是源ims上的msgid
+//msgid的对应关系追加写入storage_root/reshard_map, 只保存在执行导入的ims上
+//冻结的用户保存在storage_root/reshard_frozen, 重启之后仍然冻结
+
+const ReshardMapFile = "reshard_map"
+const ReshardFrozenFile = "reshard_frozen"
+
+//reshard_map每一项 appid uid 源msgid 目标msgid = 32字节
+const ReshardMapItemSize = 32
+
+//reshard_frozen每一项 appid uid = 16字节
+const ReshardFrozenItemSize = 16
+
+//目标ims上的msgid作为sync key时的标记, 和im迁移时使用的标记不同
+const SyncKeyImported = int64(1) << 61
+
+//im在迁移期间同步完之前的ims之后，用之前的ims上的msgid从当前ims开始同步时的标记
+//和im_debug/im.go中的定义保持一致
+const SyncKeyPrevStorage = int64(1) << 60
+
+var ErrUserMoving = errors.New("user is moving to another storage")
+
+// MsgidPair 同一条消息在源ims和目标ims上的msgid
+type MsgidPair struct {
+	src int64
+	dst int64
+}
+
+//保护importedMsgids
+var reshardMutex sync.Mutex
+
+//导入的用户的msgid对应关系, 按照src排序, 导入的顺序和源ims上的顺序一致, dst同样是递增的
+var importedMsgids = make(map[UserID][]MsgidPair)
+
+//迁移中的用户, 不再接受新的消息, 由roleMutex保护
+var frozenUsers = make(map[UserID]bool)
+
+// ExportUser messageIndex中的一个用户
+type ExportUser struct {
+	Appid int64
+	Uid   int64
+}
+
+type ExportRequest struct {
+	Appid  int64
+	Uid    int64
+	After  int64 //只导出msgid大于After的消息, 0表示全部
+	Cursor int64 //从该离线消息记录开始向前遍历, 0表示从最新的消息开始
+	Limit  int32
+}
+
+// ExportMessage 离线消息链上的一条消息
+type ExportMessage struct {
+	Msgid    int64 //源ims上的msgid
+	DeviceId int64
+	Flag     int32 //离线消息记录的flag, 包含MessageFlagGroup
+	Cmd      int32
+	Raw      []byte
+}
+
+// ExportResponse Messages按照从新到旧的顺序, Cursor为0表示已经遍历完
+type ExportResponse struct {
+	Messages  []*ExportMessage
+	Cursor    int64
+	LastMsgid int64 //用户最新一条消息的msgid, 0表示不存在该用户
+}
+
+// ImportRequest Messages按照从旧到新的顺序
+type ImportRequest struct {
+	Appid    int64
+	Uid      int64
+	Messages []*ExportMessage
+}
+
+// FreezeRequest 切换路由之前冻结迁移的用户, 复制失败时解除冻结
+type FreezeRequest struct {
+	Users  []*ExportUser
+	Frozen bool
+}
+
+func (peerStorage *PeerStorage) GetUsers() []*ExportUser {
+	peerStorage.mutex.Lock()
+	defer peerStorage.mutex.Unlock()
+	users := make([]*ExportUser, 0, len(peerStorage.messageIndex))
+	for id := range peerStorage.messageIndex {
+		users = append(users, &ExportUser{id.appid, id.uid})
+	}
+	return users
+}
+
+// ExportMessages 沿着OfflineMessage2的prevMsgid向前遍历，最多返回limit条消息
+func (peerStorage *PeerStorage) ExportMessages(appid int64, uid int64, after int64, cursor int64, limit int) *ExportResponse {
+	lastId, _ := peerStorage.GetLastMessageID(appid, uid)
+	resp := &ExportResponse{Messages: make([]*ExportMessage, 0, 10)}
+	if cursor == 0 {
+		cursor = lastId
+	}
+	for cursor > 0 {
+		if limit > 0 && len(resp.Messages) >= limit {
+			resp.Cursor = cursor
+			break
+		}
+
+		msg := peerStorage.LoadMessage(cursor)
+		if msg == nil {
+			log.Warning("load offline message err:", cursor)
+			break
+		}
+
+		var off *OfflineMessage2
+		if msg.cmd == MSG_OFFLINE {
+			off1 := msg.body.(*OfflineMessage)
+			off = &OfflineMessage2{
+				appid:         off1.appid,
+				receiver:      off1.receiver,
+				msgid:         off1.msgid,
+				deviceId:      off1.deviceId,
+				prevMsgid:     off1.prevMsgid,
+				prevPeerMsgid: off1.prevMsgid,
+			}
+		} else if msg.cmd == MSG_OFFLINE_V2 {
+			off = msg.body.(*OfflineMessage2)
+		} else {
+			log.Warning("invalid message cmd:", msg.cmd)
+			break
+		}
+		if resp.LastMsgid == 0 {
+			resp.LastMsgid = off.msgid
+		}
+		if off.msgid <= after {
+			break
+		}
+		flag := msg.flag
+
+		msg = peerStorage.LoadMessage(off.msgid)
+		if msg == nil && peerStorage.IsRemoved(off.msgid) {
+			//压缩时已经被删除
+			cursor = off.prevMsgid
+			continue
+		}
+		if msg == nil {
+			log.Warning("load message err:", off.msgid)
+			break
+		}
+
+		msg.version = DefaultVersion
+		em := &ExportMessage{
+			Msgid:    off.msgid,
+			DeviceId: off.deviceId,
+			Flag:     int32(flag),
+			Cmd:      int32(msg.cmd),
+			Raw:      msg.ToData(),
+		}
+		resp.Messages = append(resp.Messages, em)
+		cursor = off.prevMsgid
+	}
+	return resp
+}
+
+// ImportMessages 按顺序追加到用户的离线消息链上，返回新的msgid
+func (peerStorage *PeerStorage) ImportMessages(appid int64, uid int64, messages []*ExportMessage) []int64 {
+	msgids := make([]int64, 0, len(messages))
+	for _, em := range messages {
+		msg := &Message{cmd: int(em.Cmd), version: DefaultVersion}
+		if !msg.FromData(em.Raw) {
+			log.Warningf("invalid message appid:%d uid:%d msgid:%d", appid, uid, em.Msgid)
+			msgids = append(msgids, 0)
+			continue
+		}
+		msg.flag |= int(em.Flag) & MessageFlagGroup
+		msgid := peerStorage.SavePeerMessage(appid, uid, em.DeviceId, msg)
+		msgids = append(msgids, msgid)
+	}
+	return msgids
+}
+
+// addImportedMsgids 需要持有reshardMutex, 重复的src被忽略
+func addImportedMsgids(id UserID, pairs []MsgidPair) {
+	imported := importedMsgids[id]
+	for _, p := range pairs {
+		if p.dst == 0 {
+			continue
+		}
+		i := sort.Search(len(imported), func(i int) bool { return imported[i].src >= p.src })
+		if i < len(imported) && imported[i].src == p.src {
+			continue
+		}
+		imported = append(imported, MsgidPair{})
+		copy(imported[i+1:], imported[i:])
+		imported[i] = p
+	}
+	importedMsgids[id] = imported
+}
+
+func encodeImportedMsgids(id UserID, pairs []MsgidPair) []byte {
+	buffer := new(bytes.Buffer)
+	for _, p := range pairs {
+		binary.Write(buffer, binary.BigEndian, id.appid)
+		binary.Write(buffer, binary.BigEndian, id.uid)
+		binary.Write(buffer, binary.BigEndian, p.src)
+		binary.Write(buffer, binary.BigEndian, p.dst)
+	}
+	return buffer.Bytes()
+}
+
+// LoadReshardMap 启动时读取之前导入的msgid对应关系
+func LoadReshardMap(root string) {
+	data, err := os.ReadFile(filepath.Join(root, ReshardMapFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("read reshard map err:", err)
+		}
+		return
+	}
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	buffer := bytes.NewBuffer(data)
+	count := 0
+	for buffer.Len() >= ReshardMapItemSize {
+		id := UserID{}
+		p := MsgidPair{}
+		binary.Read(buffer, binary.BigEndian, &id.appid)
+		binary.Read(buffer, binary.BigEndian, &id.uid)
+		binary.Read(buffer, binary.BigEndian, &p.src)
+		binary.Read(buffer, binary.BigEndian, &p.dst)
+		addImportedMsgids(id, []MsgidPair{p})
+		count++
+	}
+	log.Infof("reshard map users:%d messages:%d", len(importedMsgids), count)
+}
+
+// SaveImportedMsgids 写入磁盘之后才更新内存中的对应关系
+func SaveImportedMsgids(root string, appid int64, uid int64, pairs []MsgidPair) error {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	id := UserID{appid, uid}
+	file, err := os.OpenFile(filepath.Join(root, ReshardMapFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(encodeImportedMsgids(id, pairs))
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	addImportedMsgids(id, pairs)
+	return nil
+}
+
+// TranslateSyncKey 把客户端保存的源ims上的msgid转换为目标ims上的msgid, 不是导入的用户时不变
+// 带SyncKeyImported标记的sync key是目标ims上的msgid, 去掉标记之后不需要转换
+// 带SyncKeyPrevStorage标记的sync key是之前的ims上的msgid, 没有导入的用户从头开始同步
+func TranslateSyncKey(appid int64, uid int64, syncKey int64) int64 {
+	if syncKey&SyncKeyImported != 0 {
+		return syncKey &^ (SyncKeyImported | SyncKeyPrevStorage)
+	}
+	prev := syncKey&SyncKeyPrevStorage != 0
+	syncKey &^= SyncKeyPrevStorage
+	if syncKey == 0 {
+		return 0
+	}
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	imported, ok := importedMsgids[UserID{appid, uid}]
+	if !ok || len(imported) == 0 {
+		if prev {
+			return 0
+		}
+		return syncKey
+	}
+
+	i := sort.Search(len(imported), func(i int) bool { return imported[i].src >= syncKey })
+	if i < len(imported) && imported[i].src == syncKey {
+		return imported[i].dst
+	}
+	//源ims上压缩时被删除没有导出的消息, 从之前最近的一条消息开始同步
+	if i == 0 {
+		return 0
+	}
+	return imported[i-1].dst
+}
+
+// TagSyncKey 导入的用户的msgid带上标记
+func TagSyncKey(appid int64, uid int64, msgid int64) int64 {
+	if msgid == 0 {
+		return 0
+	}
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	if len(importedMsgids[UserID{appid, uid}]) == 0 {
+		return msgid
+	}
+	return msgid | SyncKeyImported
+}
+
+// LoadFrozenUsers 启动时读取迁移中被冻结的用户
+func LoadFrozenUsers(root string) {
+	data, err := os.ReadFile(filepath.Join(root, ReshardFrozenFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("read reshard frozen users err:", err)
+		}
+		return
+	}
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+	buffer := bytes.NewBuffer(data)
+	for buffer.Len() >= ReshardFrozenItemSize {
+		id := UserID{}
+		binary.Read(buffer, binary.BigEndian, &id.appid)
+		binary.Read(buffer, binary.BigEndian, &id.uid)
+		frozenUsers[id] = true
+	}
+	log.Infof("reshard frozen users:%d", len(frozenUsers))
+}
+
+// saveFrozenUsers 写入临时文件之后替换, 需要持有roleMutex
+func saveFrozenUsers(root string, users map[UserID]bool) error {
+	buffer := new(bytes.Buffer)
+	for id := range users {
+		binary.Write(buffer, binary.BigEndian, id.appid)
+		binary.Write(buffer, binary.BigEndian, id.uid)
+	}
+
+	path := filepath.Join(root, ReshardFrozenFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buffer.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// isFrozen 需要持有roleMutex
+func isFrozen(appid int64, uid int64) bool {
+	return frozenUsers[UserID{appid, uid}]
+}
+
+// FreezeUsers 等待正在写入的消息完成之后返回, 之后迁移的用户的消息写入失败, im重新加载路由之后写入目标ims
+func FreezeUsers(addr string, r *FreezeRequest) (int, error) {
+	atomic.AddInt64(&serverSummary.requestCount, 1)
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+	users := make(map[UserID]bool, len(frozenUsers)+len(r.Users))
+	for id := range frozenUsers {
+		users[id] = true
+	}
+	for _, u := range r.Users {
+		id := UserID{u.Appid, u.Uid}
+		if r.Frozen {
+			users[id] = true
+		} else {
+			delete(users, id)
+		}
+	}
+	//写入磁盘之后才生效, 重启之后不会解除冻结
+	if err := saveFrozenUsers(config.storageRoot, users); err != nil {
+		log.Error("save reshard frozen users err:", err)
+		return 0, err
+	}
+	frozenUsers = users
+	log.Infof("freeze users:%d frozen:%t total:%d", len(r.Users), r.Frozen, len(frozenUsers))
+	return len(frozenUsers), nil
+}
+
+func ListUsers(addr string, appid int64) []*ExportUser {
+	atomic.AddInt64(&serverSummary.requestCount, 1)
+	users := storage.GetUsers()
+	if appid == 0 {
+		return users
+	}
+	r := make([]*ExportUser, 0, len(users))
+	for _, u := range users {
+		if u.Appid == appid {
+			r = append(r, u)
+		}
+	}
+	return r
+}
+
+func ExportUserMessages(addr string, r *ExportRequest) *ExportResponse {
+	atomic.AddInt64(&serverSummary.requestCount, 1)
+	resp := storage.ExportMessages(r.Appid, r.Uid, r.After, r.Cursor, int(r.Limit))
+	log.Infof("export appid:%d uid:%d after:%d cursor:%d messages:%d next cursor:%d",
+		r.Appid, r.Uid, r.After, r.Cursor, len(resp.Messages), resp.Cursor)
+	return resp
+}
+
+func ImportUserMessages(addr string, r *ImportRequest) ([]int64, error) {
+	atomic.AddInt64(&serverSummary.requestCount, 1)
+	if err := LockWrite(); err != nil {
+		return nil, err
+	}
+	defer UnlockWrite()
+	msgids := storage.ImportMessages(r.Appid, r.Uid, r.Messages)
+	log.Infof("import appid:%d uid:%d messages:%d", r.Appid, r.Uid, len(msgids))
+
+	pairs := make([]MsgidPair, 0, len(msgids))
+	for i, msgid := range msgids {
+		pairs = append(pairs, MsgidPair{r.Messages[i].Msgid, msgid})
+	}
+	if err := SaveImportedMsgids(config.storageRoot, r.Appid, r.Uid, pairs); err != nil {
+		log.Error("save reshard map err:", err)
+		return nil, err
+	}
+	return msgids, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import "os"
+import "fmt"
+import "time"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//消息保留策略: master删除超过retention_days天或者超过retention_size总大小的最早的block文件
+//watermark之前的消息已经被删除，读取历史消息时到watermark为止
+//master删除block之后把watermark同步给slave, slave删除同样的block
+//旧版本的slave不能解析watermark, 只发送给SyncHeartbeatVersion之后的slave, 使用之前需要先升级所有的slave
+
+const MSG_STORAGE_SYNC_WATERMARK = 232 //master->slave SyncCursor, 之前的消息已经被删除, 只发送给SyncHeartbeatVersion之后的slave
+
+//检查保留策略的间隔
+const RetentionInterval = 10 * time.Minute
+
+func init() {
+	messageCreators[MSG_STORAGE_SYNC_WATERMARK] = func() IMessage { return new(SyncCursor) }
+	messageDescriptions[MSG_STORAGE_SYNC_WATERMARK] = "MSG_STORAGE_SYNC_WATERMARK"
+}
+
+// Watermark 第一条没有被删除的消息，之前的block文件已经被删除
+func (storage *StorageFile) Watermark() int64 {
+	return atomic.LoadInt64(&storage.watermark)
+}
+
+// expireBlocks 删除blockNo之前的block, 当前写入的block不会删除, 需要持有storage.mutex
+func (storage *StorageFile) expireBlocks(blockNo int) []int {
+	deleted := make([]int, 0)
+	for _, b := range storage.listBlocks() {
+		if b >= blockNo || b >= storage.blockNo {
+			break
+		}
+		storage.files.Remove(b)
+		path := fmt.Sprintf("%s/message_%d", storage.root, b)
+		err := os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			err = storage.removeArchive(b)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("remove block err:", err)
+			break
+		}
+		invalidateChecksum(b)
+		deleted = append(deleted, b)
+	}
+	storage.resetBlockVersions()
+	return deleted
+}
+
+// SetWatermark 删除watermark之前的block和索引
+// slave落后于watermark时之前的消息已经无法同步，从watermark所在的block开始写入
+func (storage *Storage) SetWatermark(watermark int64) {
+	storage.mutex.Lock()
+	if watermark <= storage.Watermark() {
+		storage.mutex.Unlock()
+		return
+	}
+
+	blockNo := storage.getBlockNo(watermark)
+	if blockNo > storage.blockNo {
+		log.Warningf("block:%d is behind watermark:%d", storage.blockNo, watermark)
+		err := storage.file.Sync()
+		if err != nil {
+			log.Fatalln("sync storage file:", err)
+		}
+		storage.file.Close()
+		storage.openWriteFile(blockNo, newBlockVersion())
+	}
+	deleted := storage.expireBlocks(blockNo)
+	atomic.StoreInt64(&storage.watermark, watermark)
+
+	pruned := 0
+	for id, ui := range storage.messageIndex {
+		if ui.lastId < watermark {
+			delete(storage.messageIndex, id)
+			pruned++
+		}
+	}
+	tombstones := storage.pruneTombstones(watermark)
+	storage.mutex.Unlock()
+
+	log.Warningf("watermark:%d deleted blocks:%v pruned users:%d tombstones:%d", watermark, deleted, pruned, tombstones)
+}
+
+// ApplyRetention 按照保留策略删除最早的已经写满的block, 返回新的watermark, 没有删除时返回0
+func (storage *Storage) ApplyRetention(days int, size int64) int64 {
+	if days <= 0 && size <= 0 {
+		return 0
+	}
+
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+
+	type blockInfo struct {
+		blockNo int
+		size    int64
+		modTime time.Time
+	}
+	blocks := make([]*blockInfo, 0)
+	var total int64
+	for _, b := range storage.listBlocks() {
+		info, err := storage.statBlock(b)
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, &blockInfo{b, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	expire := -1
+	deadline := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	for _, b := range blocks {
+		if b.blockNo >= current {
+			break
+		}
+		//已经写满的block的修改时间是最后一条消息的时间
+		old := days > 0 && b.modTime.Before(deadline)
+		large := size > 0 && total > size
+		if !old && !large {
+			break
+		}
+		total -= b.size
+		expire = b.blockNo
+	}
+	if expire < 0 {
+		return 0
+	}
+
+	watermark := storage.getMsgid(expire+1, HeaderSize)
+	storage.SetWatermark(watermark)
+	return watermark
+}
+
+// SendWatermark 通知slave删除watermark之前的block
+func (master *Master) SendWatermark(watermark int64) {
+	m := &Message{cmd: MSG_STORAGE_SYNC_WATERMARK, body: &SyncCursor{msgid: watermark}}
+	for c := range master.CloneClientSet() {
+		if c.version < SyncHeartbeatVersion {
+			continue
+		}
+		c.ewt <- m
+	}
+}
+
+// RetentionLoop 只有master执行保留策略，slave跟随master的watermark
+func RetentionLoop() {
+	ticker := time.NewTicker(RetentionInterval)
+	for range ticker.C {
+		roleMutex.RLock()
+		isSlave := slave != nil
+		roleMutex.RUnlock()
+		if isSlave {
+			continue
+		}
+
+		watermark := storage.ApplyRetention(config.retentionDays, config.retentionSize)
+		if watermark > 0 {
+			master.SendWatermark(watermark)
+		}
+	}
+}
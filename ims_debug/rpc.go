@@ -1,15 +1,17 @@
 package main
 
 import "sync/atomic"
+import log "github.com/golang/glog"
 
 func SyncMessage(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 	atomic.AddInt64(&serverSummary.requestCount, 1)
-	messages, lastMsgid := storage.LoadHistoryMessages(syncKey.Appid, syncKey.Uid, syncKey.LastMsgid, config.groupLimit, config.limit)
+	lastId := TranslateSyncKey(syncKey.Appid, syncKey.Uid, syncKey.LastMsgid)
+	messages, lastMsgid := storage.LoadHistoryMessages(syncKey.Appid, syncKey.Uid, lastId, config.groupLimit, config.limit)
 
 	historyMessages := make([]*HistoryMessage, 0, 10)
 	for _, emsg := range messages {
 		hm := &HistoryMessage{}
-		hm.Msgid = emsg.msgid
+		hm.Msgid = TagSyncKey(syncKey.Appid, syncKey.Uid, emsg.msgid)
 		hm.DeviceId = emsg.deviceId
 		hm.Cmd = int32(emsg.msg.cmd)
 
@@ -18,21 +20,34 @@ func SyncMessage(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 		historyMessages = append(historyMessages, hm)
 	}
 
-	return &PeerHistoryMessage{historyMessages, lastMsgid}
+	return &PeerHistoryMessage{historyMessages, TagSyncKey(syncKey.Appid, syncKey.Uid, lastMsgid)}
 }
 
 func SavePeerMessage(addr string, m *PeerMessage) (int64, error) {
 	atomic.AddInt64(&serverSummary.requestCount, 1)
+	if err := LockWrite(); err != nil {
+		return 0, err
+	}
+	if isFrozen(m.Appid, m.Uid) {
+		UnlockWrite()
+		return 0, ErrUserMoving
+	}
 	atomic.AddInt64(&serverSummary.peerMessageCount, 1)
 	msg := &Message{cmd: int(m.Cmd), version: DefaultVersion}
 	msg.FromData(m.Raw)
 	msgid := storage.SavePeerMessage(m.Appid, m.Uid, m.DeviceId, msg)
-	return msgid, nil
+	//离线消息的索引在消息之后写入
+	lastId, _ := storage.GetLastMessageID(m.Appid, m.Uid)
+	UnlockWrite()
+
+	WaitSyncAck(lastId)
+	return TagSyncKey(m.Appid, m.Uid, msgid), nil
 }
 
 func GetNewCount(addr string, syncKey *SyncHistory) (int64, error) {
 	atomic.AddInt64(&serverSummary.requestCount, 1)
-	count := storage.GetNewCount(syncKey.Appid, syncKey.Uid, syncKey.LastMsgid)
+	lastId := TranslateSyncKey(syncKey.Appid, syncKey.Uid, syncKey.LastMsgid)
+	count := storage.GetNewCount(syncKey.Appid, syncKey.Uid, lastId)
 	return int64(count), nil
 }
 
@@ -43,7 +58,7 @@ func GetLatestMessage(addr string, r *HistoryRequest) []*HistoryMessage {
 	historyMessages := make([]*HistoryMessage, 0, 10)
 	for _, emsg := range messages {
 		hm := &HistoryMessage{}
-		hm.Msgid = emsg.msgid
+		hm.Msgid = TagSyncKey(r.Appid, r.Uid, emsg.msgid)
 		hm.DeviceId = emsg.deviceId
 		hm.Cmd = int32(emsg.msg.cmd)
 
@@ -53,3 +68,40 @@ func GetLatestMessage(addr string, r *HistoryRequest) []*HistoryMessage {
 	}
 	return historyMessages
 }
+
+func GetReplicaStatus() *ReplicaStatus {
+	roleMutex.RLock()
+	defer roleMutex.RUnlock()
+	status := &ReplicaStatus{NextMsgid: storage.NextMsgid(), Epoch: epoch, Fenced: fenced}
+	if slave != nil {
+		status.IsSlave = true
+		status.Staleness = slave.Staleness()
+		status.Master = slave.addr
+	}
+	return status
+}
+
+// FenceMaster 停止master的写入，返回时的NextMsgid是slave需要同步到的位置
+func FenceMaster(addr string, epoch int64) (*ReplicaStatus, error) {
+	log.Infof("fence from:%s epoch:%d", addr, epoch)
+	if err := Fence(epoch); err != nil {
+		return nil, err
+	}
+	return GetReplicaStatus(), nil
+}
+
+func PromoteSlave(addr string, r *PromoteRequest) (*ReplicaStatus, error) {
+	log.Infof("promote from:%s epoch:%d master msgid:%d force:%t", addr, r.Epoch, r.MasterMsgid, r.Force)
+	if err := Promote(r); err != nil {
+		return nil, err
+	}
+	return GetReplicaStatus(), nil
+}
+
+func ReplicateMaster(addr string, r *ReplicateRequest) (*ReplicaStatus, error) {
+	log.Infof("replicate from:%s master:%s epoch:%d", addr, r.MasterAddress, r.Epoch)
+	if err := Replicate(r); err != nil {
+		return nil, err
+	}
+	return GetReplicaStatus(), nil
+}
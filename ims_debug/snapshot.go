@@ -0,0 +1,333 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "bytes"
+import "time"
+import "errors"
+import "path/filepath"
+import "encoding/binary"
+import log "github.com/golang/glog"
+
+//新的slave通过快照同步: master发送已经写入的block文件和同一时刻的peer_index
+//之后从快照的位置开始同步新的消息
+
+const MSG_STORAGE_SYNC_SNAPSHOT_BEGIN = 225 //slave->master 请求快照, 旧版本的master会断开连接
+const MSG_STORAGE_SYNC_BLOCK = 226          //master->slave block文件的内容
+const MSG_STORAGE_SYNC_INDEX = 227          //master->slave peer_index的内容
+const MSG_STORAGE_SYNC_SNAPSHOT_END = 228   //master->slave 快照结束, 之后是快照位置之后的消息
+
+const SnapshotChunkSize = 1024 * 1024
+
+//等待master回复快照请求的时间
+const SnapshotHandshakeTimeout = 10 * time.Second
+
+//slave接收快照的临时目录
+const SnapshotDir = "snapshot"
+
+func init() {
+	messageCreators[MSG_STORAGE_SYNC_SNAPSHOT_BEGIN] = func() IMessage { return new(SyncCursor) }
+	messageCreators[MSG_STORAGE_SYNC_BLOCK] = func() IMessage { return new(SyncBlock) }
+	messageCreators[MSG_STORAGE_SYNC_INDEX] = func() IMessage { return new(SyncIndex) }
+	messageCreators[MSG_STORAGE_SYNC_SNAPSHOT_END] = func() IMessage { return new(SyncCursor) }
+
+	messageDescriptions[MSG_STORAGE_SYNC_SNAPSHOT_BEGIN] = "MSG_STORAGE_SYNC_SNAPSHOT_BEGIN"
+	messageDescriptions[MSG_STORAGE_SYNC_BLOCK] = "MSG_STORAGE_SYNC_BLOCK"
+	messageDescriptions[MSG_STORAGE_SYNC_INDEX] = "MSG_STORAGE_SYNC_INDEX"
+	messageDescriptions[MSG_STORAGE_SYNC_SNAPSHOT_END] = "MSG_STORAGE_SYNC_SNAPSHOT_END"
+}
+
+//region SyncBlock
+
+type SyncBlock struct {
+	blockNo int32
+	offset  int64
+	data    []byte
+}
+
+func (block *SyncBlock) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, block.blockNo)
+	binary.Write(buffer, binary.BigEndian, block.offset)
+	buffer.Write(block.data)
+	return buffer.Bytes()
+}
+
+func (block *SyncBlock) FromData(buff []byte) bool {
+	if len(buff) < 12 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &block.blockNo)
+	binary.Read(buffer, binary.BigEndian, &block.offset)
+	block.data = buff[12:]
+	return true
+}
+
+//endregion
+
+//region SyncIndex
+
+//格式和peer_index文件相同，每一项32字节
+type SyncIndex struct {
+	data []byte
+}
+
+func (index *SyncIndex) ToData() []byte {
+	return index.data
+}
+
+func (index *SyncIndex) FromData(buff []byte) bool {
+	if len(buff)%32 != 0 {
+		return false
+	}
+	index.data = buff
+	return true
+}
+
+//endregion
+
+// Snapshot 同一时刻的写入位置, 消息索引和tombstone
+func (storage *Storage) Snapshot() (int64, map[UserID]*UserIndex, map[UserID]int64) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	offset, err := storage.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return offset + int64(storage.blockNo)*BlockSize, storage.clonePeerIndex(), storage.cloneTombstones()
+}
+
+func (storage *Storage) isEmpty() bool {
+	offset, err := storage.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return storage.blockNo == 0 && offset <= HeaderSize && len(storage.messageIndex) == 0
+}
+
+// IsEmpty 没有任何消息，新的slave
+func (storage *Storage) IsEmpty() bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.isEmpty()
+}
+
+// sendBlock 发送block文件的前size个字节, 压缩的block按照压缩之前的格式发送
+func (client *SyncClient) sendBlock(blockNo int, size int64, seq *int) error {
+	file := storage.openBlockReader(blockNo)
+	if file == nil {
+		//历史消息被删除
+		return nil
+	}
+	defer file.Close()
+
+	buf := make([]byte, SnapshotChunkSize)
+	var offset int64
+	for size < 0 || offset < size {
+		n := int64(len(buf))
+		if size >= 0 && size-offset < n {
+			n = size - offset
+		}
+		m, err := io.ReadFull(file, buf[:n])
+		if m > 0 {
+			*seq = *seq + 1
+			block := &SyncBlock{blockNo: int32(blockNo), offset: offset, data: buf[:m]}
+			err := SendMessage(client.conn, &Message{cmd: MSG_STORAGE_SYNC_BLOCK, seq: *seq, body: block})
+			if err != nil {
+				return err
+			}
+			offset += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendSnapshot 发送快照，返回快照的位置
+func (client *SyncClient) SendSnapshot(seq *int) (int64, error) {
+	msgid, index, tombstones := storage.Snapshot()
+	lastBlock := storage.getBlockNo(msgid)
+	log.Infof("send snapshot msgid:%d blocks:%d users:%d tombstones:%d", msgid, lastBlock+1, len(index), len(tombstones))
+
+	//之前的block文件不会再改变，当前的block只发送快照位置之前的部分
+	for i := 0; i < lastBlock; i++ {
+		if err := client.sendBlock(i, -1, seq); err != nil {
+			return 0, err
+		}
+	}
+	if err := client.sendBlock(lastBlock, int64(storage.getBlockOffset(msgid)), seq); err != nil {
+		return 0, err
+	}
+
+	buffer := new(bytes.Buffer)
+	flush := func() error {
+		*seq = *seq + 1
+		msg := &Message{cmd: MSG_STORAGE_SYNC_INDEX, seq: *seq, body: &SyncIndex{buffer.Bytes()}}
+		err := SendMessage(client.conn, msg)
+		buffer.Reset()
+		return err
+	}
+	for id, value := range index {
+		binary.Write(buffer, binary.BigEndian, id.appid)
+		binary.Write(buffer, binary.BigEndian, id.uid)
+		binary.Write(buffer, binary.BigEndian, value.lastId)
+		binary.Write(buffer, binary.BigEndian, value.lastPeerId)
+		if buffer.Len() >= SnapshotChunkSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if buffer.Len() > 0 {
+		if err := flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(tombstones) > 0 {
+		*seq = *seq + 1
+		msg := &Message{cmd: MSG_STORAGE_SYNC_TOMBSTONE, seq: *seq, body: &SyncTombstone{encodeTombstones(tombstones)}}
+		if err := SendMessage(client.conn, msg); err != nil {
+			return 0, err
+		}
+	}
+
+	*seq = *seq + 1
+	err := SendMessage(client.conn, &Message{cmd: MSG_STORAGE_SYNC_SNAPSHOT_END, seq: *seq, body: &SyncCursor{msgid: msgid}})
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("send snapshot msgid:%d done", msgid)
+	return msgid, nil
+}
+
+// SnapshotReceiver slave接收快照，block文件先写入临时目录，结束之后再替换
+type SnapshotReceiver struct {
+	dir   string
+	file  *os.File
+	block int
+	index map[UserID]*UserIndex
+
+	tombstones map[UserID]int64
+}
+
+func NewSnapshotReceiver(root string) (*SnapshotReceiver, error) {
+	dir := filepath.Join(root, SnapshotDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &SnapshotReceiver{dir: dir, block: -1, index: make(map[UserID]*UserIndex), tombstones: make(map[UserID]int64)}
+	return r, nil
+}
+
+func (r *SnapshotReceiver) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Sync()
+	_ = r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *SnapshotReceiver) WriteBlock(block *SyncBlock) error {
+	if int(block.blockNo) != r.block {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		path := fmt.Sprintf("%s/message_%d", r.dir, block.blockNo)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		r.file = file
+		r.block = int(block.blockNo)
+	}
+	offset, err := r.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if offset != block.offset {
+		return fmt.Errorf("block:%d offset:%d expect:%d", block.blockNo, block.offset, offset)
+	}
+	_, err = r.file.Write(block.data)
+	return err
+}
+
+func (r *SnapshotReceiver) WriteIndex(index *SyncIndex) {
+	buffer := bytes.NewBuffer(index.data)
+	for buffer.Len() >= 32 {
+		id := UserID{}
+		ui := &UserIndex{}
+		binary.Read(buffer, binary.BigEndian, &id.appid)
+		binary.Read(buffer, binary.BigEndian, &id.uid)
+		binary.Read(buffer, binary.BigEndian, &ui.lastId)
+		binary.Read(buffer, binary.BigEndian, &ui.lastPeerId)
+		r.index[id] = ui
+	}
+}
+
+func (r *SnapshotReceiver) WriteTombstone(t *SyncTombstone) {
+	decodeTombstones(t.data, r.tombstones)
+}
+
+// Install 快照接收完成，替换当前的存储
+func (r *SnapshotReceiver) Install(msgid int64) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	if storage.getBlockNo(msgid) != r.block && r.block >= 0 {
+		return errors.New("snapshot incomplete")
+	}
+	return storage.InstallSnapshot(r.dir, msgid, r.index, r.tombstones)
+}
+
+func (storage *Storage) InstallSnapshot(dir string, msgid int64, index map[UserID]*UserIndex, tombstones map[UserID]int64) error {
+	storage.mutex.Lock()
+	if !storage.isEmpty() {
+		storage.mutex.Unlock()
+		return errors.New("storage isn't empty")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "message_*"))
+	if err != nil {
+		storage.mutex.Unlock()
+		return err
+	}
+	_ = storage.file.Close()
+	for storage.files.Len() > 0 {
+		storage.files.RemoveOldest()
+	}
+	//空的block 0由快照中的文件替换，快照中没有时删除
+	_ = os.Remove(fmt.Sprintf("%s/message_0", storage.root))
+	for _, f := range files {
+		err = os.Rename(f, filepath.Join(storage.root, filepath.Base(f)))
+		if err != nil {
+			log.Fatal("rename snapshot file err:", err)
+		}
+	}
+	storage.resetBlockVersions()
+	storage.openWriteFile(storage.getBlockNo(msgid), newBlockVersion())
+
+	storage.messageIndex = make(map[UserID]*UserIndex)
+	for id, ui := range index {
+		storage.setLastMessageID(id.appid, id.uid, ui.lastId, ui.lastPeerId)
+	}
+	storage.tombstones = make(map[UserID]int64)
+	storage.setTombstones(tombstones)
+	storage.mutex.Unlock()
+
+	storage.flushIndex()
+	_ = os.RemoveAll(dir)
+	log.Infof("install snapshot msgid:%d users:%d next msgid:%d", msgid, len(index), storage.NextMsgid())
+	return nil
+}
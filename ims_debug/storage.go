@@ -1,7 +1,6 @@
 package main
 
 import "os"
-import "bytes"
 
 import log "github.com/golang/glog"
 
@@ -10,16 +9,25 @@ type Storage struct {
 	*PeerStorage
 }
 
-func NewStorage(root string) *Storage {
-	f := NewStorageFile(root)
+func NewStorage(root string, archiveRoot string) *Storage {
+	f := NewStorageFile(root, archiveRoot)
 	ps := NewPeerStorage(f)
 
 	storage := &Storage{f, ps}
 
 	r1 := storage.readPeerIndex()
+	if r1 && f.recovery != nil && storage.lastId >= f.recovery.Msgid {
+		//索引中包含被截断的消息，重新创建索引
+		log.Warningf("index last id:%d is truncated, recreate index", storage.lastId)
+		storage.messageIndex = make(map[UserID]*UserIndex)
+		storage.lastId = 0
+		r1 = false
+	}
 	storage.lastSavedId = storage.lastId
 
 	if r1 {
+		//tombstone_index和peer_index同时保存, 索引重建时从block中的tombstone恢复
+		storage.setTombstones(storage.readTombstoneIndex())
 		storage.repairPeerIndex()
 	} else {
 		storage.createPeerIndex()
@@ -52,20 +60,30 @@ func (storage *Storage) ExecMessage(msg *Message, msgid int64) {
 
 func (storage *Storage) SaveSyncMessageBatch(mb *MessageBatch) error {
 	id := mb.firstId
-	//all message come from one block
-	for _, m := range mb.messages {
+	for i, m := range mb.messages {
+		if mb.crcs != nil && MessageChecksum(m) != mb.crcs[i] {
+			log.Errorf("sync message:%d crc err", id)
+			return ErrChecksum
+		}
+		size := RecordSize(m, mb.version)
+		if int64(storage.getBlockOffset(id))+size > BlockSize {
+			//旧版本的master发送的batch可能跨越block, 和master写入时一样切换到下一个block
+			id = storage.getMsgid(storage.getBlockNo(id)+1, HeaderSize)
+		}
 		emsg := &EMessage{id, 0, m}
-		buffer := new(bytes.Buffer)
-		storage.WriteMessage(buffer, m)
-		id += int64(buffer.Len())
-		storage.SaveSyncMessage(emsg)
+		id += size
+		err := storage.SaveSyncMessage(emsg, mb.version)
+		if err != nil {
+			return err
+		}
 	}
 
 	log.Infof("save batch sync message first id:%d last id:%d\n", mb.firstId, mb.lastId)
 	return nil
 }
 
-func (storage *Storage) SaveSyncMessage(emsg *EMessage) error {
+// SaveSyncMessage version是master上block文件的格式
+func (storage *Storage) SaveSyncMessage(emsg *EMessage, version int) error {
 	storage.mutex.Lock()
 	defer storage.mutex.Unlock()
 
@@ -78,8 +96,12 @@ func (storage *Storage) SaveSyncMessage(emsg *EMessage) error {
 	}
 
 	if (n - storage.blockNo) == 1 {
+		err := storage.file.Sync()
+		if err != nil {
+			log.Fatalln("sync storage file:", err)
+		}
 		storage.file.Close()
-		storage.openWriteFile(n)
+		storage.openWriteFile(n, version)
 	}
 
 	offset, err := storage.file.Seek(0, os.SEEK_END)
@@ -90,7 +112,18 @@ func (storage *Storage) SaveSyncMessage(emsg *EMessage) error {
 	if o < int(offset) {
 		log.Warning("skip msg:", emsg.msgid)
 		return nil
-	} else if o > int(offset) {
+	}
+
+	if storage.version != version {
+		//新的slave第一次同步或者master升级之前的block
+		err = storage.resetWriteFile(version)
+		if err != nil {
+			log.Error("block version mismatch:", err)
+			return err
+		}
+	}
+
+	if o > int(offset) {
 		log.Warning("write padding:", o-int(offset))
 		padding := make([]byte, o-int(offset))
 		_, err = storage.file.Write(padding)
@@ -99,7 +132,12 @@ func (storage *Storage) SaveSyncMessage(emsg *EMessage) error {
 		}
 	}
 
-	storage.WriteMessage(storage.file, emsg.msg)
+	err = storage.WriteMessage(storage.file, emsg.msg, emsg.msgid)
+	if err != nil {
+		log.Error("write sync message err:", err)
+		return err
+	}
+	storage.dirty = true
 	storage.execMessage(emsg.msg, emsg.msgid)
 	log.Info("save sync message:", emsg.msgid)
 	return nil
@@ -115,7 +153,7 @@ func (storage *Storage) LoadSyncMessagesInBackground(cursor int64) chan *Message
 
 		n := blockNo
 		for {
-			file := storage.openReadFile(n)
+			file := storage.openBlockReader(n)
 			if file == nil {
 				break
 			}
@@ -157,15 +195,20 @@ func (storage *Storage) LoadSyncMessagesInBackground(cursor int64) chan *Message
 			}
 
 			const BatchCount = 5000
-			batch := &MessageBatch{messages: make([]*Message, 0, BatchCount)}
+			version := storage.BlockVersion(n)
+			key := storage.BlockKey(n)
+			batch := &MessageBatch{version: version, messages: make([]*Message, 0, BatchCount)}
 			for {
 				position, err := file.Seek(0, os.SEEK_CUR)
 				if err != nil {
 					log.Info("seek file err:", err)
 					break
 				}
-				msg := storage.ReadMessage(file)
+				msg := storage.ReadMessage(file, version, key)
 				if msg == nil {
+					if size, err := file.Seek(0, os.SEEK_END); err == nil && size > position {
+						log.Errorf("read message:%d err, block:%d size:%d", storage.getMsgid(n, int(position)), n, size)
+					}
 					break
 				}
 				msgid := storage.getMsgid(n, int(position))
@@ -178,7 +221,7 @@ func (storage *Storage) LoadSyncMessagesInBackground(cursor int64) chan *Message
 
 				if len(batch.messages) >= BatchCount {
 					c <- batch
-					batch = &MessageBatch{messages: make([]*Message, 0, BatchCount)}
+					batch = &MessageBatch{version: version, messages: make([]*Message, 0, BatchCount)}
 				}
 			}
 			if len(batch.messages) > 0 {
@@ -201,8 +244,10 @@ func (storage *Storage) flushIndex() {
 	storage.mutex.Lock()
 	lastId := storage.lastId
 	peerIndex := storage.clonePeerIndex()
+	tombstones := storage.cloneTombstones()
 	storage.mutex.Unlock()
 
+	storage.saveTombstoneIndex(tombstones)
 	storage.savePeerIndex(peerIndex)
 	storage.lastSavedId = lastId
 }
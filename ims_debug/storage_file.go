@@ -12,50 +12,72 @@ import "path/filepath"
 import "strings"
 import "strconv"
 import "io"
+import "errors"
+import "hash/crc32"
 import log "github.com/golang/glog"
 
 const HeaderSize = 32
 const Magic = 0x494d494d
-const FVersion = 1 << 16 //1.0
+const FVersion1 = 1 << 16 //1.0 magic|message|magic
+const FVersion2 = 2 << 16 //2.0 magic|message|crc32|magic
+const FVersion3 = 3 << 16 //3.0 magic|加密的message|crc32|magic
+const FVersion = FVersion2 //没有配置master key时新建block的格式, 之前的block保持原来的格式
+
+var ErrChecksum = errors.New("record checksum mismatch")
 
 const BlockSize = 128 * 1024 * 1024
 const LruSize = 128
 
 type StorageFile struct {
-	root  string
-	mutex sync.Mutex
+	root        string
+	archiveRoot string //归档文件的目录, 默认storage_root/archive
+	mutex       sync.Mutex
 
 	dirty   bool       //write file dirty
 	blockNo int        //write file block NO
+	version int        //write file version
 	file    *os.File   //write
 	files   *lru.Cache //read, block files
 
+	versionMutex sync.Mutex
+	versions     map[int]int //每个block文件的格式
+
+	remaps map[int]*BlockRemap //压缩的block的remap表, 没有压缩的block为nil
+
+	key  *BlockKey         //write file的data key, 3.0之前的格式为nil
+	keys map[int]*BlockKey //3.0格式的block的data key
+
+	recovery *RecoveryReport //启动时截断的不完整消息
+
+	watermark int64 //之前的消息已经被删除, atomic
+
 	lastId      int64 //peer&group message_index记录的最大消息id
 	lastSavedId int64 //索引文件中最大的消息id
 }
 
-func NewStorageFile(root string) *StorageFile {
+func NewStorageFile(root string, archiveRoot string) *StorageFile {
 	storage := new(StorageFile)
 	storage.root = root
+	storage.archiveRoot = archiveRoot
 	storage.files = lru.New(LruSize)
 	storage.files.OnEvicted = onFileEvicted
+	storage.versions = make(map[int]int)
+	storage.remaps = make(map[int]*BlockRemap)
+	storage.keys = make(map[int]*BlockKey)
 
 	//find the last block file
 	pattern := fmt.Sprintf("%s/message_*", storage.root)
 	files, _ := filepath.Glob(pattern)
 	blockNo := 0 //begin from 0
+	blocks := make(map[string]int)
 	for _, f := range files {
 		base := filepath.Base(f)
 		if strings.HasPrefix(base, "message_") {
-			if !checkFile(f) {
-				log.Fatal("check file failure")
-			} else {
-				log.Infof("check file pass:%s", f)
-			}
 			b, err := strconv.ParseInt(base[8:], 10, 64)
 			if err != nil {
 				log.Fatal("invalid message file:", f)
 			}
+			blocks[f] = int(b)
 
 			if int(b) > blockNo {
 				blockNo = int(b)
@@ -63,7 +85,32 @@ func NewStorageFile(root string) *StorageFile {
 		}
 	}
 
-	storage.openWriteFile(blockNo)
+	//最后一个block结尾不完整的消息被截断，之前的block已经sync
+	for f, b := range blocks {
+		if b == blockNo {
+			continue
+		}
+		if !checkFile(f) {
+			log.Fatal("check file failure:", f)
+		} else {
+			log.Infof("check file pass:%s", f)
+		}
+	}
+	storage.recovery = storage.recoverFile(blockNo)
+
+	//保留策略删除的block之后的第一条消息, 包括已经归档的block
+	storage.cleanArchive()
+	minBlockNo := blockNo
+	for _, b := range storage.listBlocks() {
+		if b < minBlockNo {
+			minBlockNo = b
+		}
+	}
+	if minBlockNo > 0 {
+		storage.watermark = storage.getMsgid(minBlockNo, HeaderSize)
+	}
+
+	storage.openWriteFile(blockNo, newBlockVersion())
 
 	return storage
 }
@@ -88,6 +135,13 @@ func checkFile(filePath string) bool {
 		return false
 	}
 
+	//压缩的block以remap表或者最后一条消息结尾
+	if remap, err := readBlockRemap(file); err != nil {
+		return false
+	} else if remap != nil && len(remap.offsets) == 0 {
+		return true
+	}
+
 	_, err = file.Seek(fileSize-4, os.SEEK_SET)
 	if err != nil {
 		log.Fatal("seek file")
@@ -104,8 +158,8 @@ func checkFile(filePath string) bool {
 	return int(m) == Magic
 }
 
-//open write file
-func (storage *StorageFile) openWriteFile(blockNo int) {
+//open write file, 新建文件时使用version格式
+func (storage *StorageFile) openWriteFile(blockNo int, version int) {
 	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
 	log.Info("open/create message file path:", path)
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
@@ -125,22 +179,111 @@ func (storage *StorageFile) openWriteFile(blockNo int) {
 		fileSize = 0
 	}
 	if fileSize == 0 {
-		storage.WriteHeader(file)
+		storage.WriteHeader(file, version)
+	} else {
+		_, err = file.Seek(0, os.SEEK_SET)
+		if err != nil {
+			log.Fatal("seek file")
+		}
+		var magic int
+		magic, version = storage.ReadHeader(file)
+		if magic != Magic || !isValidVersion(version) {
+			log.Fatalf("invalid file header magic:%x version:%x", magic, version)
+		}
 	}
 	storage.file = file
 	storage.blockNo = blockNo
+	storage.version = version
 	storage.dirty = false
+	storage.setBlockVersion(blockNo, version)
+
+	//已经写入data key的加密block
+	var key *BlockKey
+	if version == FVersion3 && fileSize > HeaderSize {
+		key, err = storage.loadBlockKey(blockNo)
+		if err != nil || key == nil {
+			log.Fatalf("block:%d load data key err:%v", blockNo, err)
+		}
+	}
+	storage.setWriteKey(key)
+}
+
+func isValidVersion(version int) bool {
+	return version == FVersion1 || version == FVersion2 || version == FVersion3
 }
 
-func (storage *StorageFile) openReadFile(blockNo int) *os.File {
+// resetWriteFile 当前的block还没有消息时改变文件的格式, slave和master的block格式需要一致
+func (storage *StorageFile) resetWriteFile(version int) error {
+	fileSize, err := storage.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if fileSize != HeaderSize {
+		return fmt.Errorf("block:%d version:%x isn't empty", storage.blockNo, storage.version)
+	}
+	if err = storage.file.Truncate(0); err != nil {
+		return err
+	}
+	storage.WriteHeader(storage.file, version)
+	storage.version = version
+	storage.dirty = true
+	storage.setBlockVersion(storage.blockNo, version)
+	storage.setWriteKey(nil)
+	return nil
+}
+
+func (storage *StorageFile) setBlockVersion(blockNo int, version int) {
+	storage.versionMutex.Lock()
+	defer storage.versionMutex.Unlock()
+	storage.versions[blockNo] = version
+}
+
+// resetBlockVersions block文件被替换之后重新读取文件头, 需要持有storage.mutex
+func (storage *StorageFile) resetBlockVersions() {
+	storage.versionMutex.Lock()
+	defer storage.versionMutex.Unlock()
+	storage.versions = make(map[int]int)
+	storage.remaps = make(map[int]*BlockRemap)
+	storage.keys = make(map[int]*BlockKey)
+	if storage.key != nil {
+		storage.keys[storage.blockNo] = storage.key
+	}
+}
+
+// BlockVersion block文件的格式，文件不存在时返回当前的格式
+func (storage *StorageFile) BlockVersion(blockNo int) int {
+	storage.versionMutex.Lock()
+	defer storage.versionMutex.Unlock()
+	if v, ok := storage.versions[blockNo]; ok {
+		return v
+	}
+
+	file := storage.openReadFile(blockNo)
+	if file == nil {
+		return FVersion
+	}
+	defer file.Close()
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return FVersion
+	}
+	magic, version := storage.ReadHeader(file)
+	if magic != Magic {
+		log.Warningf("block:%d header magic err:%x", blockNo, magic)
+		return FVersion
+	}
+	storage.versions[blockNo] = version
+	return version
+}
+
+// openReadFile 打开block文件, 不存在时打开归档文件
+func (storage *StorageFile) openReadFile(blockNo int) BlockFile {
 	//open file readonly mode
 	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
 	log.Info("open message block file path:", path)
 	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Infof("message block file:%s nonexist", path)
-			return nil
+			return storage.openArchivedFile(blockNo)
 		} else {
 			log.Fatal(err)
 		}
@@ -169,10 +312,10 @@ func (storage *StorageFile) getBlockOffset(msgid int64) int {
 	return int(msgid % BlockSize)
 }
 
-func (storage *StorageFile) getFile(blockNo int) *os.File {
+func (storage *StorageFile) getFile(blockNo int) BlockFile {
 	v, ok := storage.files.Get(blockNo)
 	if ok {
-		return v.(*os.File)
+		return v.(BlockFile)
 	}
 	file := storage.openReadFile(blockNo)
 	if file == nil {
@@ -183,7 +326,8 @@ func (storage *StorageFile) getFile(blockNo int) *os.File {
 	return file
 }
 
-func (storage *StorageFile) ReadMessage(file *os.File) *Message {
+// ReadMessage 读取version格式的一条消息, 2.0之后的格式校验crc32, 3.0的格式用block的data key解密
+func (storage *StorageFile) ReadMessage(file io.Reader, version int, key *BlockKey) *Message {
 	//校验消息起始位置的magic
 	var magic int32
 	err := binary.Read(file, binary.BigEndian, &magic)
@@ -196,11 +340,48 @@ func (storage *StorageFile) ReadMessage(file *os.File) *Message {
 		log.Warning("magic err:", magic)
 		return nil
 	}
-	msg := ReceiveMessage(file)
+
+	if version == FVersion1 {
+		msg := ReceiveMessage(file)
+		if msg == nil {
+			return msg
+		}
+		err = binary.Read(file, binary.BigEndian, &magic)
+		if err != nil {
+			log.Info("read file err:", err)
+			return nil
+		}
+		if magic != Magic {
+			log.Warning("magic err:", magic)
+			return nil
+		}
+		return msg
+	} else if version != FVersion2 && version != FVersion3 {
+		log.Warningf("unsupported file version:%x", version)
+		return nil
+	}
+
+	limit := 32 * 1024
+	if version == FVersion3 {
+		limit += SealOverhead
+	}
+	h := crc32.NewIEEE()
+	msg := ReceiveLimitMessage(io.TeeReader(file, h), limit, false)
 	if msg == nil {
 		return msg
 	}
 
+	var sum uint32
+	err = binary.Read(file, binary.BigEndian, &sum)
+	if err != nil {
+		log.Info("read file err:", err)
+		return nil
+	}
+	if sum != h.Sum32() {
+		log.Warningf("crc err:%x expect:%x", h.Sum32(), sum)
+		return nil
+	}
+
 	err = binary.Read(file, binary.BigEndian, &magic)
 	if err != nil {
 		log.Info("read file err:", err)
@@ -211,10 +392,17 @@ func (storage *StorageFile) ReadMessage(file *os.File) *Message {
 		log.Warning("magic err:", magic)
 		return nil
 	}
+	if version == FVersion3 {
+		return openRecord(msg, key)
+	}
 	return msg
 }
 
 func (storage *StorageFile) LoadMessage(msgid int64) *Message {
+	if msgid < storage.Watermark() {
+		//已经被删除
+		return nil
+	}
 	storage.mutex.Lock()
 	defer storage.mutex.Unlock()
 	blockNo := storage.getBlockNo(msgid)
@@ -226,17 +414,26 @@ func (storage *StorageFile) LoadMessage(msgid int64) *Message {
 		return nil
 	}
 
+	if remap := storage.blockRemap(blockNo); remap != nil {
+		var ok bool
+		offset, ok = remap.lookup(offset)
+		if !ok {
+			//压缩时已经被删除
+			return nil
+		}
+	}
+
 	_, err := file.Seek(int64(offset), os.SEEK_SET)
 	if err != nil {
 		log.Warning("seek file")
 		return nil
 	}
-	return storage.ReadMessage(file)
+	return storage.ReadMessage(file, storage.BlockVersion(blockNo), storage.BlockKey(blockNo))
 }
 
-func (storage *StorageFile) ReadHeader(file *os.File) (magic int, version int) {
+func (storage *StorageFile) ReadHeader(file io.Reader) (magic int, version int) {
 	header := make([]byte, HeaderSize)
-	n, err := file.Read(header)
+	n, err := io.ReadFull(file, header)
 	if err != nil || n != HeaderSize {
 		return
 	}
@@ -249,13 +446,13 @@ func (storage *StorageFile) ReadHeader(file *os.File) (magic int, version int) {
 	return
 }
 
-func (storage *StorageFile) WriteHeader(file *os.File) {
+func (storage *StorageFile) WriteHeader(file *os.File, version int) {
 	var m int32 = Magic
 	err := binary.Write(file, binary.BigEndian, m)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	var v int32 = FVersion
+	var v = int32(version)
 	err = binary.Write(file, binary.BigEndian, v)
 	if err != nil {
 		log.Fatalln(err)
@@ -267,12 +464,52 @@ func (storage *StorageFile) WriteHeader(file *os.File) {
 	}
 }
 
-func (storage *StorageFile) WriteMessage(file io.Writer, msg *Message) {
+// EncodeRecord 按照block的格式编码一条消息
+func EncodeRecord(msg *Message, version int) []byte {
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, int32(Magic))
 	WriteMessage(buffer, msg)
+	if version != FVersion1 {
+		sum := crc32.ChecksumIEEE(buffer.Bytes()[4:])
+		binary.Write(buffer, binary.BigEndian, sum)
+	}
 	binary.Write(buffer, binary.BigEndian, int32(Magic))
-	buf := buffer.Bytes()
+	return buffer.Bytes()
+}
+
+// RecordSize 消息在version格式的block中的长度
+func RecordSize(msg *Message, version int) int64 {
+	size := int64(len(EncodeRecord(msg, version)))
+	if version == FVersion3 && isSealedCmd(msg.cmd) {
+		size += SealOverhead
+	}
+	return size
+}
+
+// encodeRecord 按照当前写入文件的格式编码msgid位置的消息, 3.0的格式用block的data key加密
+func (storage *StorageFile) encodeRecord(msg *Message, msgid int64) ([]byte, error) {
+	if storage.version != FVersion3 || !isSealedCmd(msg.cmd) {
+		return EncodeRecord(msg, storage.version), nil
+	}
+	if storage.key == nil {
+		return nil, fmt.Errorf("block:%d data key doesn't exist", storage.blockNo)
+	}
+	return EncodeRecord(storage.key.seal(msg, msgid), storage.version), nil
+}
+
+// WriteMessage 按照当前写入文件的格式写入同步的消息, MSG_BLOCK_KEY是加密block的data key
+func (storage *StorageFile) WriteMessage(file io.Writer, msg *Message, msgid int64) error {
+	if storage.version == FVersion3 && msg.cmd == MSG_BLOCK_KEY {
+		key, err := openBlockKey(storage.blockNo, msg.body.(*BlockKeyRecord))
+		if err != nil {
+			return err
+		}
+		storage.setWriteKey(key)
+	}
+	buf, err := storage.encodeRecord(msg, msgid)
+	if err != nil {
+		return err
+	}
 	n, err := file.Write(buf)
 	if err != nil {
 		log.Fatal("file write err:", err)
@@ -280,6 +517,7 @@ func (storage *StorageFile) WriteMessage(file io.Writer, msg *Message) {
 	if n != len(buf) {
 		log.Fatal("file write size:", len(buf), " nwrite:", n)
 	}
+	return nil
 }
 
 //save without lock
@@ -289,27 +527,42 @@ func (storage *StorageFile) saveMessage(msg *Message) int64 {
 		log.Fatalln(err)
 	}
 
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, int32(Magic))
-	WriteMessage(buffer, msg)
-	binary.Write(buffer, binary.BigEndian, int32(Magic))
-	buf := buffer.Bytes()
+	size := RecordSize(msg, storage.version)
 
-	if msgid+int64(len(buf)) > BlockSize {
+	if msgid+size > BlockSize {
 		err = storage.file.Sync()
 		if err != nil {
 			log.Fatalln("sync storage file:", err)
 		}
 		storage.file.Close()
-		storage.openWriteFile(storage.blockNo + 1)
+		storage.openWriteFile(storage.blockNo+1, newBlockVersion())
 		msgid, err = storage.file.Seek(0, os.SEEK_END)
 		if err != nil {
 			log.Fatalln(err)
 		}
+		size = RecordSize(msg, storage.version)
 	}
 
-	if msgid+int64(len(buf)) > BlockSize {
-		log.Fatalln("message size:", len(buf))
+	//新的加密block先写入data key
+	if storage.version == FVersion3 && storage.key == nil && isSealedCmd(msg.cmd) {
+		key, record, err := createBlockKey(storage.blockNo)
+		if err != nil {
+			log.Fatalln("create block key err:", err)
+		}
+		storage.setWriteKey(key)
+		storage.saveMessage(record)
+		msgid, err = storage.file.Seek(0, os.SEEK_END)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if msgid+size > BlockSize {
+		log.Fatalln("message size:", size)
+	}
+	buf, err := storage.encodeRecord(msg, storage.getMsgid(storage.blockNo, int(msgid)))
+	if err != nil {
+		log.Fatalln("encode message err:", err)
 	}
 	n, err := storage.file.Write(buf)
 	if err != nil {
@@ -348,6 +601,6 @@ func (storage *StorageFile) Flush() {
 }
 
 func onFileEvicted(key lru.Key, value interface{}) {
-	f := value.(*os.File)
+	f := value.(BlockFile)
 	_ = f.Close()
 }
@@ -0,0 +1,70 @@
+package main
+
+import "bytes"
+import "strings"
+import "testing"
+
+func testMessage(i int, content string) *Message {
+	im := &IMMessage{sender: 1, receiver: 2, timestamp: 1000 + int32(i), msgid: int32(i), content: content}
+	return &Message{cmd: MsgIm, version: DefaultVersion, body: im}
+}
+
+func equalMessage(m1 *Message, m2 *Message) bool {
+	if m1 == nil || m2 == nil {
+		return m1 == m2
+	}
+	return m1.cmd == m2.cmd && bytes.Equal(m1.ToData(), m2.ToData())
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		version int
+		content string
+	}{
+		{FVersion1, "hello"},
+		{FVersion1, ""},
+		{FVersion2, "hello"},
+		{FVersion2, ""},
+		{FVersion2, strings.Repeat("x", 16*1024)},
+	}
+	storage := new(StorageFile)
+	for i, test := range tests {
+		msg := testMessage(i, test.content)
+		data := EncodeRecord(msg, test.version)
+		if int64(len(data)) != RecordSize(msg, test.version) {
+			t.Errorf("version:%x record size:%d expect:%d", test.version, len(data), RecordSize(msg, test.version))
+		}
+		r := bytes.NewReader(data)
+		m := storage.ReadMessage(r, test.version, nil)
+		if !equalMessage(m, msg) {
+			t.Errorf("version:%x content len:%d read message mismatch", test.version, len(test.content))
+		}
+		if r.Len() != 0 {
+			t.Errorf("version:%x %d bytes left", test.version, r.Len())
+		}
+	}
+}
+
+//2.0之后的格式消息内容被修改时校验失败
+func TestRecordCRCMismatch(t *testing.T) {
+	tests := []struct {
+		version int
+		offset  int //从记录开始的位置修改一个字节
+	}{
+		{FVersion2, 4 + MsgHeaderSize},
+		{FVersion2, 4 + MsgHeaderSize + 10},
+		{FVersion2, -5}, //crc32
+	}
+	storage := new(StorageFile)
+	for _, test := range tests {
+		data := EncodeRecord(testMessage(1, "hello world"), test.version)
+		offset := test.offset
+		if offset < 0 {
+			offset += len(data)
+		}
+		data[offset] ^= 0xff
+		if m := storage.ReadMessage(bytes.NewReader(data), test.version, nil); m != nil {
+			t.Errorf("version:%x offset:%d corrupted record is accepted", test.version, test.offset)
+		}
+	}
+}
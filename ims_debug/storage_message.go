@@ -2,6 +2,7 @@ package main
 
 import "bytes"
 import "encoding/binary"
+import "hash/crc32"
 import log "github.com/golang/glog"
 
 //存储服务器命令消息 deprecated
@@ -21,6 +22,16 @@ const MSG_GET_GROUP_OFFLINE_COUNT = 212
 const MSG_STORAGE_SYNC_BEGIN = 220
 const MSG_STORAGE_SYNC_MESSAGE = 221 //感觉从来没有使用过，都是使用批量同步的方式
 const MSG_STORAGE_SYNC_MESSAGE_BATCH = 222
+const MSG_STORAGE_SYNC_ACK = 223         //slave->master 已经写入的位置
+const MSG_STORAGE_SYNC_ACK_REQUEST = 224 //master->slave 要求slave回复ack, 旧版本的slave会忽略
+const MSG_STORAGE_SYNC_HEARTBEAT = 234   //master->slave SyncCursor, master当前的位置, 只发送给SyncHeartbeatVersion之后的slave
+
+//MSG_STORAGE_SYNC_ACK_REQUEST的flag, 异步复制时ack只用于统计延迟, slave回复之前不需要写入磁盘
+//旧版本的slave忽略该flag, 每次回复之前仍然写入磁盘
+const SyncAckFlagNoFlush = 0x01
+
+//slave在MSG_STORAGE_SYNC_BEGIN中发送的同步协议版本, 支持心跳之后slave可以计算落后master的时间
+const SyncHeartbeatVersion = 1
 
 //内部文件存储使用
 
@@ -66,6 +77,8 @@ func init() {
 	messageCreators[MSG_STORAGE_SYNC_BEGIN] = func() IMessage { return new(SyncCursor) }
 	messageCreators[MSG_STORAGE_SYNC_MESSAGE] = func() IMessage { return new(EMessage) }
 	messageCreators[MSG_STORAGE_SYNC_MESSAGE_BATCH] = func() IMessage { return new(MessageBatch) }
+	messageCreators[MSG_STORAGE_SYNC_ACK] = func() IMessage { return new(SyncCursor) }
+	messageCreators[MSG_STORAGE_SYNC_HEARTBEAT] = func() IMessage { return new(SyncCursor) }
 
 	messageDescriptions[MSG_SAVE_AND_ENQUEUE] = "MSG_SAVE_AND_ENQUEUE"
 	messageDescriptions[MSG_DEQUEUE] = "MSG_DEQUEUE"
@@ -79,6 +92,9 @@ func init() {
 	messageDescriptions[MSG_STORAGE_SYNC_BEGIN] = "MSG_STORAGE_SYNC_BEGIN"
 	messageDescriptions[MSG_STORAGE_SYNC_MESSAGE] = "MSG_STORAGE_SYNC_MESSAGE"
 	messageDescriptions[MSG_STORAGE_SYNC_MESSAGE_BATCH] = "MSG_STORAGE_SYNC_MESSAGE_BATCH"
+	messageDescriptions[MSG_STORAGE_SYNC_ACK] = "MSG_STORAGE_SYNC_ACK"
+	messageDescriptions[MSG_STORAGE_SYNC_ACK_REQUEST] = "MSG_STORAGE_SYNC_ACK_REQUEST"
+	messageDescriptions[MSG_STORAGE_SYNC_HEARTBEAT] = "MSG_STORAGE_SYNC_HEARTBEAT"
 
 	messageDescriptions[MSG_OFFLINE_V2] = "MSG_OFFLINE_V2"
 	messageDescriptions[MSG_PENDING_GROUP_MESSAGE] = "MSG_PENDING_GROUP_MESSAGE"
@@ -89,12 +105,16 @@ func init() {
 //region SyncCursor
 
 type SyncCursor struct {
-	msgid int64
+	msgid   int64
+	epoch   int64 //slave的fencing token, 旧版本的slave没有该字段
+	version int64 //slave的同步协议版本, 旧版本的slave没有该字段
 }
 
 func (cursor *SyncCursor) ToData() []byte {
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, cursor.msgid)
+	binary.Write(buffer, binary.BigEndian, cursor.epoch)
+	binary.Write(buffer, binary.BigEndian, cursor.version)
 	return buffer.Bytes()
 }
 
@@ -104,6 +124,12 @@ func (cursor *SyncCursor) FromData(buff []byte) bool {
 	}
 	buffer := bytes.NewBuffer(buff)
 	binary.Read(buffer, binary.BigEndian, &cursor.msgid)
+	if len(buff) >= 16 {
+		binary.Read(buffer, binary.BigEndian, &cursor.epoch)
+	}
+	if len(buff) >= 24 {
+		binary.Read(buffer, binary.BigEndian, &cursor.version)
+	}
 	return true
 }
 
@@ -171,6 +197,10 @@ type MessageBatch struct {
 	firstId  int64
 	lastId   int64
 	messages []*Message
+
+	//消息之后的可选字段，旧版本的master没有这些字段
+	version int      //消息所在block文件的格式
+	crcs    []uint32 //每条消息的crc32, slave写入之前校验
 }
 
 func (batch *MessageBatch) ToData() []byte {
@@ -180,8 +210,16 @@ func (batch *MessageBatch) ToData() []byte {
 	count := int32(len(batch.messages))
 	binary.Write(buffer, binary.BigEndian, count)
 
+	crcs := make([]uint32, 0, count)
 	for _, m := range batch.messages {
+		start := buffer.Len()
 		SendMessage(buffer, m)
+		crcs = append(crcs, crc32.ChecksumIEEE(buffer.Bytes()[start:]))
+	}
+
+	binary.Write(buffer, binary.BigEndian, int32(batch.version))
+	for _, c := range crcs {
+		binary.Write(buffer, binary.BigEndian, c)
 	}
 
 	buf := buffer.Bytes()
@@ -209,9 +247,31 @@ func (batch *MessageBatch) FromData(buff []byte) bool {
 		batch.messages = append(batch.messages, msg)
 	}
 
+	batch.version = FVersion1
+	if buffer.Len() >= 4 {
+		var version int32
+		binary.Read(buffer, binary.BigEndian, &version)
+		batch.version = int(version)
+	}
+	if buffer.Len() >= 4*int(count) {
+		batch.crcs = make([]uint32, count)
+		for i := range batch.crcs {
+			binary.Read(buffer, binary.BigEndian, &batch.crcs[i])
+		}
+	}
+	if !isValidVersion(batch.version) {
+		return false
+	}
 	return true
 }
 
+// MessageChecksum 和MessageBatch中的crc32相同
+func MessageChecksum(msg *Message) uint32 {
+	buffer := new(bytes.Buffer)
+	WriteMessage(buffer, msg)
+	return crc32.ChecksumIEEE(buffer.Bytes())
+}
+
 //endregion
 
 //region OfflineMessage
@@ -33,6 +33,16 @@ type HistoryRequest struct {
 	Limit int32
 }
 
+// ReplicaStatus im用于选择读取的slave
+type ReplicaStatus struct {
+	IsSlave   bool
+	Staleness int64 //数据最多落后master的秒数
+	NextMsgid int64
+	Epoch     int64  //fencing token
+	Fenced    bool   //被fence之后不再接受写入
+	Master    string //slave同步的master地址
+}
+
 func SyncMessageInterface(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 	return nil
 }
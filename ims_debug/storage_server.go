@@ -24,6 +24,7 @@ var (
 var storage *Storage
 var config *StorageConfig
 var master *Master
+var slave *Slave //nil表示当前是master, 由roleMutex保护
 var serverSummary *ServerSummary
 
 func init() {
@@ -110,6 +111,12 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func StartHttpServer(addr string) {
 	http.HandleFunc("/summary", Summary)
 	http.HandleFunc("/stack", Stack)
+	http.HandleFunc("/verify", Verify)
+	http.HandleFunc("/repair", Repair)
+	http.HandleFunc("/erase", EraseHandler)
+	http.HandleFunc("/erasures", Erasures)
+	http.HandleFunc("/compact", Compact)
+	http.HandleFunc("/archive", Archive)
 
 	handler := loggingHandler{http.DefaultServeMux}
 
@@ -125,6 +132,15 @@ func ListenRpcClient() {
 	dispatcher.AddFunc("SavePeerMessage", SavePeerMessage)
 	dispatcher.AddFunc("GetNewCount", GetNewCount)
 	dispatcher.AddFunc("GetLatestMessage", GetLatestMessage)
+	dispatcher.AddFunc("GetReplicaStatus", GetReplicaStatus)
+	dispatcher.AddFunc("FenceMaster", FenceMaster)
+	dispatcher.AddFunc("PromoteSlave", PromoteSlave)
+	dispatcher.AddFunc("ReplicateMaster", ReplicateMaster)
+	dispatcher.AddFunc("ListUsers", ListUsers)
+	dispatcher.AddFunc("ExportUserMessages", ExportUserMessages)
+	dispatcher.AddFunc("ImportUserMessages", ImportUserMessages)
+	dispatcher.AddFunc("FreezeUsers", FreezeUsers)
+	dispatcher.AddFunc("EraseUser", EraseUser)
 
 	s := &gorpc.Server{
 		Addr:    config.rpcListen,
@@ -137,12 +153,16 @@ func ListenRpcClient() {
 }
 
 func main() {
+	flag.Parse()
+	if len(flag.Args()) > 0 && flag.Args()[0] == "inspect" {
+		os.Exit(Inspect(flag.Args()[1:]))
+	}
+
 	fmt.Printf("Version:     %s\nBuilt:       %s\nGo version:  %s\nGit branch:  %s\nGit commit:  %s\n",
 		Version, BuildTime, GoVersion, GitBranch, GitCommitId)
 
 	rand.Seed(time.Now().UnixNano())
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	flag.Parse()
 	if len(flag.Args()) == 0 {
 		fmt.Println("usage: ims config")
 		return
@@ -153,18 +173,26 @@ func main() {
 		config.rpcListen, config.storageRoot, config.syncListen,
 		config.masterAddress, config.isPushSystem, config.groupLimit, config.limit)
 	log.Infof("http listen address:%s", config.httpListenAddress)
+	log.Infof("retention days:%d size:%d", config.retentionDays, config.retentionSize)
+	log.Infof("archive days:%d archive root:%s", config.archiveDays, config.archiveRoot)
+	log.Infof("master key file:%s", config.masterKeyFile)
+	if err := reloadKeyring(); err != nil {
+		log.Fatal("load master key err:", err)
+	}
 
-	storage = NewStorage(config.storageRoot)
+	storage = NewStorage(config.storageRoot, config.archiveRoot)
+	LoadReshardMap(config.storageRoot)
+	LoadFrozenUsers(config.storageRoot)
 
 	master = NewMaster()
 	master.Start()
-	if len(config.masterAddress) > 0 {
-		slave := NewSlave(config.masterAddress)
-		slave.Start()
-	}
+	StartReplica()
 
 	go FlushStorageLoop()
 	go FlushIndexLoop()
+	go RetentionLoop()
+	go CompactionLoop()
+	go ArchiveLoop()
 	go waitSignal()
 
 	if len(config.httpListenAddress) > 0 {
@@ -1,13 +1,26 @@
 package main
 
 import "net"
+import "math"
 import "sync"
 import "time"
+import "sync/atomic"
 import log "github.com/golang/glog"
 
+//master发送心跳的间隔
+const SyncHeartbeatInterval = time.Second
+
+//没有和master同步过时的延迟
+const UnknownStaleness = math.MaxInt32
+
 type SyncClient struct {
 	conn *net.TCPConn
 	ewt  chan *Message
+
+	sentMsgid int64 //最后发送给slave的消息
+	ackMsgid  int64 //slave回复的已经写入的位置, 之前的消息slave都已经保存, 异步复制时可能还没有写入磁盘
+	ackTime   int64 //最后一次收到ack的时间(毫秒)
+	version   int64 //slave的同步协议版本, 在加入master之前设置
 }
 
 func NewSyncClient(conn *net.TCPConn) *SyncClient {
@@ -17,32 +30,123 @@ func NewSyncClient(conn *net.TCPConn) *SyncClient {
 	return c
 }
 
+// ReadAck 读取slave回复的ack, 连接断开时返回
+func (client *SyncClient) ReadAck() {
+	for {
+		msg := ReceiveMessage(client.conn)
+		if msg == nil {
+			return
+		}
+		if msg.cmd != MSG_STORAGE_SYNC_ACK {
+			log.Warning("unexpected sync message cmd:", Command(msg.cmd))
+			continue
+		}
+		cursor := msg.body.(*SyncCursor)
+		atomic.StoreInt64(&client.ackMsgid, cursor.msgid)
+		atomic.StoreInt64(&client.ackTime, time.Now().UnixNano()/int64(time.Millisecond))
+		master.NotifyAck()
+	}
+}
+
 func (client *SyncClient) RunLoop() {
+	defer client.conn.Close()
+
 	seq := 0
 	msg := ReceiveMessage(client.conn)
 	if msg == nil {
 		return
 	}
-	if msg.cmd != MSG_STORAGE_SYNC_BEGIN {
+	if msg.cmd == MSG_STORAGE_CHECKSUM_REQUEST || msg.cmd == MSG_STORAGE_BLOCK_REQUEST {
+		//slave校验数据的连接，不同步消息
+		client.ServeVerify(msg)
+		return
+	}
+	if msg.cmd != MSG_STORAGE_SYNC_BEGIN && msg.cmd != MSG_STORAGE_SYNC_SNAPSHOT_BEGIN {
 		return
 	}
 
 	cursor := msg.body.(*SyncCursor)
-	log.Info("cursor msgid:", cursor.msgid)
-	c := storage.LoadSyncMessagesInBackground(cursor.msgid)
+	snapshot := msg.cmd == MSG_STORAGE_SYNC_SNAPSHOT_BEGIN
+	log.Info("cursor msgid:", cursor.msgid, " epoch:", cursor.epoch, " snapshot:", snapshot)
+	if cursor.epoch > CurrentEpoch() {
+		//slave已经切换到更新的master, 当前的master不能再写入
+		log.Warningf("slave epoch:%d is newer than epoch:%d", cursor.epoch, CurrentEpoch())
+		_ = Fence(cursor.epoch)
+		return
+	}
+	if IsFenced() && cursor.epoch >= CurrentEpoch() {
+		//被fence之后只允许之前的slave继续同步，新master的slave不能同步之后写入的消息
+		log.Warningf("fenced, refuse slave of epoch:%d", cursor.epoch)
+		return
+	}
+	if cursor.msgid > storage.NextMsgid() {
+		log.Errorf("slave cursor:%d is ahead of master:%d, refuse to sync", cursor.msgid, storage.NextMsgid())
+		return
+	}
+	client.version = cursor.version
+	atomic.StoreInt64(&client.ackMsgid, cursor.msgid)
+	atomic.StoreInt64(&client.ackTime, time.Now().UnixNano()/int64(time.Millisecond))
+	msg = &Message{cmd: MSG_STORAGE_SYNC_ACK_REQUEST}
+	if config.syncAckCount <= 0 {
+		msg.flag = SyncAckFlagNoFlush
+	}
+	seq = seq + 1
+	msg.seq = seq
+	_ = SendMessage(client.conn, msg)
+	go client.ReadAck()
+
+	msgid := cursor.msgid
+	if snapshot {
+		var err error
+		msgid, err = client.SendSnapshot(&seq)
+		if err != nil {
+			log.Warning("send snapshot err:", err)
+			return
+		}
+	}
+
+	if watermark := storage.Watermark(); watermark > 0 && cursor.version < SyncHeartbeatVersion {
+		//旧版本的slave不能解析watermark, 不删除block
+		log.Warningf("slave version:%d does not support watermark:%d, upgrade slave", cursor.version, watermark)
+	} else if watermark > 0 {
+		//slave删除同样的block, 落后于watermark时从watermark开始同步
+		seq = seq + 1
+		msg = &Message{cmd: MSG_STORAGE_SYNC_WATERMARK, seq: seq, body: &SyncCursor{msgid: watermark}}
+		if SendMessage(client.conn, msg) != nil {
+			return
+		}
+		if msgid < watermark {
+			msgid = watermark
+		}
+	}
+
+	c := storage.LoadSyncMessagesInBackground(msgid)
 
 	for batch := range c {
 		msg := &Message{cmd: MSG_STORAGE_SYNC_MESSAGE_BATCH, body: batch}
 		seq = seq + 1
 		msg.seq = seq
 		_ = SendMessage(client.conn, msg)
+		atomic.StoreInt64(&client.sentMsgid, batch.lastId)
 	}
 
 	master.AddClient(client)
 	defer master.RemoveClient(client)
 
+	var heartbeat <-chan time.Time
+	if cursor.version >= SyncHeartbeatVersion {
+		ticker := time.NewTicker(SyncHeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
-		msg := <-client.ewt
+		var msg *Message
+		select {
+		case msg = <-client.ewt:
+		case <-heartbeat:
+			msg = &Message{cmd: MSG_STORAGE_SYNC_HEARTBEAT, body: &SyncCursor{msgid: storage.NextMsgid()}}
+		}
 		if msg == nil {
 			log.Warning("chan closed")
 			break
@@ -54,6 +158,9 @@ func (client *SyncClient) RunLoop() {
 		if err != nil {
 			break
 		}
+		if batch, ok := msg.body.(*MessageBatch); ok {
+			atomic.StoreInt64(&client.sentMsgid, batch.lastId)
+		}
 	}
 }
 
@@ -68,12 +175,16 @@ type Master struct {
 
 	mutex   sync.Mutex
 	clients map[*SyncClient]struct{}
+
+	ackMutex  sync.Mutex
+	ackNotify chan struct{} //收到ack时关闭并重新创建，唤醒等待ack的请求
 }
 
 func NewMaster() *Master {
 	master := new(Master)
 	master.clients = make(map[*SyncClient]struct{})
 	master.ewt = make(chan *EMessage, 10)
+	master.ackNotify = make(chan struct{})
 	return master
 }
 
@@ -104,17 +215,29 @@ func (master *Master) SendBatch(cache []*EMessage) {
 		return
 	}
 
-	batch := &MessageBatch{messages: make([]*Message, 0, 1000)}
-	batch.firstId = cache[0].msgid
+	//slave根据batch中第一条消息的位置和block的格式计算之后消息的位置，同一个batch中的消息属于同一个block
+	var batch *MessageBatch
+	clients := master.CloneClientSet()
+	send := func() {
+		m := &Message{cmd: MSG_STORAGE_SYNC_MESSAGE_BATCH, body: batch}
+		for c := range clients {
+			c.ewt <- m
+		}
+	}
 	for _, em := range cache {
+		blockNo := storage.getBlockNo(em.msgid)
+		if batch != nil && storage.getBlockNo(batch.firstId) != blockNo {
+			send()
+			batch = nil
+		}
+		if batch == nil {
+			batch = &MessageBatch{version: storage.BlockVersion(blockNo), messages: make([]*Message, 0, len(cache))}
+			batch.firstId = em.msgid
+		}
 		batch.lastId = em.msgid
 		batch.messages = append(batch.messages, em.msg)
 	}
-	m := &Message{cmd: MSG_STORAGE_SYNC_MESSAGE_BATCH, body: batch}
-	clients := master.CloneClientSet()
-	for c := range clients {
-		c.ewt <- m
-	}
+	send()
 }
 
 func (master *Master) Run() {
@@ -139,7 +262,11 @@ func (master *Master) Run() {
 			if len(cache) == 1 {
 				firstTs = time.Now()
 			}
-			if len(cache) >= 1000 {
+			//半同步模式下不等待凑满批次，减少写入的延迟
+			if config.syncAckCount > 0 && len(master.ewt) == 0 {
+				master.SendBatch(cache)
+				cache = cache[0:0]
+			} else if len(cache) >= 1000 {
 				master.SendBatch(cache)
 				cache = cache[0:0]
 			}
@@ -161,25 +288,71 @@ func (master *Master) Start() {
 //region Slave
 
 type Slave struct {
-	addr string
+	addr  string
+	epoch int64 //创建时的epoch, 同步开始时发送给master
+
+	connected int32 //和master的同步连接是否正常
+	lastSync  int64 //最后一次和master同步的时间(秒)，master不发送心跳时用于判断数据的延迟
+
+	heartbeat    int32 //master是否发送心跳, 旧版本的master不发送
+	syncedTime   int64 //已经同步到该时间master的位置(秒), 0表示还没有同步到过
+	pendingMsgid int64 //心跳中master的位置, 同步到之后更新syncedTime, 只在同步的goroutine中访问
+	pendingTime  int64 //收到pendingMsgid的时间(秒), 0表示没有等待同步的位置
+
+	snapshotRefused bool //master不支持快照
+
+	mutex sync.Mutex
+	conn  *net.TCPConn
+	quit  chan struct{}
+	done  chan struct{}
 }
 
-func NewSlave(addr string) *Slave {
+func NewSlave(addr string, epoch int64) *Slave {
 	s := new(Slave)
 	s.addr = addr
+	s.epoch = epoch
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
 	return s
 }
 
+func (slave *Slave) setConn(conn *net.TCPConn) bool {
+	slave.mutex.Lock()
+	defer slave.mutex.Unlock()
+	select {
+	case <-slave.quit:
+		return false
+	default:
+	}
+	slave.conn = conn
+	return true
+}
+
 func (slave *Slave) RunOnce(conn *net.TCPConn) {
 	defer conn.Close()
+	if !slave.setConn(conn) {
+		return
+	}
+
+	atomic.StoreInt64(&slave.lastSync, time.Now().Unix())
+	atomic.StoreInt32(&slave.connected, 1)
+	defer func() {
+		atomic.StoreInt32(&slave.connected, 0)
+		atomic.StoreInt64(&slave.lastSync, time.Now().Unix())
+	}()
 
 	seq := 0
 
 	msgid := storage.NextMsgid()
-	cursor := &SyncCursor{msgid}
-	log.Info("cursor msgid:", msgid)
+	cursor := &SyncCursor{msgid: msgid, epoch: slave.epoch, version: SyncHeartbeatVersion}
+	//新的slave从master获取快照
+	snapshot := config.syncSnapshot && !slave.snapshotRefused && storage.IsEmpty()
+	log.Info("cursor msgid:", msgid, " snapshot:", snapshot)
 
 	msg := &Message{cmd: MSG_STORAGE_SYNC_BEGIN, body: cursor}
+	if snapshot {
+		msg.cmd = MSG_STORAGE_SYNC_SNAPSHOT_BEGIN
+	}
 	seq += 1
 	msg.seq = seq
 	err := SendMessage(conn, msg)
@@ -188,15 +361,56 @@ func (slave *Slave) RunOnce(conn *net.TCPConn) {
 		return
 	}
 
+	if snapshot {
+		//旧版本的master收到快照请求之后不回复也不断开连接
+		_ = conn.SetReadDeadline(time.Now().Add(SnapshotHandshakeTimeout))
+	}
+
+	var receiver *SnapshotReceiver
+	received := false
+	ack := false   //master是否要求回复ack
+	flush := false //回复ack之前是否写入磁盘, 半同步复制时master要求
 	for {
 		msg := ReceiveStorageSyncMessage(conn)
 		if msg == nil {
+			if snapshot && !received {
+				//旧版本的master不支持快照，之后使用原来的方式同步
+				log.Warning("master doesn't support snapshot")
+				slave.snapshotRefused = true
+			}
 			return
 		}
+		if !received && snapshot {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+		received = true
+		atomic.StoreInt64(&slave.lastSync, time.Now().Unix())
+
+		if msg.cmd == MSG_STORAGE_SYNC_BLOCK || msg.cmd == MSG_STORAGE_SYNC_INDEX || msg.cmd == MSG_STORAGE_SYNC_TOMBSTONE {
+			if receiver == nil {
+				receiver, err = NewSnapshotReceiver(storage.root)
+				if err != nil {
+					log.Error("create snapshot dir err:", err)
+					return
+				}
+			}
+			if msg.cmd == MSG_STORAGE_SYNC_BLOCK {
+				err = receiver.WriteBlock(msg.body.(*SyncBlock))
+			} else if msg.cmd == MSG_STORAGE_SYNC_INDEX {
+				receiver.WriteIndex(msg.body.(*SyncIndex))
+			} else {
+				receiver.WriteTombstone(msg.body.(*SyncTombstone))
+			}
+			if err != nil {
+				log.Error("write snapshot err:", err)
+				return
+			}
+			continue
+		}
 
 		if msg.cmd == MSG_STORAGE_SYNC_MESSAGE {
 			emsg := msg.body.(*EMessage)
-			err := storage.SaveSyncMessage(emsg)
+			err := storage.SaveSyncMessage(emsg, storage.BlockVersion(storage.getBlockNo(emsg.msgid)))
 			if err != nil {
 				log.Error("Error when syncing message, msgid: ", emsg.msgid)
 				return
@@ -208,15 +422,62 @@ func (slave *Slave) RunOnce(conn *net.TCPConn) {
 				log.Error("Error when syncing batch message, firstId-", mb.firstId, ", lastId-", mb.lastId)
 				return
 			}
+			slave.updateSynced()
+		} else if msg.cmd == MSG_STORAGE_SYNC_HEARTBEAT {
+			atomic.StoreInt32(&slave.heartbeat, 1)
+			if slave.pendingTime == 0 {
+				slave.pendingMsgid = msg.body.(*SyncCursor).msgid
+				slave.pendingTime = time.Now().Unix()
+			}
+			slave.updateSynced()
+			continue
+		} else if msg.cmd == MSG_STORAGE_SYNC_ACK_REQUEST {
+			ack = true
+			flush = msg.flag&SyncAckFlagNoFlush == 0
+		} else if msg.cmd == MSG_STORAGE_SYNC_SNAPSHOT_END {
+			if receiver == nil {
+				receiver, err = NewSnapshotReceiver(storage.root)
+				if err != nil {
+					log.Error("create snapshot dir err:", err)
+					return
+				}
+			}
+			err = receiver.Install(msg.body.(*SyncCursor).msgid)
+			if err != nil {
+				log.Error("install snapshot err:", err)
+				return
+			}
+			receiver = nil
+		} else if msg.cmd == MSG_STORAGE_SYNC_WATERMARK {
+			storage.SetWatermark(msg.body.(*SyncCursor).msgid)
 		} else {
 			log.Error("unknown message cmd:", Command(msg.cmd))
+			continue
+		}
+
+		if ack {
+			if flush {
+				//写入磁盘之后再回复ack
+				storage.Flush()
+			}
+			seq += 1
+			err := SendMessage(conn, &Message{cmd: MSG_STORAGE_SYNC_ACK, seq: seq, body: &SyncCursor{msgid: storage.NextMsgid()}})
+			if err != nil {
+				return
+			}
 		}
 	}
 }
 
 func (slave *Slave) Run() {
+	defer close(slave.done)
 	nsleep := 100
 	for {
+		select {
+		case <-slave.quit:
+			return
+		default:
+		}
 		conn, err := net.Dial("tcp", slave.addr)
 		if err != nil {
 			log.Info("connect master server error:", err)
@@ -225,7 +486,11 @@ func (slave *Slave) Run() {
 				nsleep = 60 * 1000
 			}
 			log.Info("slave sleep:", nsleep)
-			time.Sleep(time.Duration(nsleep) * time.Millisecond)
+			select {
+			case <-slave.quit:
+				return
+			case <-time.After(time.Duration(nsleep) * time.Millisecond):
+			}
 			continue
 		}
 		tconn := conn.(*net.TCPConn)
@@ -237,6 +502,43 @@ func (slave *Slave) Run() {
 	}
 }
 
+// Stop 断开和master的连接，返回时已经收到的消息都已经写入
+func (slave *Slave) Stop() {
+	slave.mutex.Lock()
+	close(slave.quit)
+	if slave.conn != nil {
+		_ = slave.conn.Close()
+	}
+	slave.mutex.Unlock()
+	<-slave.done
+}
+
+// updateSynced 已经写入的位置达到心跳中master的位置之后，数据至少和收到心跳时一样新
+func (slave *Slave) updateSynced() {
+	if slave.pendingTime == 0 || storage.NextMsgid() < slave.pendingMsgid {
+		return
+	}
+	atomic.StoreInt64(&slave.syncedTime, slave.pendingTime)
+	slave.pendingTime = 0
+}
+
+// Staleness 数据最多落后master的时间(秒)
+func (slave *Slave) Staleness() int64 {
+	now := time.Now().Unix()
+	if atomic.LoadInt32(&slave.heartbeat) == 0 {
+		//旧版本的master不发送心跳，只能根据连接是否正常判断
+		if atomic.LoadInt32(&slave.connected) > 0 {
+			return 0
+		}
+		return now - atomic.LoadInt64(&slave.lastSync)
+	}
+	synced := atomic.LoadInt64(&slave.syncedTime)
+	if synced == 0 {
+		return UnknownStaleness
+	}
+	return now - synced
+}
+
 func (slave *Slave) Start() {
 	go slave.Run()
 }
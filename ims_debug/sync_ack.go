@@ -0,0 +1,101 @@
+package main
+
+import "time"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//半同步复制: sync_ack_count大于0时，SavePeerMessage等待至少sync_ack_count个slave写入之后才返回
+//超过sync_ack_timeout没有足够的slave回复时，仍然返回成功，退化为异步复制
+//连接的slave不足时不等待，超时之后直到slave写入超时的消息之前都不等待，避免每次写入都等待超时
+
+//超时的msgid, 0表示没有超时, slave写入之后恢复半同步复制
+var syncAckLagging int64
+
+func (master *Master) NotifyAck() {
+	master.ackMutex.Lock()
+	defer master.ackMutex.Unlock()
+	close(master.ackNotify)
+	master.ackNotify = make(chan struct{})
+}
+
+func (master *Master) ackChan() chan struct{} {
+	master.ackMutex.Lock()
+	defer master.ackMutex.Unlock()
+	return master.ackNotify
+}
+
+// AckCount 已经写入msgid的slave数量
+func (master *Master) AckCount(msgid int64) int {
+	count := 0
+	for c := range master.CloneClientSet() {
+		if atomic.LoadInt64(&c.ackMsgid) > msgid {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitAck 等待count个slave写入msgid, 超时返回false
+func (master *Master) WaitAck(msgid int64, count int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		//先取得通知的chan, 避免检查之后收到的ack被错过
+		ch := master.ackChan()
+		if master.AckCount(msgid) >= count {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// WaitSyncAck 半同步模式下等待slave写入msgid
+func WaitSyncAck(msgid int64) {
+	if config.syncAckCount <= 0 {
+		return
+	}
+	if len(master.CloneClientSet()) < config.syncAckCount {
+		atomic.AddInt64(&serverSummary.syncAckAsyncCount, 1)
+		return
+	}
+	if lagging := atomic.LoadInt64(&syncAckLagging); lagging > 0 {
+		if master.AckCount(lagging) < config.syncAckCount {
+			atomic.AddInt64(&serverSummary.syncAckAsyncCount, 1)
+			return
+		}
+		if atomic.CompareAndSwapInt64(&syncAckLagging, lagging, 0) {
+			log.Infof("slaves caught up msgid:%d, wait slave ack again", lagging)
+		}
+	}
+	begin := time.Now()
+	if !master.WaitAck(msgid, config.syncAckCount, config.syncAckTimeout) {
+		atomic.AddInt64(&serverSummary.syncAckTimeoutCount, 1)
+		atomic.CompareAndSwapInt64(&syncAckLagging, 0, msgid)
+		log.Warningf("wait slave ack msgid:%d timeout, acked slaves:%d", msgid, master.AckCount(msgid))
+		return
+	}
+	atomic.AddInt64(&serverSummary.syncAckCount, 1)
+	atomic.AddInt64(&serverSummary.syncAckWaitTime, int64(time.Since(begin)/time.Microsecond))
+}
+
+// GetSlaveStats 每个slave的复制延迟
+func GetSlaveStats() []map[string]interface{} {
+	next := storage.NextMsgid()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	stats := make([]map[string]interface{}, 0)
+	for c := range master.CloneClientSet() {
+		ackMsgid := atomic.LoadInt64(&c.ackMsgid)
+		obj := make(map[string]interface{})
+		obj["addr"] = c.conn.RemoteAddr().String()
+		obj["sent_msgid"] = atomic.LoadInt64(&c.sentMsgid)
+		obj["ack_msgid"] = ackMsgid
+		obj["lag_bytes"] = next - ackMsgid
+		obj["last_ack_ms"] = now - atomic.LoadInt64(&c.ackTime)
+		stats = append(stats, obj)
+	}
+	return stats
+}
@@ -0,0 +1,499 @@
+package main
+
+import "os"
+import "io"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "net/url"
+import "net/http"
+import "hash/crc32"
+import "encoding/binary"
+import log "github.com/golang/glog"
+
+//主从一致性校验: 每个block按照1M分段计算crc32, slave通过sync端口向master请求同一范围的校验值
+//不一致的分段可以从master重新获取
+
+const MSG_STORAGE_CHECKSUM_REQUEST = 229 //slave->master BlockRange, 请求block前length字节的校验值
+const MSG_STORAGE_CHECKSUM = 230         //master->slave BlockChecksum
+const MSG_STORAGE_BLOCK_REQUEST = 231    //slave->master BlockRange, master回复MSG_STORAGE_SYNC_BLOCK, 以空的block结束
+
+const ChecksumSegmentSize = 1024 * 1024
+
+//校验连接上每个请求的超时时间
+const VerifyTimeout = 30 * time.Second
+
+func init() {
+	messageCreators[MSG_STORAGE_CHECKSUM_REQUEST] = func() IMessage { return new(BlockRange) }
+	messageCreators[MSG_STORAGE_CHECKSUM] = func() IMessage { return new(BlockChecksum) }
+	messageCreators[MSG_STORAGE_BLOCK_REQUEST] = func() IMessage { return new(BlockRange) }
+
+	messageDescriptions[MSG_STORAGE_CHECKSUM_REQUEST] = "MSG_STORAGE_CHECKSUM_REQUEST"
+	messageDescriptions[MSG_STORAGE_CHECKSUM] = "MSG_STORAGE_CHECKSUM"
+	messageDescriptions[MSG_STORAGE_BLOCK_REQUEST] = "MSG_STORAGE_BLOCK_REQUEST"
+}
+
+//region BlockRange
+
+type BlockRange struct {
+	blockNo int32
+	offset  int64
+	length  int64
+}
+
+func (r *BlockRange) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.blockNo)
+	binary.Write(buffer, binary.BigEndian, r.offset)
+	binary.Write(buffer, binary.BigEndian, r.length)
+	return buffer.Bytes()
+}
+
+func (r *BlockRange) FromData(buff []byte) bool {
+	if len(buff) < 20 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.blockNo)
+	binary.Read(buffer, binary.BigEndian, &r.offset)
+	binary.Read(buffer, binary.BigEndian, &r.length)
+	return true
+}
+
+//endregion
+
+//region BlockChecksum
+
+type BlockChecksum struct {
+	blockNo int32
+	size    int64 //master上block文件的大小, 文件不存在时为-1
+	sums    []uint32
+}
+
+func (c *BlockChecksum) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.blockNo)
+	binary.Write(buffer, binary.BigEndian, c.size)
+	binary.Write(buffer, binary.BigEndian, int32(len(c.sums)))
+	for _, sum := range c.sums {
+		binary.Write(buffer, binary.BigEndian, sum)
+	}
+	return buffer.Bytes()
+}
+
+func (c *BlockChecksum) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	var count int32
+	binary.Read(buffer, binary.BigEndian, &c.blockNo)
+	binary.Read(buffer, binary.BigEndian, &c.size)
+	binary.Read(buffer, binary.BigEndian, &count)
+	if count < 0 || int(count)*4 != buffer.Len() {
+		return false
+	}
+	c.sums = make([]uint32, count)
+	for i := range c.sums {
+		binary.Read(buffer, binary.BigEndian, &c.sums[i])
+	}
+	return true
+}
+
+//endregion
+
+//已经写满的block不会再改变，缓存整个文件的校验值
+var checksumMutex sync.Mutex
+var checksumCache = make(map[int]*BlockChecksum)
+
+func blockPath(blockNo int) string {
+	return fmt.Sprintf("%s/message_%d", storage.root, blockNo)
+}
+
+func blockSize(blockNo int) int64 {
+	info, err := os.Stat(blockPath(blockNo))
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// computeChecksum block前size字节每一段的crc32, 压缩的block按照压缩之前的格式计算
+func computeChecksum(blockNo int, size int64) (*BlockChecksum, error) {
+	c := &BlockChecksum{blockNo: int32(blockNo), size: -1}
+	file := storage.openBlockReader(blockNo)
+	if file == nil {
+		return c, nil
+	}
+	defer file.Close()
+
+	var err error
+	c.size, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > c.size {
+		size = c.size
+	}
+
+	buf := make([]byte, ChecksumSegmentSize)
+	var offset int64
+	for offset < size {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		_, err := io.ReadFull(file, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		c.sums = append(c.sums, crc32.ChecksumIEEE(buf[:n]))
+		offset += n
+	}
+	return c, nil
+}
+
+// BlockChecksums master上使用, size小于0时计算整个文件
+// slave每次重新计算，避免缓存掩盖之后的磁盘错误
+func BlockChecksums(blockNo int, size int64) (*BlockChecksum, error) {
+	sealed := blockNo < storage.getBlockNo(storage.NextMsgid())
+	if sealed {
+		checksumMutex.Lock()
+		c, ok := checksumCache[blockNo]
+		checksumMutex.Unlock()
+		if ok && (size < 0 || size == c.size) {
+			return c, nil
+		}
+	}
+
+	c, err := computeChecksum(blockNo, size)
+	if err != nil {
+		return nil, err
+	}
+	if sealed && c.size >= 0 && (size < 0 || size == c.size) {
+		checksumMutex.Lock()
+		checksumCache[blockNo] = c
+		checksumMutex.Unlock()
+	}
+	return c, nil
+}
+
+func invalidateChecksum(blockNo int) {
+	checksumMutex.Lock()
+	defer checksumMutex.Unlock()
+	delete(checksumCache, blockNo)
+}
+
+// ServeVerify master处理slave的校验和修复请求
+func (client *SyncClient) ServeVerify(msg *Message) {
+	seq := 0
+	for msg != nil {
+		var err error
+		switch msg.cmd {
+		case MSG_STORAGE_CHECKSUM_REQUEST:
+			r := msg.body.(*BlockRange)
+			var c *BlockChecksum
+			c, err = BlockChecksums(int(r.blockNo), r.length)
+			if err != nil {
+				log.Warning("block checksum err:", err)
+				return
+			}
+			seq++
+			err = SendMessage(client.conn, &Message{cmd: MSG_STORAGE_CHECKSUM, seq: seq, body: c})
+		case MSG_STORAGE_BLOCK_REQUEST:
+			err = client.sendRange(msg.body.(*BlockRange), &seq)
+		default:
+			log.Warning("unexpected verify message cmd:", Command(msg.cmd))
+			return
+		}
+		if err != nil {
+			return
+		}
+		msg = ReceiveMessage(client.conn)
+	}
+}
+
+// sendRange 发送block的一段，以空的block结束
+func (client *SyncClient) sendRange(r *BlockRange, seq *int) error {
+	file := storage.openBlockReader(int(r.blockNo))
+	if file != nil {
+		defer file.Close()
+		buf := make([]byte, SnapshotChunkSize)
+		offset := r.offset
+		end := r.offset + r.length
+		_, err := file.Seek(offset, io.SeekStart)
+		for offset < end && err == nil {
+			n := int64(len(buf))
+			if end-offset < n {
+				n = end - offset
+			}
+			var m int
+			m, err = io.ReadFull(file, buf[:n])
+			if m > 0 {
+				*seq = *seq + 1
+				block := &SyncBlock{blockNo: r.blockNo, offset: offset, data: buf[:m]}
+				if err := SendMessage(client.conn, &Message{cmd: MSG_STORAGE_SYNC_BLOCK, seq: *seq, body: block}); err != nil {
+					return err
+				}
+				offset += int64(m)
+			}
+		}
+	}
+	*seq = *seq + 1
+	block := &SyncBlock{blockNo: r.blockNo, offset: r.offset + r.length}
+	return SendMessage(client.conn, &Message{cmd: MSG_STORAGE_SYNC_BLOCK, seq: *seq, body: block})
+}
+
+// DivergentRange slave和master不一致的一段
+type DivergentRange struct {
+	BlockNo int   `json:"block"`
+	Offset  int64 `json:"offset"`
+	Length  int64 `json:"length"`
+}
+
+type VerifyReport struct {
+	Master        string           `json:"master"`
+	Time          int64            `json:"time"`
+	BlocksChecked int              `json:"blocks_checked"`
+	BytesChecked  int64            `json:"bytes_checked"`
+	Divergent     []DivergentRange `json:"divergent"`
+	Error         string           `json:"error,omitempty"`
+}
+
+//同一时间只有一个校验或者修复
+var verifyMutex sync.Mutex
+var lastReport *VerifyReport
+
+type verifyConn struct {
+	conn *net.TCPConn
+	seq  int
+}
+
+func dialVerify(addr string) (*verifyConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, VerifyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyConn{conn: conn.(*net.TCPConn)}, nil
+}
+
+func (vc *verifyConn) request(cmd int, r *BlockRange) error {
+	vc.seq++
+	_ = vc.conn.SetDeadline(time.Now().Add(VerifyTimeout))
+	return SendMessage(vc.conn, &Message{cmd: cmd, seq: vc.seq, body: r})
+}
+
+func (vc *verifyConn) checksum(blockNo int, size int64) (*BlockChecksum, error) {
+	err := vc.request(MSG_STORAGE_CHECKSUM_REQUEST, &BlockRange{blockNo: int32(blockNo), length: size})
+	if err != nil {
+		return nil, err
+	}
+	msg := ReceiveMessage(vc.conn)
+	if msg == nil || msg.cmd != MSG_STORAGE_CHECKSUM {
+		return nil, errors.New("master doesn't support verify")
+	}
+	return msg.body.(*BlockChecksum), nil
+}
+
+// VerifyReplica 比较slave和master上所有block的校验值
+func VerifyReplica() *VerifyReport {
+	report := &VerifyReport{Time: time.Now().Unix(), Divergent: make([]DivergentRange, 0)}
+	roleMutex.RLock()
+	if slave != nil {
+		report.Master = slave.addr
+	}
+	roleMutex.RUnlock()
+	if len(report.Master) == 0 {
+		report.Error = "not a slave"
+		return report
+	}
+
+	vc, err := dialVerify(report.Master)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	defer vc.conn.Close()
+
+	lastBlock := storage.getBlockNo(storage.NextMsgid())
+	for i := storage.getBlockNo(storage.Watermark()); i <= lastBlock; i++ {
+		local, err := computeChecksum(i, -1)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		remote, err := vc.checksum(i, local.size)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		report.BlocksChecked++
+		if local.size > 0 {
+			report.BytesChecked += local.size
+		}
+
+		//slave上不存在的block整个作为不一致的部分，不需要逐段比较
+		for j := 0; local.size >= 0 && (j < len(local.sums) || j < len(remote.sums)); j++ {
+			if j < len(local.sums) && j < len(remote.sums) && local.sums[j] == remote.sums[j] {
+				continue
+			}
+			offset := int64(j) * ChecksumSegmentSize
+			//slave上缺少的段按照master上的长度计算
+			size := local.size
+			if j >= len(local.sums) {
+				size = remote.size
+			}
+			length := size - offset
+			if length > ChecksumSegmentSize {
+				length = ChecksumSegmentSize
+			}
+			if length <= 0 {
+				continue
+			}
+			report.Divergent = append(report.Divergent, DivergentRange{i, offset, length})
+		}
+		//已经写满的block, slave上缺少结尾的部分
+		if i < lastBlock && remote.size > local.size {
+			offset := local.size
+			if offset < 0 {
+				offset = 0
+			}
+			report.Divergent = append(report.Divergent, DivergentRange{i, offset, remote.size - offset})
+		}
+	}
+	return report
+}
+
+// repairRange 从master获取一段数据，覆盖slave上的block文件
+func repairRange(vc *verifyConn, r DivergentRange) error {
+	//master发送的是归档和压缩之前的格式
+	if err := storage.restoreBlock(r.BlockNo); err != nil {
+		return err
+	}
+	if err := storage.expandBlock(r.BlockNo); err != nil {
+		return err
+	}
+	err := vc.request(MSG_STORAGE_BLOCK_REQUEST, &BlockRange{blockNo: int32(r.BlockNo), offset: r.Offset, length: r.Length})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(blockPath(r.BlockNo), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for {
+		msg := ReceiveStorageSyncMessage(vc.conn)
+		if msg == nil || msg.cmd != MSG_STORAGE_SYNC_BLOCK {
+			return errors.New("receive block err")
+		}
+		block := msg.body.(*SyncBlock)
+		if len(block.data) == 0 {
+			break
+		}
+		if _, err := file.WriteAt(block.data, block.offset); err != nil {
+			return err
+		}
+	}
+	invalidateChecksum(r.BlockNo)
+	storage.resetBlockVersions()
+	return file.Sync()
+}
+
+// RepairReplica 修复上一次校验发现的不一致，之后重建消息索引
+func RepairReplica(ranges []DivergentRange) error {
+	roleMutex.RLock()
+	var addr string
+	if slave != nil {
+		addr = slave.addr
+	}
+	roleMutex.RUnlock()
+	if len(addr) == 0 {
+		return errors.New("not a slave")
+	}
+
+	vc, err := dialVerify(addr)
+	if err != nil {
+		return err
+	}
+	defer vc.conn.Close()
+
+	//修复期间不写入同步的消息
+	storage.mutex.Lock()
+	for _, r := range ranges {
+		log.Infof("repair block:%d offset:%d length:%d", r.BlockNo, r.Offset, r.Length)
+		if err = repairRange(vc, r); err != nil {
+			break
+		}
+	}
+	storage.messageIndex = make(map[UserID]*UserIndex)
+	storage.createPeerIndex()
+	storage.mutex.Unlock()
+
+	storage.flushIndex()
+	return err
+}
+
+// Verify 校验slave和master是否一致 /verify
+func Verify(rw http.ResponseWriter, req *http.Request) {
+	verifyMutex.Lock()
+	defer verifyMutex.Unlock()
+	report := VerifyReplica()
+	lastReport = report
+	WriteHttpObj(reportObj(report), rw)
+}
+
+// Repair 从master重新获取不一致的数据 /repair?block=&offset=&length=, 没有参数时修复上一次校验的结果
+func Repair(rw http.ResponseWriter, req *http.Request) {
+	verifyMutex.Lock()
+	defer verifyMutex.Unlock()
+
+	m, _ := url.ParseQuery(req.URL.RawQuery)
+	var ranges []DivergentRange
+	if len(m.Get("block")) > 0 {
+		blockNo, err1 := strconv.Atoi(m.Get("block"))
+		offset, err2 := strconv.ParseInt(m.Get("offset"), 10, 64)
+		length, err3 := strconv.ParseInt(m.Get("length"), 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || offset < 0 || length <= 0 {
+			WriteHttpError(400, "invalid query param", rw)
+			return
+		}
+		ranges = append(ranges, DivergentRange{blockNo, offset, length})
+	} else if lastReport != nil {
+		ranges = lastReport.Divergent
+	}
+	if len(ranges) == 0 {
+		WriteHttpError(400, "nothing to repair", rw)
+		return
+	}
+
+	err := RepairReplica(ranges)
+	if err != nil {
+		log.Warning("repair err:", err)
+		WriteHttpError(500, err.Error(), rw)
+		return
+	}
+	report := VerifyReplica()
+	lastReport = report
+	WriteHttpObj(reportObj(report), rw)
+}
+
+func reportObj(report *VerifyReport) map[string]interface{} {
+	obj := make(map[string]interface{})
+	obj["master"] = report.Master
+	obj["time"] = report.Time
+	obj["blocks_checked"] = report.BlocksChecked
+	obj["bytes_checked"] = report.BytesChecked
+	obj["divergent"] = report.Divergent
+	if len(report.Error) > 0 {
+		obj["error"] = report.Error
+	}
+	return obj
+}
@@ -0,0 +1,319 @@
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "bufio"
+import "math"
+import "time"
+import "strings"
+import "github.com/gomodule/redigo/redis"
+import "github.com/valyala/gorpc"
+import log "github.com/golang/glog"
+import "im_research/hashring"
+
+//和im_debug/cluster.go中的定义保持一致
+const ClusterKey = "im_cluster"
+
+var (
+	oldPool       = flag.String("old", "", "current storage_rpc_pool")
+	newPool       = flag.String("new", "", "new storage_rpc_pool")
+	shardHash     = flag.String("hash", "ring", "shard hash of new pool, ring or mod")
+	oldShardHash  = flag.String("old_hash", "", "shard hash of old pool, default same as -hash")
+	replicas      = flag.Int("replicas", hashring.DefaultReplicas, "virtual nodes of weight 1")
+	appid         = flag.Int64("appid", 0, "only move users of appid, 0 means all")
+	batch         = flag.Int("batch", 500, "messages per import call")
+	redisAddress  = flag.String("redis", "127.0.0.1:6379", "redis address")
+	redisPassword = flag.String("redis_password", "", "redis password")
+	redisDb       = flag.Int("redis_db", 0, "redis db")
+	wait          = flag.Duration("wait", 30*time.Second, "time for all im to reload cluster")
+	dryRun        = flag.Bool("dry_run", false, "only print users to move")
+	finish        = flag.Bool("finish", false, "end migration window, im stop reading old storage")
+	clusterFile   = flag.Bool("cluster_file", false, "im load cluster from cluster_file, print the change instead of publishing to redis")
+)
+
+// Move 一个用户从源ims迁移到目标ims
+type Move struct {
+	appid int64
+	uid   int64
+	src   string
+	dst   string
+
+	watermark int64 //已经复制的源ims上最新的msgid
+	skipped   bool
+}
+
+func newClient(addr string) *gorpc.DispatcherClient {
+	c := &gorpc.Client{
+		Conns:          1,
+		Addr:           addr,
+		RequestTimeout: 60 * time.Second,
+	}
+	c.Start()
+
+	dispatcher := gorpc.NewDispatcher()
+	dispatcher.AddFunc("ListUsers", ListUsersInterface)
+	dispatcher.AddFunc("ExportUserMessages", ExportUserMessagesInterface)
+	dispatcher.AddFunc("ImportUserMessages", ImportUserMessagesInterface)
+	dispatcher.AddFunc("FreezeUsers", FreezeUsersInterface)
+	return dispatcher.NewFuncClient(c)
+}
+
+func newRing(pool string, mode string) *hashring.Ring {
+	nodes, err := hashring.ParseNodes(strings.Fields(pool))
+	if err != nil {
+		log.Fatal("parse pool err:", err)
+	}
+	if len(nodes) == 0 {
+		log.Fatal("empty pool")
+	}
+	return hashring.NewWithMode(mode, nodes, *replicas)
+}
+
+func ringPool(r *hashring.Ring) string {
+	nodes := make([]string, 0, r.Len())
+	for _, node := range r.Nodes() {
+		nodes = append(nodes, node.String())
+	}
+	return strings.Join(nodes, " ")
+}
+
+func dialRedis() redis.Conn {
+	conn, err := redis.Dial("tcp", *redisAddress,
+		redis.DialPassword(*redisPassword), redis.DialDatabase(*redisDb))
+	if err != nil {
+		log.Fatal("dial redis err:", err)
+	}
+	return conn
+}
+
+// export 读取用户在after之后的全部消息，按照从旧到新的顺序返回
+func export(dc *gorpc.DispatcherClient, appid, uid, after int64) ([]*ExportMessage, int64, error) {
+	messages := make([]*ExportMessage, 0)
+	var lastMsgid int64
+	var cursor int64
+	for {
+		r := &ExportRequest{Appid: appid, Uid: uid, After: after, Cursor: cursor, Limit: int32(*batch)}
+		resp, err := dc.Call("ExportUserMessages", r)
+		if err != nil {
+			return nil, 0, err
+		}
+		er := resp.(*ExportResponse)
+		if lastMsgid == 0 {
+			lastMsgid = er.LastMsgid
+		}
+		messages = append(messages, er.Messages...)
+		if er.Cursor == 0 {
+			break
+		}
+		cursor = er.Cursor
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, lastMsgid, nil
+}
+
+// copyMessages 复制源ims上watermark之后的消息到目标ims
+func copyMessages(clients map[string]*gorpc.DispatcherClient, m *Move) error {
+	messages, lastMsgid, err := export(clients[m.src], m.appid, m.uid, m.watermark)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(messages); i += *batch {
+		end := i + *batch
+		if end > len(messages) {
+			end = len(messages)
+		}
+		r := &ImportRequest{Appid: m.appid, Uid: m.uid, Messages: messages[i:end]}
+		_, err := clients[m.dst].Call("ImportUserMessages", r)
+		if err != nil {
+			return err
+		}
+	}
+	if lastMsgid > m.watermark {
+		m.watermark = lastMsgid
+	}
+	return nil
+}
+
+// freezeUsers 源ims冻结或者解除冻结迁移的用户
+func freezeUsers(clients map[string]*gorpc.DispatcherClient, moves []*Move, frozen bool) error {
+	users := make(map[string][]*ExportUser)
+	for _, m := range moves {
+		if m.skipped {
+			continue
+		}
+		users[m.src] = append(users[m.src], &ExportUser{Appid: m.appid, Uid: m.uid})
+	}
+	for src, u := range users {
+		_, err := clients[src].Call("FreezeUsers", &FreezeRequest{Users: u, Frozen: frozen})
+		if err != nil {
+			return fmt.Errorf("freeze users of %s err:%s", src, err)
+		}
+	}
+	return nil
+}
+
+// checkClusterRedis im没有从redis读取集群成员时切换路由不会生效，在复制之前退出
+func checkClusterRedis() {
+	conn := dialRedis()
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("EXISTS", ClusterKey))
+	if err != nil {
+		log.Fatal("check cluster err:", err)
+	}
+	if !exists {
+		log.Fatalf("%s not found in redis, im is not using cluster_redis, run with -cluster_file", ClusterKey)
+	}
+}
+
+// waitClusterFile 打印需要写入所有im的cluster_file的内容，等待确认
+func waitClusterFile(lines ...string) {
+	fmt.Println("update cluster_file of all im:")
+	for _, line := range lines {
+		fmt.Println("    " + line)
+	}
+	fmt.Println("press enter after all cluster files are updated")
+	_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatal("read stdin err:", err)
+	}
+}
+
+func publishCluster(conn redis.Conn, args ...interface{}) {
+	_, err := conn.Do("HSET", append([]interface{}{ClusterKey}, args...)...)
+	if err != nil {
+		log.Fatal("hset cluster err:", err)
+	}
+	_, err = conn.Do("PUBLISH", ClusterKey, "reshard")
+	if err != nil {
+		log.Warning("publish cluster err:", err)
+	}
+}
+
+func finishMigration() {
+	if *clusterFile {
+		fmt.Println("remove storage_rpc_pool_old from cluster_file of all im to finish migration")
+		return
+	}
+	conn := dialRedis()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", ClusterKey, "storage_rpc_pool_old")
+	if err != nil {
+		log.Fatal("hdel cluster err:", err)
+	}
+	_, err = conn.Do("PUBLISH", ClusterKey, "reshard")
+	if err != nil {
+		log.Warning("publish cluster err:", err)
+	}
+	fmt.Println("migration finished")
+}
+
+func main() {
+	flag.Parse()
+	if *finish {
+		finishMigration()
+		return
+	}
+	if len(*oldPool) == 0 || len(*newPool) == 0 {
+		fmt.Println("usage: reshard -old \"ip:port ...\" -new \"ip:port ...\" [-hash ring] [-dry_run] [-cluster_file]")
+		fmt.Println("       reshard -finish [-cluster_file]")
+		return
+	}
+	if len(*oldShardHash) == 0 {
+		*oldShardHash = *shardHash
+	}
+
+	oldRing := newRing(*oldPool, *oldShardHash)
+	newRing := newRing(*newPool, *shardHash)
+
+	clients := make(map[string]*gorpc.DispatcherClient)
+	for _, addr := range append(oldRing.Names(), newRing.Names()...) {
+		if _, ok := clients[addr]; !ok {
+			clients[addr] = newClient(addr)
+		}
+	}
+
+	//找出所属ims发生变化的用户
+	moves := make([]*Move, 0)
+	for _, src := range oldRing.Names() {
+		resp, err := clients[src].Call("ListUsers", *appid)
+		if err != nil {
+			log.Fatalf("list users of %s err:%s", src, err)
+		}
+		users := resp.([]*ExportUser)
+		count := 0
+		for _, u := range users {
+			if oldRing.Get(u.Uid) != src {
+				continue
+			}
+			dst := newRing.Get(u.Uid)
+			if dst == src {
+				continue
+			}
+			m := &Move{appid: u.Appid, uid: u.Uid, src: src, dst: dst}
+			moves = append(moves, m)
+			count++
+		}
+		fmt.Printf("%s users:%d move:%d\n", src, len(users), count)
+	}
+	if *dryRun {
+		return
+	}
+	if !*clusterFile {
+		checkClusterRedis()
+	}
+
+	//第一轮复制，源ims继续提供服务
+	begin := time.Now()
+	for _, m := range moves {
+		r := &ExportRequest{Appid: m.appid, Uid: m.uid, After: math.MaxInt64}
+		resp, err := clients[m.dst].Call("ExportUserMessages", r)
+		if err != nil {
+			log.Fatalf("check %s err:%s", m.dst, err)
+		}
+		if resp.(*ExportResponse).LastMsgid > 0 {
+			//重复执行时目标ims上已经存在该用户的消息
+			log.Warningf("appid:%d uid:%d exists in %s, skip", m.appid, m.uid, m.dst)
+			m.skipped = true
+			continue
+		}
+		if err := copyMessages(clients, m); err != nil {
+			log.Fatalf("copy appid:%d uid:%d err:%s", m.appid, m.uid, err)
+		}
+	}
+	fmt.Printf("copy %d users used:%s\n", len(moves), time.Since(begin))
+
+	//冻结之后源ims不再写入迁移的用户，复制最后的增量之后目标ims上的消息和源ims的顺序一致
+	//冻结期间用户发送的消息失败，客户端重试时写入目标ims
+	if err := freezeUsers(clients, moves, true); err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range moves {
+		if m.skipped {
+			continue
+		}
+		if err := copyMessages(clients, m); err != nil {
+			if err := freezeUsers(clients, moves, false); err != nil {
+				log.Error(err)
+			}
+			log.Fatalf("copy delta appid:%d uid:%d err:%s", m.appid, m.uid, err)
+		}
+	}
+
+	//切换路由，迁移期间im读取消息时会查询之前的ims
+	if *clusterFile {
+		waitClusterFile("storage_rpc_pool="+ringPool(newRing), "storage_rpc_pool_old="+ringPool(oldRing))
+	} else {
+		conn := dialRedis()
+		defer conn.Close()
+		publishCluster(conn, "storage_rpc_pool", ringPool(newRing), "storage_rpc_pool_old", ringPool(oldRing))
+	}
+	fmt.Printf("routing flipped, wait %s for all im to reload\n", *wait)
+	time.Sleep(*wait)
+
+	fmt.Printf("reshard done, run \"reshard -finish\" to end migration window\n")
+	log.Flush()
+}
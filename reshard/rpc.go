@@ -0,0 +1,57 @@
+package main
+
+//和ims_debug/reshard.go中的定义保持一致
+
+type ExportUser struct {
+	Appid int64
+	Uid   int64
+}
+
+type ExportRequest struct {
+	Appid  int64
+	Uid    int64
+	After  int64
+	Cursor int64
+	Limit  int32
+}
+
+type ExportMessage struct {
+	Msgid    int64
+	DeviceId int64
+	Flag     int32
+	Cmd      int32
+	Raw      []byte
+}
+
+type ExportResponse struct {
+	Messages  []*ExportMessage
+	Cursor    int64
+	LastMsgid int64
+}
+
+type ImportRequest struct {
+	Appid    int64
+	Uid      int64
+	Messages []*ExportMessage
+}
+
+type FreezeRequest struct {
+	Users  []*ExportUser
+	Frozen bool
+}
+
+func ListUsersInterface(addr string, appid int64) []*ExportUser {
+	return nil
+}
+
+func ExportUserMessagesInterface(addr string, r *ExportRequest) *ExportResponse {
+	return nil
+}
+
+func ImportUserMessagesInterface(addr string, r *ImportRequest) ([]int64, error) {
+	return nil, nil
+}
+
+func FreezeUsersInterface(addr string, r *FreezeRequest) (int, error) {
+	return 0, nil
+}